@@ -29,6 +29,14 @@ func main() {
 
 	init_file := flag.Bool("init", false, "Create a new configuration file")
 	conf_file := flag.String("config", "conf.yml", "Configuration file")
+
+	token_create := flag.String("token-create", "", "Create a scoped API token with the given name")
+	token_ops := flag.String("ops", "download", "Operations allowed for -token-create (upload,download,delete,list)")
+	token_prefixes := flag.String("prefixes", "/", "Path prefixes allowed for -token-create")
+	token_access := flag.String("access", "public", "Access tiers allowed for -token-create (public,private)")
+	token_ttl := flag.Duration("ttl", 0, "Lifetime of a token from -token-create, 0 never expires")
+	token_list := flag.Bool("token-list", false, "List API tokens")
+	token_revoke := flag.String("token-revoke", "", "Revoke the API token with the given name")
 	flag.Parse()
 
 	config_dir, err := bs.ConfDir()
@@ -54,6 +62,21 @@ func main() {
 		return
 	}
 
+	if *token_create != "" {
+		TokenCreate(*token_create, *token_ops, *token_prefixes, *token_access, *token_ttl)
+		return
+	}
+
+	if *token_list {
+		TokenList()
+		return
+	}
+
+	if *token_revoke != "" {
+		TokenRevoke(*token_revoke)
+		return
+	}
+
 	if DidUpdate() {
 		return
 	}
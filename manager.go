@@ -35,26 +35,68 @@ compression_lvl: 2 # 1-4
 streaming: 
   enable: true
   codec: "auto" # See support/README.md for all options
+  hardware: "auto" # auto, software, nvenc, videotoolbox, vaapi, qsv or v4l2
   bitrate: 1000 # {bitrate}k
+  workers: 1 # concurrent transcode jobs
+  timeout: 21600 # seconds before a transcode is stopped
+  ladder: # renditions taller than the source are skipped, remove to encode the source once at bitrate
+    - name: 1080p
+      height: 1080
+      bitrate: 5000 # {bitrate}k
+    - name: 720p
+      height: 720
+      bitrate: 2800
+    - name: 480p
+      height: 480
+      bitrate: 1400
+    - name: 360p
+      height: 360
+      bitrate: 800
+  thumbnails: # sprite sheets and a WebVTT track for scrub previews
+    enable: true
+    interval: 10 # seconds between thumbnails
+    width: 160 # pixels
+    columns: 10 # thumbnails per sprite sheet row
+    rows: 10
+  audio_bitrates: [64, 128, 256] # {bitrate}k renditions of audio files, those above the source are skipped
 cache:
   enable: true
   n_items: 1000
   ttl: 3600 # seconds
+images: # resized copies, /bstore/<image>?width=256&height=256&fit=cover&format=webp&quality=85
+  enable: true
+  sizes: [64, 128, 256, 512, 1024, 2048] # allowed widths and heights
+  qualities: [60, 75, 85, 95] # allowed JPEG qualities
+  max_source_size: 33554432 # bytes
+  max_pixels: 50000000
+  max_cache_size: 1073741824 # bytes kept in ~/.bstore/images
 cors:
   allow_origins: 
     - "*"
   allow_methods: 
     - "GET"
+    - "HEAD"
     - "PUT"
+    - "POST"
+    - "PATCH"
     - "DELETE"
     - "OPTIONS"
   allow_headers: 
     - "Content-Type"
     - "Authorization"
     - "X-Access"
+    - "Tus-Resumable"
+    - "Upload-Length"
+    - "Upload-Metadata"
+    - "Upload-Offset"
   expose_headers: 
     - "Content-Type"
     - "Authorization"
+    - "Location"
+    - "Tus-Resumable"
+    - "Upload-Offset"
+    - "Upload-Length"
+    - "Upload-Expires"
   allow_credentials: true
   max_age: 3600           #seconds
 middleware:
@@ -65,6 +107,24 @@ middleware:
     enabled: true
     max_requests: 100
     duration: 60 # seconds
+    upload: # optional, overrides max_requests/duration for /api/upload
+      max_requests: 20
+      duration: 60
+    serve: # optional, overrides max_requests/duration for /bstore, /stream and /api/download
+      max_requests: 1000
+      duration: 60
+multipart:
+  enable: true # resumable uploads in parts at /api/multipart
+  max_size: 107374182400 # bytes, max size of an assembled upload, parts are limited by max_file_size
+  ttl: 86400 # seconds before an unfinished upload is removed
+tus:
+  enable: true # tus 1.0 resumable uploads at /api/tus
+  max_size: 107374182400 # bytes, max Upload-Length
+  ttl: 86400 # seconds before an unfinished upload is removed
+s3:
+  enable: false # S3 compatible API, needs BSTORE_S3_ACCESS_KEY and BSTORE_S3_SECRET_KEY
+  prefix: /s3 # endpoint is http://<host><prefix>, buckets are public and private
+  region: us-east-1
 `
 	config_dir, err := bstore.ConfDir()
 	if err != nil {
@@ -197,3 +257,81 @@ func DidUpdate() bool {
 func Version() {
 	fmt.Printf("bstore %s\n", version)
 }
+
+func TokenCreate(name, ops, prefixes, access string, ttl time.Duration) {
+	tokens_path, err := bstore.TokensPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	token := &bstore.Token{
+		Name:       name,
+		Operations: split_list(ops),
+		Prefixes:   split_list(prefixes),
+		Access:     split_list(access),
+	}
+	if ttl > 0 {
+		token.Expires = time.Now().Add(ttl).UTC()
+	}
+
+	secret, err := bstore.CreateToken(tokens_path, token)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Created token `%s` in %s\n", name, tokens_path)
+	fmt.Println("This secret is only shown once:")
+	fmt.Println(secret)
+}
+
+func TokenList() {
+	tokens_path, err := bstore.TokensPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tokens, err := bstore.ReadTokens(tokens_path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(tokens) == 0 {
+		fmt.Println("No tokens found")
+		return
+	}
+
+	for _, t := range tokens {
+		expires := "never"
+		if !t.Expires.IsZero() {
+			expires = t.Expires.Format(time.RFC3339)
+			if time.Now().After(t.Expires) {
+				expires += " (expired)"
+			}
+		}
+		fmt.Printf("%s\n  Operations: %v\n  Prefixes: %v\n  Access: %v\n  Expires: %s\n", t.Name, t.Operations, t.Prefixes, t.Access, expires)
+	}
+}
+
+func TokenRevoke(name string) {
+	tokens_path, err := bstore.TokensPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = bstore.RevokeToken(tokens_path, name); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Revoked token `%s`\n", name)
+}
+
+func split_list(s string) []string {
+	var ret []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
@@ -7,9 +7,13 @@ import (
 	"net/http"
 	"os"
 	"os/user"
+	"path"
 	"path/filepath"
 	"strings"
 
+	"github.com/cartersusi/bstore/pkg/jobs"
+	"github.com/cartersusi/bstore/pkg/storage"
+	"github.com/cartersusi/bstore/pkg/stream"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"gopkg.in/yaml.v2"
@@ -24,12 +28,19 @@ type CORSConfig struct {
 	MaxAge           int      `yaml:"max_age"`
 }
 
-type RateLimitConfig struct {
-	Enabled     bool  `yaml:"enabled"`
+type RateLimitRule struct {
 	MaxRequests int64 `yaml:"max_requests"`
 	Duration    int64 `yaml:"duration"`
 }
 
+type RateLimitConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	MaxRequests int64         `yaml:"max_requests"`
+	Duration    int64         `yaml:"duration"`
+	Upload      RateLimitRule `yaml:"upload"`
+	Serve       RateLimitRule `yaml:"serve"`
+}
+
 type MiddlewareConfig struct {
 	MaxPathLength     int             `yaml:"max_path_length"`
 	OnlyBstorePaths   bool            `yaml:"only_bstore_paths"`
@@ -40,7 +51,16 @@ type MiddlewareConfig struct {
 type StreamingConfig struct {
 	Enabled bool   `yaml:"enable"`
 	Codec   string `yaml:"codec"`
-	Bitrate int    `yaml:"bitrate"`
+	// Hardware forces an encoder from stream.Hardware, `auto` detects one.
+	Hardware string `yaml:"hardware"`
+	Bitrate  int    `yaml:"bitrate"`
+	Workers  int    `yaml:"workers"`
+	Timeout  int    `yaml:"timeout"`
+	// Ladder is the set of renditions to encode, Bitrate is used when empty.
+	Ladder     []stream.Rung     `yaml:"ladder"`
+	Thumbnails stream.Thumbnails `yaml:"thumbnails"`
+	// AudioBitrates are the renditions of audio files in kbps, stream.DefaultAudioBitrates when empty.
+	AudioBitrates []int `yaml:"audio_bitrates"`
 }
 
 type CacheConfig struct {
@@ -49,20 +69,49 @@ type CacheConfig struct {
 	TTL     int  `yaml:"ttl"`
 }
 
+// ImagesConfig limits the derivatives `/bstore/<image>?width=...` serves to the listed
+// sizes and qualities.
+type ImagesConfig struct {
+	Enabled       bool  `yaml:"enable"`
+	Sizes         []int `yaml:"sizes"`
+	Qualities     []int `yaml:"qualities"`
+	MaxSourceSize int64 `yaml:"max_source_size"`
+	MaxPixels     int   `yaml:"max_pixels"`
+	MaxCacheSize  int64 `yaml:"max_cache_size"`
+}
+
+type S3Config struct {
+	Enabled bool   `yaml:"enable"`
+	Prefix  string `yaml:"prefix"`
+	Region  string `yaml:"region"`
+}
+
 type ServerCfg struct {
 	Host             string           `yaml:"host"`
 	Keys             string           `yaml:"keys"`
 	PublicBasePath   string           `yaml:"public_base_path"`
 	PrivateBasePath  string           `yaml:"private_base_path"`
 	MaxFileSize      int64            `yaml:"max_file_size"`
+	MaxFileNameLen   int              `yaml:"max_file_name_length"`
 	LogFile          string           `yaml:"log_file"`
 	Encrypt          bool             `yaml:"encrypt"`
 	Compress         bool             `yaml:"compress"`
 	CompressionLevel int              `yaml:"compression_lvl"`
 	Cache            CacheConfig      `yaml:"cache"`
+	Images           ImagesConfig     `yaml:"images"`
 	Streaming        StreamingConfig  `yaml:"streaming"`
 	CORS             CORSConfig       `yaml:"cors"`
 	MWare            MiddlewareConfig `yaml:"middleware"`
+	S3               S3Config         `yaml:"s3"`
+	Multipart        MultipartConfig  `yaml:"multipart"`
+	Tus              MultipartConfig  `yaml:"tus"`
+
+	// Storage for each access tier, local directories at the base paths unless set before Load.
+	Public  storage.Backend `yaml:"-"`
+	Private storage.Backend `yaml:"-"`
+
+	// Transcode jobs, started with StartJobs when streaming is enabled.
+	Jobs *jobs.Queue `yaml:"-"`
 }
 
 type BstoreError struct {
@@ -74,8 +123,9 @@ type BstoreError struct {
 type ReqValidation struct {
 	Err        error
 	HttpStatus int
-	Fpath      string
+	Fpath      string // canonical key, `/dir/name`
 	BasePath   string
+	Backend    storage.Backend
 }
 
 func (e *BstoreError) Error() string {
@@ -93,7 +143,12 @@ func NewError(code int, message string, err error) *BstoreError {
 func HandleError(c *gin.Context, err error) {
 	log.Printf("Error: %v\n", err)
 	if bstoreError, ok := err.(*BstoreError); ok {
-		c.JSON(bstoreError.Code, gin.H{"error": bstoreError.Message})
+		var keyError *KeyError
+		if errors.As(bstoreError.Err, &keyError) {
+			c.JSON(bstoreError.Code, gin.H{"error": keyError.Message, "reason": keyError.Reason, "file_path": keyError.Key})
+		} else {
+			c.JSON(bstoreError.Code, gin.H{"error": bstoreError.Message})
+		}
 	} else {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
 	}
@@ -104,8 +159,8 @@ func (cfg *ServerCfg) Load(conf_file string) error {
 	f, err := os.Open(conf_file)
 	if err != nil {
 		fmt.Printf("Cannot find configuration file: `%s`\n", conf_file)
-		fmt.Println("\nLoad a configuration file with:\n\t$bstore -config <path>\n")
-		fmt.Println("Initialize a configuration file with:\n\t$bstore -init\n")
+		fmt.Print("\nLoad a configuration file with:\n\t$bstore -config <path>\n\n")
+		fmt.Print("Initialize a configuration file with:\n\t$bstore -init\n\n")
 		return err
 	}
 	defer f.Close()
@@ -126,6 +181,13 @@ func (cfg *ServerCfg) Load(conf_file string) error {
 		return err
 	}
 
+	if cfg.Public == nil {
+		cfg.Public = storage.NewLocal(cfg.PublicBasePath)
+	}
+	if cfg.Private == nil {
+		cfg.Private = storage.NewLocal(cfg.PrivateBasePath)
+	}
+
 	if cfg.Host == "" {
 		fmt.Println("Warning: Host is not set.")
 	}
@@ -143,10 +205,78 @@ func (cfg *ServerCfg) Load(conf_file string) error {
 		return errors.New("MaxFileSize must be greater than 0")
 	}
 
+	if cfg.MaxFileNameLen < 1 {
+		fmt.Printf("Warning: MaxFileNameLength is not set. Defaulting to %d.\n", DefaultMaxFileNameLength)
+		cfg.MaxFileNameLen = DefaultMaxFileNameLength
+	}
+
 	if cfg.MaxFileSize <= 100000 {
 		fmt.Printf("Warning: MaxFileSize is measured in bytes. The value %d is less than 0.1mb\n", cfg.MaxFileSize)
 	}
 
+	if cfg.Streaming.Enabled && cfg.Streaming.Workers < 1 {
+		fmt.Println("Warning: Streaming Workers is not set. Defaulting to 1.")
+		cfg.Streaming.Workers = 1
+	}
+
+	if cfg.Streaming.Enabled && cfg.Streaming.Timeout < 1 {
+		fmt.Printf("Warning: Streaming Timeout is not set. Defaulting to %d seconds.\n", DefaultTranscodeTimeout)
+		cfg.Streaming.Timeout = DefaultTranscodeTimeout
+	}
+
+	if cfg.Streaming.Hardware == "" {
+		cfg.Streaming.Hardware = "auto"
+	}
+	if _, ok := stream.Hardware[cfg.Streaming.Hardware]; !ok && cfg.Streaming.Hardware != "auto" {
+		return errors.New("Streaming Hardware must be auto, software, nvenc, videotoolbox, vaapi, qsv or v4l2")
+	}
+
+	if thumbs := &cfg.Streaming.Thumbnails; thumbs.Enabled {
+		if thumbs.Interval < 1 {
+			thumbs.Interval = stream.DefaultThumbnails.Interval
+		}
+		if thumbs.Width < 1 {
+			thumbs.Width = stream.DefaultThumbnails.Width
+		}
+		if thumbs.Columns < 1 {
+			thumbs.Columns = stream.DefaultThumbnails.Columns
+		}
+		if thumbs.Rows < 1 {
+			thumbs.Rows = stream.DefaultThumbnails.Rows
+		}
+	}
+
+	if cfg.Streaming.Enabled && len(cfg.Streaming.AudioBitrates) == 0 {
+		cfg.Streaming.AudioBitrates = stream.DefaultAudioBitrates
+	}
+	// every bitrate names its own rendition
+	bitrates := make(map[int]bool)
+	for _, bitrate := range cfg.Streaming.AudioBitrates {
+		if bitrate < 1 {
+			return errors.New("Streaming Audio Bitrates must be greater than 0")
+		}
+		if bitrates[bitrate] {
+			return fmt.Errorf("Streaming Audio Bitrate %d is listed twice", bitrate)
+		}
+		bitrates[bitrate] = true
+	}
+
+	// rung names end up in HLS playlist names
+	rung_names := make(map[string]bool)
+	for _, rung := range cfg.Streaming.Ladder {
+		if rung.Name == "" || strings.Trim(rung.Name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-") != "" {
+			return fmt.Errorf("Streaming Ladder name `%s` must only contain letters, digits, `_` and `-`", rung.Name)
+		}
+		if rung_names[rung.Name] {
+			return fmt.Errorf("Streaming Ladder name `%s` is used twice", rung.Name)
+		}
+		rung_names[rung.Name] = true
+
+		if rung.Height < 1 || rung.Bitrate < 1 {
+			return fmt.Errorf("Streaming Ladder `%s` Height and Bitrate must be greater than 0", rung.Name)
+		}
+	}
+
 	if cfg.MWare.MaxPathLength < 1 {
 		return errors.New("MaxPathLength must be greater than 0")
 	}
@@ -163,6 +293,76 @@ func (cfg *ServerCfg) Load(conf_file string) error {
 		if cfg.MWare.RateLimitCapacity < 1 {
 			return errors.New("Rate Limit Capacity must be greater than 0")
 		}
+
+		for name, rule := range map[string]RateLimitRule{RouteUpload: cfg.MWare.RateLimit.Upload, RouteServe: cfg.MWare.RateLimit.Serve} {
+			if rule.MaxRequests > 0 && rule.Duration < 1 {
+				return fmt.Errorf("Rate Limit %s Duration must be greater than 0", name)
+			}
+		}
+	}
+
+	if images := &cfg.Images; images.Enabled {
+		if len(images.Sizes) == 0 {
+			images.Sizes = DefaultImageSizes
+		}
+		if len(images.Qualities) == 0 {
+			images.Qualities = DefaultImageQualities
+		}
+		if images.MaxSourceSize < 1 {
+			fmt.Printf("Warning: Images MaxSourceSize is not set. Defaulting to %d.\n", DefaultImageMaxSourceSize)
+			images.MaxSourceSize = DefaultImageMaxSourceSize
+		}
+		if images.MaxPixels < 1 {
+			fmt.Printf("Warning: Images MaxPixels is not set. Defaulting to %d.\n", DefaultImageMaxPixels)
+			images.MaxPixels = DefaultImageMaxPixels
+		}
+		if images.MaxCacheSize < 1 {
+			fmt.Printf("Warning: Images MaxCacheSize is not set. Defaulting to %d.\n", DefaultImageMaxCacheSize)
+			images.MaxCacheSize = DefaultImageMaxCacheSize
+		}
+
+		for _, size := range images.Sizes {
+			if size < 1 || size > 16384 {
+				return errors.New("Images Sizes must be between 1 and 16384")
+			}
+		}
+		for _, quality := range images.Qualities {
+			if quality < 1 || quality > 100 {
+				return errors.New("Images Qualities must be between 1 and 100")
+			}
+		}
+	}
+
+	for name, mp := range map[string]*MultipartConfig{"Multipart": &cfg.Multipart, "Tus": &cfg.Tus} {
+		if !mp.Enabled {
+			continue
+		}
+
+		if mp.MaxSize < 1 {
+			fmt.Printf("Warning: %s MaxSize is not set. Defaulting to %d.\n", name, int64(DefaultMultipartMaxSize))
+			mp.MaxSize = DefaultMultipartMaxSize
+		}
+
+		if mp.TTL < 1 {
+			fmt.Printf("Warning: %s TTL is not set. Defaulting to %ds.\n", name, DefaultMultipartTTL)
+			mp.TTL = DefaultMultipartTTL
+		}
+	}
+
+	if cfg.S3.Enabled {
+		prefix, err := clean_s3_prefix(cfg.S3.Prefix)
+		if err != nil {
+			return err
+		}
+		cfg.S3.Prefix = prefix
+
+		if cfg.S3.Region == "" {
+			cfg.S3.Region = S3DefaultRegion
+		}
+
+		if access_key, secret_key := GetS3Keys(); access_key == "" || secret_key == "" {
+			return errors.New("S3 requires BSTORE_S3_ACCESS_KEY and BSTORE_S3_SECRET_KEY")
+		}
 	}
 
 	return nil
@@ -175,6 +375,7 @@ func (cfg *ServerCfg) Print() {
 	fmt.Printf("PublicBasePath: %s\n", cfg.PublicBasePath)
 	fmt.Printf("PrivateBasePath: %s\n", cfg.PrivateBasePath)
 	fmt.Printf("MaxFileSize: %d mb\n", cfg.MaxFileSize/1024/1024)
+	fmt.Printf("MaxFileNameLength: %d\n", cfg.MaxFileNameLen)
 	fmt.Printf("LogFile: %s\n", filepath.Join(cd, cfg.LogFile))
 	fmt.Printf("Encrypt: %t\n", cfg.Encrypt)
 	fmt.Printf("Compress: %t\n", cfg.Compress)
@@ -183,10 +384,31 @@ func (cfg *ServerCfg) Print() {
 	fmt.Printf("  Enabled: %t\n", cfg.Cache.Enabled)
 	fmt.Printf("  N: %d\n", cfg.Cache.N)
 	fmt.Printf("  TTL: %d\n", cfg.Cache.TTL)
+	fmt.Printf("Images:\n")
+	fmt.Printf("  Enabled: %t\n", cfg.Images.Enabled)
+	if cfg.Images.Enabled {
+		fmt.Printf("  Sizes: %v\n", cfg.Images.Sizes)
+		fmt.Printf("  Qualities: %v\n", cfg.Images.Qualities)
+		fmt.Printf("  Max Source Size: %d mb\n", cfg.Images.MaxSourceSize/1024/1024)
+		fmt.Printf("  Max Pixels: %d\n", cfg.Images.MaxPixels)
+		fmt.Printf("  Max Cache Size: %d mb\n", cfg.Images.MaxCacheSize/1024/1024)
+	}
 	fmt.Printf("Streaming:\n")
 	fmt.Printf("  Enabled: %t\n", cfg.Streaming.Enabled)
 	fmt.Printf("  Codec: %s\n", cfg.Streaming.Codec)
+	fmt.Printf("  Hardware: %s\n", cfg.Streaming.Hardware)
 	fmt.Printf("  Bitrate: %dk\n", cfg.Streaming.Bitrate)
+	fmt.Printf("  Workers: %d\n", cfg.Streaming.Workers)
+	fmt.Printf("  Timeout: %ds\n", cfg.Streaming.Timeout)
+	fmt.Printf("  Thumbnails: %t\n", cfg.Streaming.Thumbnails.Enabled)
+	if cfg.Streaming.Thumbnails.Enabled {
+		t := cfg.Streaming.Thumbnails
+		fmt.Printf("    Every %ds, %dpx wide, %dx%d per sprite sheet\n", t.Interval, t.Width, t.Columns, t.Rows)
+	}
+	for _, rung := range cfg.Streaming.Ladder {
+		fmt.Printf("  Ladder %s: %dp at %dk\n", rung.Name, rung.Height, rung.Bitrate)
+	}
+	fmt.Printf("  Audio Bitrates: %v\n", cfg.Streaming.AudioBitrates)
 	fmt.Printf("CORS:\n")
 	fmt.Printf("  Allow Origins: %v\n", cfg.CORS.AllowOrigins)
 	fmt.Printf("  Allow Methods: %v\n", cfg.CORS.AllowMethods)
@@ -202,23 +424,38 @@ func (cfg *ServerCfg) Print() {
 	fmt.Printf("    Enabled: %t\n", cfg.MWare.RateLimit.Enabled)
 	fmt.Printf("    Max Requests: %d\n", cfg.MWare.RateLimit.MaxRequests)
 	fmt.Printf("    Duration: %ds\n", cfg.MWare.RateLimit.Duration)
+	fmt.Printf("    Upload: %d/%ds\n", cfg.MWare.RateLimit.Rule(RouteUpload).MaxRequests, cfg.MWare.RateLimit.Rule(RouteUpload).Duration)
+	fmt.Printf("    Serve: %d/%ds\n", cfg.MWare.RateLimit.Rule(RouteServe).MaxRequests, cfg.MWare.RateLimit.Rule(RouteServe).Duration)
+	fmt.Printf("Multipart:\n")
+	fmt.Printf("  Enabled: %t\n", cfg.Multipart.Enabled)
+	fmt.Printf("  Max Size: %d mb\n", cfg.Multipart.MaxSize/1024/1024)
+	fmt.Printf("  TTL: %ds\n", cfg.Multipart.TTL)
+	fmt.Printf("Tus:\n")
+	fmt.Printf("  Enabled: %t\n", cfg.Tus.Enabled)
+	fmt.Printf("  Max Size: %d mb\n", cfg.Tus.MaxSize/1024/1024)
+	fmt.Printf("  TTL: %ds\n", cfg.Tus.TTL)
+	fmt.Printf("S3:\n")
+	fmt.Printf("  Enabled: %t\n", cfg.S3.Enabled)
+	fmt.Printf("  Prefix: %s\n", cfg.S3.Prefix)
+	fmt.Printf("  Region: %s\n", cfg.S3.Region)
 }
 
 func (bstore *ServerCfg) GetAccess(c *gin.Context) string {
 	return c.Request.Header.Get("X-access")
 }
 
-func (bstore *ServerCfg) ValidateReq(c *gin.Context) ReqValidation {
+func (bstore *ServerCfg) ValidateReq(c *gin.Context, opts ...KeyOption) ReqValidation {
 	var ret ReqValidation
-	fpath := c.Param("file_path")
-	if fpath == "" {
-		ret.Err = errors.New("file_path is required")
+	fpath, err := CleanKey(c.Param("file_path"), bstore.MaxFileNameLen, opts...)
+	if err != nil {
+		ret.Err = err
 		ret.HttpStatus = http.StatusBadRequest
 		return ret
 	}
 
 	ret.Fpath = fpath
 	ret.BasePath = bstore.get_base_path(bstore.GetAccess(c))
+	ret.Backend = bstore.get_backend(bstore.GetAccess(c))
 
 	return ret
 }
@@ -285,6 +522,13 @@ func (bstore *ServerCfg) get_base_path(x_access string) string {
 	return bstore.PrivateBasePath
 }
 
+func (bstore *ServerCfg) get_backend(x_access string) storage.Backend {
+	if x_access == "public" {
+		return bstore.Public
+	}
+	return bstore.Private
+}
+
 func (bstore *ServerCfg) keys_in_file() bool {
 	if bstore.Keys != "env" {
 		return true
@@ -371,3 +615,29 @@ func (bstore *ServerCfg) check_keys() error {
 	}
 	return nil
 }
+
+// routeGroups are the path prefixes of the other routes, the S3 API may not share them.
+var routeGroups = []string{"/api", "/bstore", StreamRoute}
+
+// clean_s3_prefix normalizes the S3 prefix, refusing one equal to, inside or above a route group.
+func clean_s3_prefix(prefix string) (string, error) {
+	if prefix == "" {
+		prefix = S3DefaultPrefix
+	}
+	prefix = path.Clean("/" + prefix)
+
+	conflict := fmt.Errorf("S3 Prefix `%s` conflicts with other routes", prefix)
+	if prefix == "/" {
+		return "", conflict
+	}
+	for _, group := range routeGroups {
+		if path_within(prefix, group) || path_within(group, prefix) {
+			return "", conflict
+		}
+	}
+	return prefix, nil
+}
+
+func path_within(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
@@ -0,0 +1,27 @@
+package bstore
+
+import "testing"
+
+func TestCleanS3Prefix(t *testing.T) {
+	valid := map[string]string{
+		"":           "/s3",
+		"s3":         "/s3",
+		"/s3/":       "/s3",
+		"/storage":   "/storage",
+		"/apis":      "/apis",
+		"/streaming": "/streaming",
+		"/v1/s3":     "/v1/s3",
+	}
+	for prefix, want := range valid {
+		if got, err := clean_s3_prefix(prefix); err != nil || got != want {
+			t.Fatalf("clean_s3_prefix(%q) = %q, %v, want %q", prefix, got, err, want)
+		}
+	}
+
+	invalid := []string{"/", "//", "/api", "api/", "/bstore", "/stream", "/stream/", "/api/s3", "/bstore/s3", "/stream/s3", "/s3/..", "/s3/../api"}
+	for _, prefix := range invalid {
+		if got, err := clean_s3_prefix(prefix); err == nil {
+			t.Fatalf("clean_s3_prefix(%q) = %q, want a conflict", prefix, got)
+		}
+	}
+}
@@ -1,73 +1,70 @@
 package bstore
 
 import (
+	"errors"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
 
+	"github.com/cartersusi/bstore/pkg/storage"
 	"github.com/gin-gonic/gin"
 )
 
 func (bstore *ServerCfg) Delete(c *gin.Context) {
 	log.Println("Valid Delete Request for", c.Request.URL.Path)
-	validation := bstore.ValidateReq(c)
+	validation := bstore.ValidateReq(c, AllowWildcard)
 	if validation.Err != nil {
-		HandleError(c, NewError(validation.HttpStatus, validation.Err.Error(), nil))
+		HandleError(c, NewError(validation.HttpStatus, validation.Err.Error(), validation.Err))
 		return
 	}
 
-	fpath := filepath.Join(validation.BasePath, validation.Fpath)
-	log.Println("Deleting file at", fpath)
+	log.Println("Deleting file at", validation.Fpath)
 
-	info, err := os.Stat(fpath)
-	if err == nil && !info.IsDir() {
-		rm(c, fpath)
+	if strings.HasSuffix(validation.Fpath, "/*") {
+		rmdir(c, validation.Backend, validation.Fpath)
 		return
 	}
 
-	if strings.HasSuffix(fpath, "/*") {
-		rmdir(c, fpath)
+	obj, err := bstore.find_object(validation.Backend, validation.Fpath)
+	if err != nil {
+		HandleError(c, NewError(http.StatusNotFound, "File not found", err))
 		return
 	}
 
-	rm(c, fpath+".zst")
-	return
+	bstore.remove_derivatives(validation.Backend, validation.Fpath)
+	rm(c, obj)
 }
 
-func rm(c *gin.Context, fpath string) {
-	err := os.Remove(fpath)
+func rm(c *gin.Context, obj *object) {
+	err := obj.backend.Delete(obj.Key)
 	if err != nil {
 		HandleError(c, NewError(http.StatusInternalServerError, "Error deleting file: "+err.Error(), nil))
 		return
 	}
 
-	log.Println("File deleted at", fpath)
+	RemoveMeta(obj.backend, obj.Key)
+	log.Println("File deleted at", obj.Key)
 	c.JSON(http.StatusOK, gin.H{"message": "File deleted successfully"})
-	return
 }
 
-func rmdir(c *gin.Context, fpath string) {
-	del_path := strings.TrimSuffix(fpath, "*")
-	info, err := os.Stat(del_path)
-	if err != nil {
+func rmdir(c *gin.Context, backend storage.Backend, key string) {
+	del_key := strings.TrimSuffix(key, "*")
+	err := backend.DeletePrefix(del_key)
+	if errors.Is(err, storage.ErrNotExist) {
 		HandleError(c, NewError(http.StatusNotFound, "Directory not found", err))
 		return
 	}
 
-	if !info.IsDir() {
+	if errors.Is(err, storage.ErrNotDir) {
 		HandleError(c, NewError(http.StatusBadRequest, "Cannot delete file with wildcard", nil))
 		return
 	}
 
-	err = os.RemoveAll(del_path)
 	if err != nil {
 		HandleError(c, NewError(http.StatusInternalServerError, "Error deleting directory: "+err.Error(), nil))
 		return
 	}
 
-	log.Println("Directory deleted at", del_path)
+	log.Println("Directory deleted at", del_key)
 	c.JSON(http.StatusOK, gin.H{"message": "Directory deleted successfully"})
-	return
 }
@@ -1,10 +1,11 @@
 package bstore
 
 import (
+	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
+	"strconv"
 
 	"github.com/cartersusi/bstore/pkg/fops"
 	"github.com/gin-gonic/gin"
@@ -14,53 +15,59 @@ func (bstore *ServerCfg) Get(c *gin.Context) {
 	log.Println("Valid Get Request for", c.Request.URL.Path)
 	validation := bstore.ValidateReq(c)
 	if validation.Err != nil {
-		HandleError(c, NewError(validation.HttpStatus, validation.Err.Error(), nil))
+		HandleError(c, NewError(validation.HttpStatus, validation.Err.Error(), validation.Err))
 		return
 	}
 
-	fpath := filepath.Join(validation.BasePath, validation.Fpath)
-	log.Println("Getting file at", fpath)
+	log.Println("Getting file at", validation.Fpath)
 
-	info, err := os.Stat(fpath)
-	if err == nil && !info.IsDir() {
-		download(c, fpath, false, bstore.Encrypt)
+	obj, err := bstore.find_object(validation.Backend, validation.Fpath)
+	if err != nil {
+		HandleError(c, NewError(http.StatusNotFound, "File not found", err))
 		return
 	}
 
-	fpath += ".zst"
-	info, err = os.Stat(fpath)
-	if err == nil && !info.IsDir() {
-		log.Println("Getting compressed file at", fpath)
-		download(c, fpath, true, bstore.Encrypt)
+	r, err := obj.open()
+	if err != nil {
+		HandleError(c, NewError(http.StatusInternalServerError, "Error reading file", err))
 		return
 	}
+	defer r.Close()
 
-	HandleError(c, NewError(http.StatusNotFound, "File not found", nil))
+	c.Header("Content-Type", "application/octet-stream")
+	serve_content(c, obj, r)
 }
 
-func download(c *gin.Context, fpath string, isCompressed bool, isEncrypted bool) {
-	if !isEncrypted && !isCompressed {
-		c.File(fpath)
-		return
-	}
-
-	if isEncrypted && !isCompressed {
-		content, err := fops.DecryptFile(fpath)
-		if err != nil {
-			HandleError(c, NewError(http.StatusInternalServerError, "Error decrypting file", err))
-			return
-		}
-		c.Data(http.StatusOK, "application/octet-stream", content)
-		return
+// serve_content answers with the plaintext in r, honoring Range, If-Range, If-None-Match
+// and If-Modified-Since. Without a sidecar the validators come from the stored file.
+func serve_content(c *gin.Context, obj *object, r io.ReadSeeker) {
+	c.Header("Accept-Ranges", "bytes")
+	refuse_ranges(c, r)
+	c.Header("ETag", make_etag(obj))
+	c.Header("X-Bstore-Compressed", strconv.FormatBool(obj.Compressed()))
+	c.Header("X-Bstore-Encrypted", strconv.FormatBool(obj.Encrypt))
+	if obj.Meta != nil {
+		obj.Meta.set_headers(c.Writer)
 	}
+	http.ServeContent(c.Writer, c.Request, obj.Name(), obj.Info.ModTime, r)
+}
 
-	content, err := fops.Decompress(fpath, isEncrypted)
-	if err != nil {
-		HandleError(c, NewError(http.StatusInternalServerError, "Error decompressing file", err))
+// refuse_ranges makes r be served whole when a seek would decode it from the start,
+// which is the case for compressed objects written without a frame index.
+func refuse_ranges(c *gin.Context, r io.ReadSeeker) {
+	fr, ok := r.(*fops.Reader)
+	if !ok || fr.Seekable() {
 		return
 	}
 
-	c.Data(http.StatusOK, "application/octet-stream", content)
-	return
+	c.Request.Header.Del("Range")
+	c.Request.Header.Del("If-Range")
+	c.Header("Accept-Ranges", "none")
+}
 
+func make_etag(obj *object) string {
+	if obj.Meta != nil && obj.Meta.SHA256 != "" {
+		return fmt.Sprintf(`"%s"`, obj.Meta.SHA256)
+	}
+	return fmt.Sprintf(`"%x-%x"`, obj.Info.ModTime.UnixNano(), obj.Info.Size)
 }
@@ -0,0 +1,349 @@
+package bstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cartersusi/bstore/pkg/imaging"
+	"github.com/cartersusi/bstore/pkg/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// ImagesDir holds the derivatives in `~/.bstore` as `<key>/<source ETag>/<options>`, each
+// part hashed. It can be emptied at any time.
+const ImagesDir = "images"
+
+const (
+	DefaultImageMaxSourceSize = 32 << 20
+	DefaultImageMaxPixels     = 50_000_000
+	DefaultImageMaxCacheSize  = 1 << 30
+)
+
+const imagesGCInterval = time.Hour
+
+var (
+	DefaultImageSizes     = []int{64, 128, 256, 512, 1024, 2048}
+	DefaultImageQualities = []int{60, 75, 85, 95}
+)
+
+// serve_image serves a resized copy of the image obj, from the cache, from disk or made
+// now. Derivatives are keyed by the source's ETag so a rewritten image gets new ones.
+func (bstore *ServerCfg) serve_image(c *gin.Context, obj *object, key string, opts imaging.Options) {
+	if !imaging.CheckEXT(key) {
+		HandleError(c, NewError(http.StatusBadRequest, "Only images can be resized", nil))
+		return
+	}
+	if err := bstore.check_image_options(opts, key); err != nil {
+		HandleError(c, NewError(http.StatusBadRequest, err.Error(), err))
+		return
+	}
+
+	source_etag := make_etag(obj)
+	params := sha256.Sum256([]byte(opts.Key()))
+	etag := fmt.Sprintf(`"%s-%s"`, strings.Trim(source_etag, `"`), hex.EncodeToString(params[:8]))
+	cache_key := key + etag
+
+	record, ok := check_OR_get(c, cache_key)
+	if !ok {
+		var err error
+		record, err = bstore.load_image(obj, key, source_etag, opts)
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		if len(record) <= MaxCacheItemSize {
+			set_cache(c, cache_key, record)
+		}
+	}
+
+	content_type, data, err := unpack_image(record)
+	if err != nil {
+		HandleError(c, NewError(http.StatusInternalServerError, "Error reading resized image", err))
+		return
+	}
+
+	c.Header("Content-Type", content_type)
+	c.Header("ETag", etag)
+	http.ServeContent(c.Writer, c.Request, "", obj.Info.ModTime, bytes.NewReader(data))
+}
+
+// image_header starts every derivative in the caches, the format is only known once the
+// source is decoded. Key and ETag name the source so ImagesGC can tell stale ones.
+type image_header struct {
+	Key         string `json:"key"`
+	ETag        string `json:"etag"`
+	ContentType string `json:"content_type"`
+}
+
+func pack_image(header image_header, data []byte) ([]byte, error) {
+	line, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(line, '\n'), data...), nil
+}
+
+func unpack_image(record []byte) (string, []byte, error) {
+	line, data, ok := bytes.Cut(record, []byte{'\n'})
+	if !ok {
+		return "", nil, errors.New("resized image has no header")
+	}
+
+	var header image_header
+	if err := json.Unmarshal(line, &header); err != nil {
+		return "", nil, err
+	}
+	return header.ContentType, data, nil
+}
+
+func images_dir() (string, error) {
+	conf_dir, err := ConfDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(conf_dir, ImagesDir), nil
+}
+
+func hash_name(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (bstore *ServerCfg) check_image_options(opts imaging.Options, key string) error {
+	for name, size := range map[string]int{"width": opts.Width, "height": opts.Height} {
+		if size != 0 && !slices.Contains(bstore.Images.Sizes, size) {
+			return fmt.Errorf("%s must be one of %v", name, bstore.Images.Sizes)
+		}
+	}
+	if opts.Quality != 0 && !slices.Contains(bstore.Images.Qualities, opts.Quality) {
+		return fmt.Errorf("quality must be one of %v", bstore.Images.Qualities)
+	}
+	// it would not change the image, only the cache key
+	if opts.Quality != 0 && !opts.Lossy(key) {
+		return errors.New("quality only applies to jpeg, png and webp are lossless")
+	}
+	return nil
+}
+
+// load_image reads the derivative from disk or makes it from the source and saves it,
+// either way packed with its header. Saving one drops those of earlier versions of the source.
+func (bstore *ServerCfg) load_image(obj *object, key, source_etag string, opts imaging.Options) ([]byte, error) {
+	dir, err := images_dir()
+	if err != nil {
+		return nil, NewError(http.StatusInternalServerError, "Error resizing image", err)
+	}
+	key_dir := filepath.Join(dir, hash_name(key))
+	fpath := filepath.Join(key_dir, hash_name(source_etag), hash_name(opts.Key()))
+
+	if record, err := os.ReadFile(fpath); err == nil {
+		// the mtime orders derivatives for eviction, most recently used last
+		now := time.Now()
+		_ = os.Chtimes(fpath, now, now)
+		return record, nil
+	}
+
+	r, err := obj.open()
+	if err != nil {
+		return nil, NewError(http.StatusInternalServerError, "Error reading file", err)
+	}
+	defer r.Close()
+
+	src, err := io.ReadAll(io.LimitReader(r, bstore.Images.MaxSourceSize+1))
+	if err != nil {
+		return nil, NewError(http.StatusInternalServerError, "Error reading file", err)
+	}
+	if int64(len(src)) > bstore.Images.MaxSourceSize {
+		return nil, NewError(http.StatusRequestEntityTooLarge, "Image is too large to be resized", nil)
+	}
+
+	data, content_type, err := imaging.Transform(src, opts, bstore.Images.MaxPixels)
+	if err != nil {
+		return nil, NewError(http.StatusUnprocessableEntity, "Error resizing image", err)
+	}
+
+	record, err := pack_image(image_header{Key: key, ETag: source_etag, ContentType: content_type}, data)
+	if err != nil {
+		return nil, NewError(http.StatusInternalServerError, "Error resizing image", err)
+	}
+
+	// a failed save only means the next request resizes again
+	if err = write_file_atomic(fpath, record); err != nil {
+		log.Println("Error saving resized image:", err)
+	}
+	remove_stale_images(key_dir, filepath.Dir(fpath))
+	return record, nil
+}
+
+// remove_stale_images drops the derivatives of every version of a source but the current one.
+func remove_stale_images(key_dir, current string) {
+	entries, err := os.ReadDir(key_dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if fpath := filepath.Join(key_dir, e.Name()); fpath != current {
+			_ = os.RemoveAll(fpath)
+		}
+	}
+}
+
+// remove_derivatives drops the resized copies of a deleted source, only public images have any.
+func (bstore *ServerCfg) remove_derivatives(backend storage.Backend, key string) {
+	if !bstore.Images.Enabled || backend != bstore.Public {
+		return
+	}
+
+	dir, err := images_dir()
+	if err != nil {
+		return
+	}
+	if err = os.RemoveAll(filepath.Join(dir, hash_name(key))); err != nil {
+		log.Println("Error removing resized images:", err)
+	}
+}
+
+// ImagesGC removes derivatives whose source was deleted or rewritten and then the least
+// recently used ones until the directory fits Images.MaxCacheSize, it never returns.
+func (bstore *ServerCfg) ImagesGC() {
+	ticker := time.NewTicker(imagesGCInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		dir, err := images_dir()
+		if err != nil {
+			log.Println("Error finding resized images:", err)
+			continue
+		}
+		bstore.gc_images(dir)
+	}
+}
+
+type image_file struct {
+	path string
+	size int64
+	mod  time.Time
+}
+
+func (bstore *ServerCfg) gc_images(dir string) {
+	var files []image_file
+	var total int64
+	// source versions already checked, by the directory holding their derivatives
+	current := make(map[string]bool)
+
+	err := filepath.WalkDir(dir, func(fpath string, d fs.DirEntry, err error) error {
+		// files still being written
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return err
+		}
+
+		version_dir := filepath.Dir(fpath)
+		ok, checked := current[version_dir]
+		if !checked {
+			ok = bstore.image_current(fpath)
+			current[version_dir] = ok
+		}
+		if !ok {
+			if err = os.Remove(fpath); err != nil {
+				log.Println("Error removing resized image:", err)
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, image_file{path: fpath, size: info.Size(), mod: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Println("Error collecting resized images:", err)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].mod.Before(files[j].mod) })
+	for _, f := range files {
+		if total <= bstore.Images.MaxCacheSize {
+			break
+		}
+		if err = os.Remove(f.path); err != nil {
+			log.Println("Error removing resized image:", err)
+			continue
+		}
+		total -= f.size
+	}
+
+	remove_empty_dirs(dir)
+}
+
+// image_current reports whether the derivative at fpath was made from the stored version
+// of its source, files without a readable header are from an older layout and stale.
+func (bstore *ServerCfg) image_current(fpath string) bool {
+	file, err := os.Open(fpath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil {
+		return false
+	}
+	var header image_header
+	if err = json.Unmarshal(line, &header); err != nil || header.Key == "" {
+		return false
+	}
+
+	obj, err := bstore.find_object(bstore.Public, header.Key)
+	return err == nil && make_etag(obj) == header.ETag
+}
+
+// remove_empty_dirs removes the directories below dir left empty, deepest first.
+func remove_empty_dirs(dir string) {
+	var dirs []string
+	_ = filepath.WalkDir(dir, func(fpath string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && fpath != dir {
+			dirs = append(dirs, fpath)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = os.Remove(dirs[i])
+	}
+}
+
+func write_file_atomic(fpath string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fpath), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fpath)
+}
@@ -0,0 +1,216 @@
+package bstore
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/png"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cartersusi/bstore/pkg/storage"
+	"github.com/gin-gonic/gin"
+)
+
+func images_server(t *testing.T) (*ServerCfg, *gin.Engine) {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	t.Setenv("HOME", t.TempDir())
+	cfg := &ServerCfg{
+		MaxFileNameLen: 255,
+		MaxFileSize:    1 << 20,
+		Public:         storage.NewMemory(),
+		Private:        storage.NewMemory(),
+		Images: ImagesConfig{
+			Enabled:       true,
+			Sizes:         DefaultImageSizes,
+			Qualities:     DefaultImageQualities,
+			MaxSourceSize: DefaultImageMaxSourceSize,
+			MaxPixels:     DefaultImageMaxPixels,
+		},
+	}
+
+	r := gin.New()
+	r.Use(cfg.Serve())
+	return cfg, r
+}
+
+func put_image(t *testing.T, cfg *ServerCfg, key string, encode func(*bytes.Buffer, image.Image) error) {
+	t.Helper()
+	put_sized_image(t, cfg, key, 300, encode)
+}
+
+func put_sized_image(t *testing.T, cfg *ServerCfg, key string, width int, encode func(*bytes.Buffer, image.Image) error) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := encode(&buf, image.NewNRGBA(image.Rect(0, 0, width, 200))); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.write_object(cfg.Public, key, &buf, &ObjectMeta{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeImageContentType(t *testing.T) {
+	cfg, r := images_server(t)
+	put_image(t, cfg, "a.gif", func(buf *bytes.Buffer, img image.Image) error { return gif.Encode(buf, img, nil) })
+	put_image(t, cfg, "b.png", func(buf *bytes.Buffer, img image.Image) error { return png.Encode(buf, img) })
+
+	tests := map[string]string{
+		"/bstore/a.gif?width=64":               "image/png", // a resized gif is no animation, it is made a PNG
+		"/bstore/b.png?width=64":               "image/png",
+		"/bstore/b.png?width=64&format=webp":   "image/webp",
+		"/bstore/b.png?width=64&format=jpeg":   "image/jpeg",
+		"/bstore/a.gif?height=64&format=webp":  "image/webp",
+		"/bstore/b.png?height=128&format=webp": "image/webp",
+	}
+	for target, want := range tests {
+		// the second request reads the derivative saved on disk by the first
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET %s = %d: %s", target, w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != want {
+				t.Fatalf("GET %s Content-Type = %q, want %q", target, got, want)
+			}
+			if _, _, err := image.DecodeConfig(w.Body); err != nil {
+				t.Fatalf("GET %s body: %v", target, err)
+			}
+		}
+	}
+}
+
+func encode_png(buf *bytes.Buffer, img image.Image) error {
+	return png.Encode(buf, img)
+}
+
+func get_image(t *testing.T, r *gin.Engine, target string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d: %s", target, w.Code, w.Body)
+	}
+}
+
+// image_files lists the derivatives saved on disk.
+func image_files(t *testing.T) []string {
+	t.Helper()
+
+	dir, err := images_dir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	err = filepath.WalkDir(dir, func(fpath string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, fpath)
+		}
+		return err
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestImagesInvalidation(t *testing.T) {
+	cfg, r := images_server(t)
+	put_image(t, cfg, "a.png", encode_png)
+
+	get_image(t, r, "/bstore/a.png?width=64")
+	get_image(t, r, "/bstore/a.png?width=128")
+	old := image_files(t)
+	if len(old) != 2 {
+		t.Fatalf("derivatives on disk = %v, want 2", old)
+	}
+
+	// a rewritten source keeps only the derivatives of its new version
+	put_sized_image(t, cfg, "a.png", 400, encode_png)
+	get_image(t, r, "/bstore/a.png?width=64")
+	files := image_files(t)
+	if len(files) != 1 || slices.Contains(old, files[0]) {
+		t.Fatalf("derivatives after a rewrite = %v, had %v", files, old)
+	}
+
+	cfg.remove_derivatives(cfg.Private, "/a.png")
+	if len(image_files(t)) != 1 {
+		t.Fatal("deleting a private object removed public derivatives")
+	}
+	cfg.remove_derivatives(cfg.Public, "/a.png")
+	if files = image_files(t); len(files) != 0 {
+		t.Fatalf("derivatives after deleting the source = %v", files)
+	}
+}
+
+func TestImagesGC(t *testing.T) {
+	cfg, r := images_server(t)
+	cfg.Images.MaxCacheSize = 1 << 30
+	dir, err := images_dir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put_image(t, cfg, "a.png", encode_png)
+	put_image(t, cfg, "b.png", encode_png)
+	put_image(t, cfg, "c.png", encode_png)
+	for _, key := range []string{"a", "b", "c"} {
+		get_image(t, r, "/bstore/"+key+".png?width=64")
+	}
+	// a derivative saved before they had a header
+	if err = os.WriteFile(filepath.Join(dir, "0123456789abcdef"), []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// rewritten and deleted without serving, only the collector notices
+	put_sized_image(t, cfg, "a.png", 400, encode_png)
+	if err = cfg.Public.Delete("b.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.gc_images(dir)
+	files := image_files(t)
+	if len(files) != 1 || !strings.HasPrefix(files[0], filepath.Join(dir, hash_name("/c.png"))) {
+		t.Fatalf("derivatives after collecting = %v, want only that of c.png", files)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("directories after collecting = %d, want the empty ones removed", len(entries))
+	}
+
+	// over the limit the least recently used go first
+	get_image(t, r, "/bstore/a.png?width=64")
+	get_image(t, r, "/bstore/a.png?width=128")
+	past := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(files[0], past, past); err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, fpath := range image_files(t) {
+		info, err := os.Stat(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += info.Size()
+	}
+	cfg.Images.MaxCacheSize = total - 1
+
+	cfg.gc_images(dir)
+	left := image_files(t)
+	if len(left) != 2 || slices.Contains(left, files[0]) {
+		t.Fatalf("derivatives after evicting = %v, want the two of a.png", left)
+	}
+}
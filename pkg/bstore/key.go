@@ -0,0 +1,151 @@
+package bstore
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Suffixes bstore uses for its own files next to objects, keys may not end with them.
+var ReservedSuffixes = []string{".zst", MetaExt, ".tmp"}
+
+const DefaultMaxFileNameLength = 256
+
+type KeyOption int
+
+const (
+	// AllowRoot accepts an empty key, naming the whole base path (listing).
+	AllowRoot KeyOption = iota
+	// AllowWildcard accepts a trailing `/*`, naming everything below a directory (deleting).
+	AllowWildcard
+)
+
+// KeyError describes why an object key was rejected, Reason is a stable identifier for clients.
+type KeyError struct {
+	Reason  string
+	Message string
+	Key     string
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("%s: %q", e.Message, e.Key)
+}
+
+// CleanKey canonicalizes an object key to `/seg/seg/name`. Instead of resolving `..` or `.`
+// it rejects them, along with NUL and control characters, backslashes, invalid UTF-8,
+// reserved suffixes, the multipart staging directory and segments longer than max_name_len.
+func CleanKey(raw string, max_name_len int, opts ...KeyOption) (string, error) {
+	allow_root, allow_wildcard := false, false
+	for _, o := range opts {
+		switch o {
+		case AllowRoot:
+			allow_root = true
+		case AllowWildcard:
+			allow_wildcard = true
+		}
+	}
+
+	key_err := func(reason, message string) error {
+		return &KeyError{Reason: reason, Message: message, Key: raw}
+	}
+
+	if err := check_characters(raw); err != nil {
+		return "", err
+	}
+
+	wildcard := false
+	if allow_wildcard && (raw == "*" || raw == "/*" || strings.HasSuffix(raw, "/*")) {
+		wildcard = true
+		raw = strings.TrimSuffix(raw, "*")
+	}
+
+	var segments []string
+	for _, seg := range strings.Split(raw, "/") {
+		switch seg {
+		case "":
+			continue
+		case ".", "..":
+			return "", key_err("path_traversal", "File path may not contain `.` or `..` segments")
+		}
+
+		if len(segments) == 0 && seg == MultipartDir {
+			return "", key_err("reserved_prefix", fmt.Sprintf("File paths may not start with `/%s`", MultipartDir))
+		}
+		if strings.Contains(seg, "*") {
+			return "", key_err("invalid_character", "File path may only use `*` as a trailing `/*`")
+		}
+		if len(seg) > max_name_len {
+			return "", key_err("name_too_long", fmt.Sprintf("File name exceeds %d bytes", max_name_len))
+		}
+		segments = append(segments, seg)
+	}
+
+	if len(segments) == 0 && !allow_root && !wildcard {
+		return "", key_err("empty", "file_path is required")
+	}
+
+	if !wildcard && len(segments) > 0 {
+		name := segments[len(segments)-1]
+		for _, suffix := range ReservedSuffixes {
+			if strings.HasSuffix(name, suffix) {
+				return "", key_err("reserved_suffix", fmt.Sprintf("File names may not end with `%s`", suffix))
+			}
+		}
+	}
+
+	key := "/" + strings.Join(segments, "/")
+	if wildcard {
+		key = strings.TrimSuffix(key, "/") + "/*"
+	}
+	return key, nil
+}
+
+// CleanPrefix validates a key prefix as S3 listings take it, `dir/sub/na` without a leading
+// slash. The last segment may be partial, the ones before it follow the rules of CleanKey.
+func CleanPrefix(raw string, max_name_len int) (string, error) {
+	key_err := func(reason, message string) error {
+		return &KeyError{Reason: reason, Message: message, Key: raw}
+	}
+
+	if err := check_characters(raw); err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(raw, "/") {
+		return "", key_err("invalid_prefix", "Prefix may not start with `/`")
+	}
+
+	segments := strings.Split(raw, "/")
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		switch {
+		case seg == "" && !last:
+			return "", key_err("invalid_prefix", "Prefix may not contain empty segments")
+		case (seg == "." || seg == "..") && !last:
+			return "", key_err("path_traversal", "Prefix may not contain `.` or `..` segments")
+		case i == 0 && seg == MultipartDir && !last:
+			return "", key_err("reserved_prefix", fmt.Sprintf("Prefixes may not start with `%s/`", MultipartDir))
+		case strings.Contains(seg, "*"):
+			return "", key_err("invalid_character", "Prefix may not contain `*`")
+		case len(seg) > max_name_len:
+			return "", key_err("name_too_long", fmt.Sprintf("File name exceeds %d bytes", max_name_len))
+		}
+	}
+	return raw, nil
+}
+
+// check_characters rejects invalid UTF-8, NUL and control characters and backslashes.
+func check_characters(raw string) error {
+	if !utf8.ValidString(raw) {
+		return &KeyError{Reason: "invalid_encoding", Message: "File path must be valid UTF-8", Key: raw}
+	}
+
+	for _, r := range raw {
+		if r == 0 || r < 0x20 || r == 0x7f {
+			return &KeyError{Reason: "invalid_character", Message: "File path contains control characters", Key: raw}
+		}
+		if r == '\\' {
+			return &KeyError{Reason: "invalid_character", Message: "File path contains backslashes", Key: raw}
+		}
+	}
+	return nil
+}
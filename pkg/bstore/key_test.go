@@ -0,0 +1,178 @@
+package bstore
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cartersusi/bstore/pkg/storage"
+)
+
+func TestCleanKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		opts   []KeyOption
+		want   string
+		reason string
+	}{
+		{name: "plain", raw: "/a/b.txt", want: "/a/b.txt"},
+		{name: "no leading slash", raw: "a/b.txt", want: "/a/b.txt"},
+		{name: "duplicate slashes", raw: "//a///b.txt/", want: "/a/b.txt"},
+		{name: "unicode", raw: "/фото/日本.jpg", want: "/фото/日本.jpg"},
+
+		{name: "dotdot", raw: "/../etc/passwd", reason: "path_traversal"},
+		{name: "dotdot middle", raw: "/a/../../b", reason: "path_traversal"},
+		{name: "dotdot bare", raw: "..", reason: "path_traversal"},
+		{name: "dot", raw: "/a/./b", reason: "path_traversal"},
+		{name: "dotdot wildcard", raw: "/../*", opts: []KeyOption{AllowWildcard}, reason: "path_traversal"},
+		{name: "dots in name", raw: "/a/..b/c..", want: "/a/..b/c.."},
+
+		{name: "nul", raw: "/a\x00.txt", reason: "invalid_character"},
+		{name: "newline", raw: "/a\n.txt", reason: "invalid_character"},
+		{name: "escape", raw: "/a\x1b.txt", reason: "invalid_character"},
+		{name: "del", raw: "/a\x7f.txt", reason: "invalid_character"},
+		{name: "backslash", raw: `/a\..\b`, reason: "invalid_character"},
+		{name: "invalid utf8", raw: "/a\xff\xfe.txt", reason: "invalid_encoding"},
+		{name: "star in name", raw: "/a*b", reason: "invalid_character"},
+
+		{name: "zst", raw: "/a/b.zst", reason: "reserved_suffix"},
+		{name: "bsmeta", raw: "/a/b" + MetaExt, reason: "reserved_suffix"},
+		{name: "tmp", raw: "/a/b.tmp", reason: "reserved_suffix"},
+		{name: "reserved suffix in dir", raw: "/a.zst/b", want: "/a.zst/b"},
+
+		{name: "multipart", raw: "/" + MultipartDir + "/id/session.json", reason: "reserved_prefix"},
+		{name: "multipart no slash", raw: MultipartDir + "/id/00001.part", reason: "reserved_prefix"},
+		{name: "multipart dir", raw: "//" + MultipartDir, reason: "reserved_prefix"},
+		{name: "multipart wildcard", raw: "/" + MultipartDir + "/*", opts: []KeyOption{AllowWildcard}, reason: "reserved_prefix"},
+		{name: "multipart nested", raw: "/a/" + MultipartDir + "/b", want: "/a/" + MultipartDir + "/b"},
+
+		{name: "name at limit", raw: "/" + strings.Repeat("a", 16), want: "/" + strings.Repeat("a", 16)},
+		{name: "name too long", raw: "/" + strings.Repeat("a", 17), reason: "name_too_long"},
+		{name: "dir too long", raw: "/" + strings.Repeat("a", 17) + "/b", reason: "name_too_long"},
+
+		{name: "empty", raw: "", reason: "empty"},
+		{name: "root", raw: "/", reason: "empty"},
+		{name: "root allowed", raw: "/", opts: []KeyOption{AllowRoot}, want: "/"},
+		{name: "wildcard", raw: "/a/*", opts: []KeyOption{AllowWildcard}, want: "/a/*"},
+		{name: "wildcard root", raw: "*", opts: []KeyOption{AllowWildcard}, want: "/*"},
+		{name: "wildcard not allowed", raw: "/a/*", reason: "invalid_character"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CleanKey(tt.raw, 16, tt.opts...)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("CleanKey(%q) error: %v", tt.raw, err)
+				}
+				if got != tt.want {
+					t.Fatalf("CleanKey(%q) = %q, want %q", tt.raw, got, tt.want)
+				}
+				return
+			}
+
+			var key_err *KeyError
+			if !errors.As(err, &key_err) {
+				t.Fatalf("CleanKey(%q) = %q, %v, want KeyError %s", tt.raw, got, err, tt.reason)
+			}
+			if key_err.Reason != tt.reason {
+				t.Fatalf("CleanKey(%q) reason = %s, want %s", tt.raw, key_err.Reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestCleanPrefix(t *testing.T) {
+	tests := []struct {
+		raw    string
+		reason string
+	}{
+		{raw: ""},
+		{raw: "a"},
+		{raw: "a/"},
+		{raw: "a/b/c"},
+		{raw: "a/."},
+		{raw: "a/..b"},
+		{raw: ".multipart"},
+
+		{raw: "/a", reason: "invalid_prefix"},
+		{raw: "a//b", reason: "invalid_prefix"},
+		{raw: "../", reason: "path_traversal"},
+		{raw: "a/../b", reason: "path_traversal"},
+		{raw: "./a", reason: "path_traversal"},
+		{raw: ".multipart/", reason: "reserved_prefix"},
+		{raw: "a*", reason: "invalid_character"},
+		{raw: "a\\b", reason: "invalid_character"},
+		{raw: "a\x00", reason: "invalid_character"},
+		{raw: "a\xff", reason: "invalid_encoding"},
+		{raw: "a/" + strings.Repeat("x", 17), reason: "name_too_long"},
+	}
+
+	for _, tt := range tests {
+		got, err := CleanPrefix(tt.raw, 16)
+		if tt.reason == "" {
+			if err != nil || got != tt.raw {
+				t.Fatalf("CleanPrefix(%q) = %q, %v", tt.raw, got, err)
+			}
+			continue
+		}
+
+		var key_err *KeyError
+		if !errors.As(err, &key_err) || key_err.Reason != tt.reason {
+			t.Fatalf("CleanPrefix(%q) = %v, want KeyError %s", tt.raw, err, tt.reason)
+		}
+	}
+}
+
+func TestResolveKey(t *testing.T) {
+	root := t.TempDir()
+	local := storage.NewLocal(root)
+
+	tests := []struct {
+		key    string
+		want   string
+		escape bool
+	}{
+		{key: "/a/b.txt", want: filepath.Join(root, "a", "b.txt")},
+		{key: "a/b.txt", want: filepath.Join(root, "a", "b.txt")},
+		{key: "/", want: root},
+		{key: "/a/../b.txt", want: filepath.Join(root, "b.txt")},
+		{key: "/..", escape: true},
+		{key: "/../b.txt", escape: true},
+		{key: "/a/../../../etc/passwd", escape: true},
+	}
+
+	for _, tt := range tests {
+		got, err := local.Path(tt.key)
+		if tt.escape {
+			if err == nil {
+				t.Fatalf("Path(%q) = %q, want escape error", tt.key, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Path(%q) error: %v", tt.key, err)
+		}
+		if got != tt.want {
+			t.Fatalf("Path(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+
+	// every key CleanKey accepts must resolve inside the root
+	for _, raw := range []string{"/a/b", "/..b/c..", "/a/" + MultipartDir + "/b", "/ /x"} {
+		key, err := CleanKey(raw, DefaultMaxFileNameLength)
+		if err != nil {
+			t.Fatalf("CleanKey(%q) error: %v", raw, err)
+		}
+		fpath, err := local.Path(key)
+		if err != nil {
+			t.Fatalf("Path(%q) error: %v", key, err)
+		}
+		rel, err := filepath.Rel(root, fpath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			t.Fatalf("Path(%q) = %q escapes %q", key, fpath, root)
+		}
+	}
+}
@@ -2,78 +2,76 @@ package bstore
 
 import (
 	"errors"
-	"fmt"
-	"io/fs"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
 
+	"github.com/cartersusi/bstore/pkg/storage"
 	"github.com/gin-gonic/gin"
 )
 
 type ListResponse struct {
-	Files   []string `json:"files"`
-	Length  int      `json:"length"`
-	Message string   `json:"message"`
+	Files    []string               `json:"files"`
+	Metadata map[string]*ObjectMeta `json:"metadata"`
+	Length   int                    `json:"length"`
+	Message  string                 `json:"message"`
 }
 
 func (bstore *ServerCfg) List(c *gin.Context) {
 	log.Println("Valid List Request for", c.Request.URL.Path)
-	validation := bstore.ValidateReq(c)
+	validation := bstore.ValidateReq(c, AllowRoot)
 	if validation.Err != nil {
-		HandleError(c, NewError(validation.HttpStatus, validation.Err.Error(), nil))
+		HandleError(c, NewError(validation.HttpStatus, validation.Err.Error(), validation.Err))
 		return
 	}
 
-	dirpath := filepath.Join(validation.BasePath, validation.Fpath)
-	info, err := os.Stat(dirpath)
-	if err != nil {
+	log.Println("Listing files in", validation.Fpath)
+
+	infos, err := validation.Backend.List(validation.Fpath)
+	if errors.Is(err, storage.ErrNotExist) {
 		HandleError(c, NewError(http.StatusNotFound, "Directory not found", err))
 		return
 	}
-
-	if !info.IsDir() {
-		HandleError(c, NewError(http.StatusBadRequest, "Path is not a directory", errors.New("Path is not a directory")))
+	if errors.Is(err, storage.ErrNotDir) {
+		HandleError(c, NewError(http.StatusBadRequest, "Path is not a directory", err))
 		return
 	}
-
-	log.Println("Listing files in", dirpath)
-
-	list_response := &ListResponse{}
-	list_response.Files, err = list_files(dirpath)
 	if err != nil {
 		HandleError(c, NewError(http.StatusInternalServerError, "Error listing files", err))
 		return
 	}
 
+	list_response := &ListResponse{
+		Files:    list_files(infos, validation.Fpath),
+		Metadata: make(map[string]*ObjectMeta),
+	}
+
+	dir := strings.TrimSuffix(validation.Fpath, "/") + "/"
+	for _, f := range list_response.Files {
+		if meta, err := ReadMeta(validation.Backend, dir+f); err == nil {
+			list_response.Metadata[f] = meta.public()
+		}
+	}
+
 	list_response.Length = len(list_response.Files)
 	list_response.Message = "Files listed successfully from " + validation.Fpath
 	c.JSON(http.StatusOK, list_response)
 }
 
-func list_files(dirPath string) ([]string, error) {
-	var fileList []string
+// list_files turns stored keys into object names relative to dir, hiding sidecars and `.zst` suffixes.
+func list_files(infos []storage.Info, dir string) []string {
+	prefix := strings.Trim(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
 
-	err := filepath.Walk(dirPath, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
+	fileList := []string{}
+	for _, info := range infos {
+		if strings.HasSuffix(info.Key, MetaExt) || is_staging(info.Key) {
+			continue
 		}
-		if !info.IsDir() {
-			relPath, err := filepath.Rel(dirPath, path)
-			if err != nil {
-				return err
-			}
-			fileList = append(fileList, strings.TrimSuffix(relPath, ".zst"))
-			//fileList = append(fileList, strings.TrimSuffix(strings.TrimPrefix(relPath, basePath), ".zst"))
-		}
-		return nil
-	})
-
-	if err != nil {
-		return nil, fmt.Errorf("error walking through directory: %v", err)
+		fileList = append(fileList, strings.TrimSuffix(strings.TrimPrefix(info.Key, prefix), ".zst"))
 	}
 
-	return fileList, nil
+	return fileList
 }
@@ -0,0 +1,136 @@
+package bstore
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cartersusi/bstore/pkg/fops"
+	"github.com/cartersusi/bstore/pkg/storage"
+	"github.com/cartersusi/bstore/pkg/stream"
+	"github.com/gin-gonic/gin"
+)
+
+// Sidecar files live next to the object they describe: `<name>.bsmeta`.
+const (
+	MetaExt          = ".bsmeta"
+	MetaHeaderPrefix = "X-Bstore-Meta-"
+)
+
+type ObjectMeta struct {
+	ContentType string            `json:"content_type"`
+	Size        int64             `json:"size"`
+	SHA256      string            `json:"sha256"`
+	Compressed  bool              `json:"compressed"`
+	Encrypted   bool              `json:"encrypted"`
+	Uploaded    time.Time         `json:"uploaded"`
+	UserMeta    map[string]string `json:"user_meta,omitempty"`
+	// Index locates the zstd frames of a compressed object so Range requests seek frame-wise.
+	Index *fops.Index `json:"index,omitempty"`
+	// Video is probed when a video is uploaded with streaming enabled.
+	Video *stream.VideoInfo `json:"video,omitempty"`
+	// Audio is probed when an audio file is uploaded with streaming enabled.
+	Audio *stream.AudioInfo `json:"audio,omitempty"`
+	// Blob is the version of the stored blob the sidecar was written for.
+	Blob *BlobVersion `json:"blob,omitempty"`
+}
+
+// BlobVersion identifies one write of a blob, backends give every write of a key a later ModTime.
+type BlobVersion struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// describes reports whether the sidecar was written for the blob in info. Sidecars from
+// before versions were recorded are trusted.
+func (meta *ObjectMeta) describes(info storage.Info) bool {
+	return meta.Blob == nil || (meta.Blob.Size == info.Size && meta.Blob.ModTime.Equal(info.ModTime))
+}
+
+func meta_path(key string) string {
+	return strings.TrimSuffix(key, ".zst") + MetaExt
+}
+
+// ReadMeta loads the sidecar of a stored object, key may include the `.zst` suffix.
+func ReadMeta(backend storage.Backend, key string) (*ObjectMeta, error) {
+	file, _, err := backend.Get(meta_path(key))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &ObjectMeta{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+func WriteMeta(backend storage.Backend, key string, meta *ObjectMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return put_bytes(backend, meta_path(key), data)
+}
+
+func RemoveMeta(backend storage.Backend, key string) {
+	_ = backend.Delete(meta_path(key))
+}
+
+func (bstore *ServerCfg) new_meta(c *gin.Context, fpath string) *ObjectMeta {
+	content_type := c.GetHeader("Content-Type")
+	if content_type == "" {
+		content_type = mime.TypeByExtension(filepath.Ext(fpath))
+	}
+	if content_type == "" {
+		content_type = "application/octet-stream"
+	}
+
+	user_meta := make(map[string]string)
+	for name, values := range c.Request.Header {
+		if len(name) > len(MetaHeaderPrefix) && strings.EqualFold(name[:len(MetaHeaderPrefix)], MetaHeaderPrefix) {
+			user_meta[strings.ToLower(name[len(MetaHeaderPrefix):])] = strings.Join(values, ", ")
+		}
+	}
+
+	return &ObjectMeta{
+		ContentType: content_type,
+		Compressed:  bstore.Compress,
+		Encrypted:   bstore.Encrypt,
+		Uploaded:    time.Now().UTC(),
+		UserMeta:    user_meta,
+	}
+}
+
+// public returns meta as clients see it, without the internal frame index.
+func (meta *ObjectMeta) public() *ObjectMeta {
+	if meta == nil {
+		return nil
+	}
+
+	ret := *meta
+	ret.Index = nil
+	return &ret
+}
+
+func (meta *ObjectMeta) set_headers(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", meta.ContentType)
+	if meta.SHA256 != "" {
+		w.Header().Set("X-Bstore-Sha256", meta.SHA256)
+	}
+	for k, v := range meta.UserMeta {
+		w.Header().Set(MetaHeaderPrefix+k, v)
+	}
+}
@@ -1,10 +1,9 @@
 package bstore
 
 import (
-	"container/list"
+	"log"
 	"net/http"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -14,18 +13,6 @@ import (
 
 const cacheKey = "cache"
 
-type IPRateLimiter struct {
-	ips        map[string]*list.Element
-	timestamps *list.List
-	capacity   int
-	mu         sync.Mutex
-}
-
-type timestampEntry struct {
-	ip    string
-	stamp int64
-}
-
 func CacheMiddleware(cache *expirable.LRU[string, []byte]) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Set(cacheKey, cache)
@@ -42,14 +29,6 @@ func GetCache(c *gin.Context) *expirable.LRU[string, []byte] {
 	return nil
 }
 
-func NewIPRateLimiter(capacity int) *IPRateLimiter {
-	return &IPRateLimiter{
-		ips:        make(map[string]*list.Element),
-		timestamps: list.New(),
-		capacity:   capacity,
-	}
-}
-
 func (bstore *ServerCfg) Cors(r *gin.Engine) {
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     bstore.CORS.AllowOrigins,
@@ -63,63 +42,69 @@ func (bstore *ServerCfg) Cors(r *gin.Engine) {
 
 func (bstore *ServerCfg) Middleware(r *gin.Engine) {
 	r.Use(bstore.check_valid_path())
-	if bstore.MWare.RateLimit.Enabled {
-		rateLimiter := NewIPRateLimiter(int(bstore.MWare.RateLimitCapacity))
-		r.Use(checkIPRateLimit(rateLimiter, bstore.MWare.RateLimit.MaxRequests, time.Duration(bstore.MWare.RateLimit.Duration)))
+
+	tokens_path, err := TokensPath()
+	if err != nil {
+		log.Fatal(err)
 	}
-	r.Use(validateReadWriteKey(bstore.GetRWKey()))
-}
 
-func (rl *IPRateLimiter) CheckRateLimit(ip string, limit int64, per time.Duration) bool {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+	// clients are limited before authentication, tokens once they are known
+	var rateLimiter *RateLimiter
+	if bstore.MWare.RateLimit.Enabled {
+		rateLimiter = NewRateLimiter(int(bstore.MWare.RateLimitCapacity))
+		r.Use(checkIPRateLimit(rateLimiter, bstore.MWare.RateLimit))
+	}
 
-	now := time.Now().UnixNano()
+	r.Use(validateReadWriteKey(bstore.GetRWKey(), GetSigningKey(), NewTokenStore(tokens_path)))
 
-	if elem, exists := rl.ips[ip]; exists {
-		entry := elem.Value.(*timestampEntry)
-		if now-entry.stamp < per.Nanoseconds() {
-			return false
-		}
-		entry.stamp = now
-		rl.timestamps.MoveToFront(elem)
-	} else {
-		if len(rl.ips) >= rl.capacity {
-			oldest := rl.timestamps.Back()
-			if oldest != nil {
-				oldestEntry := oldest.Value.(*timestampEntry)
-				delete(rl.ips, oldestEntry.ip)
-				rl.timestamps.Remove(oldest)
-			}
-		}
-		entry := &timestampEntry{ip: ip, stamp: now}
-		elem := rl.timestamps.PushFront(entry)
-		rl.ips[ip] = elem
+	if rateLimiter != nil {
+		r.Use(checkTokenRateLimit(rateLimiter, bstore.MWare.RateLimit))
 	}
-
-	return true
 }
 
-func validateReadWriteKey(validKey string) gin.HandlerFunc {
-	protectedPaths := []string{
-		"/api/upload/",
-		"/api/download/",
-		"/api/delete/",
-		"/api/list/",
+// validateReadWriteKey accepts either the global read/write key, which may do anything,
+// a scoped token whose operations, access tiers and path prefixes cover the request,
+// or a presigned URL for the exact path and method.
+func validateReadWriteKey(validKey, signingKey string, tokens *TokenStore) gin.HandlerFunc {
+	protectedPaths := map[string]string{
+		"/api/upload/":    OpUpload,
+		"/api/download/":  OpDownload,
+		"/api/delete/":    OpDelete,
+		"/api/list/":      OpList,
+		"/api/stat/":      OpDownload,
+		"/api/presign/":   OpDownload,
+		"/api/multipart/": OpUpload,
+		"/api/tus/":       OpUpload,
+		"/api/jobs/":      OpUpload,
 	}
 
 	return func(c *gin.Context) {
 		path := c.Request.URL.Path
 
-		needsValidation := false
-		for _, protectedPath := range protectedPaths {
+		op := ""
+		fpath := ""
+		for protectedPath, protectedOp := range protectedPaths {
 			if strings.HasPrefix(path, protectedPath) {
-				needsValidation = true
+				op = protectedOp
+				fpath = strings.TrimPrefix(path, protectedPath)
 				break
 			}
 		}
 
-		if !needsValidation {
+		// tus clients discover the server with an unauthenticated OPTIONS
+		if op == "" || (c.Request.Method == http.MethodOptions && strings.HasPrefix(path, "/api/tus/")) {
+			c.Next()
+			return
+		}
+
+		if strings.HasPrefix(path, "/api/presign/") {
+			op = presign_op(c.Query("method"))
+		} else if is_presigned(c) && c.GetHeader("Authorization") == "" {
+			if err := verify_presigned(c, signingKey); err != nil {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				c.Abort()
+				return
+			}
 			c.Next()
 			return
 		}
@@ -139,24 +124,37 @@ func validateReadWriteKey(validKey string) gin.HandlerFunc {
 		}
 
 		key := strings.TrimPrefix(authHeader, bearerPrefix)
-		if key != validKey {
+		if secure_compare(key, validKey) {
+			c.Next()
+			return
+		}
+
+		token := tokens.Lookup(key)
+		if token == nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid read_write key"})
 			c.Abort()
 			return
 		}
 
-		c.Next()
-	}
-}
+		// the job names the file, GetJob checks the token against it
+		if strings.HasPrefix(path, "/api/jobs/") {
+			c.Set(tokenKey, token)
+			c.Next()
+			return
+		}
 
-func checkIPRateLimit(rl *IPRateLimiter, maxRequests int64, duration time.Duration) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		ip := c.ClientIP()
-		if !rl.CheckRateLimit(ip, maxRequests, duration) {
-			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+		access := "private"
+		if c.GetHeader("X-Access") == "public" {
+			access = "public"
+		}
+
+		if err := token.Allows(op, access, fpath); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
 			c.Abort()
 			return
 		}
+
+		c.Set(tokenKey, token)
 		c.Next()
 	}
 }
@@ -177,11 +175,21 @@ func (bstore *ServerCfg) check_valid_path() gin.HandlerFunc {
 				return
 			}
 
+			if bstore.S3.Enabled && strings.HasPrefix(path, bstore.S3.Prefix+"/") {
+				c.Next()
+				return
+			}
+
 			validPaths := []string{
 				"/api/upload/",
 				"/api/download/",
 				"/api/delete/",
 				"/api/list/",
+				"/api/stat/",
+				"/api/presign/",
+				"/api/multipart/",
+				"/api/tus/",
+				"/api/jobs/",
 			}
 
 			for _, validPath := range validPaths {
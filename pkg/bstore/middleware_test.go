@@ -0,0 +1,123 @@
+package bstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// test_server is an engine with the middleware of cfg and a 200 handler behind it,
+// with its config directory, and so the tokens file, in a temporary HOME.
+func test_server(t *testing.T, cfg *ServerCfg) (*gin.Engine, string) {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("BSTORE_READ_WRITE_KEY", "rw-key")
+	t.Setenv("BSTORE_SIGNING_KEY", "")
+
+	tokens_path, err := TokensPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	cfg.Middleware(r)
+	r.Any("/*path", func(c *gin.Context) { c.Status(http.StatusOK) })
+	return r, tokens_path
+}
+
+func do(r *gin.Engine, method, path, key string) int {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func limited_cfg(max int64) *ServerCfg {
+	cfg := &ServerCfg{}
+	cfg.MWare.MaxPathLength = 1024
+	cfg.MWare.RateLimitCapacity = 100
+	cfg.MWare.RateLimit = RateLimitConfig{Enabled: true, MaxRequests: max, Duration: 3600}
+	return cfg
+}
+
+func TestRateLimitBeforeAuth(t *testing.T) {
+	r, _ := test_server(t, limited_cfg(2))
+
+	for i := 0; i < 2; i++ {
+		if code := do(r, http.MethodGet, "/api/download/a.txt", "wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("request %d = %d, want 401", i, code)
+		}
+	}
+	if code := do(r, http.MethodGet, "/api/download/a.txt", "wrong"); code != http.StatusTooManyRequests {
+		t.Fatalf("request with a wrong key after the limit = %d, want 429", code)
+	}
+	if code := do(r, http.MethodGet, "/api/download/a.txt", "rw-key"); code != http.StatusTooManyRequests {
+		t.Fatalf("request with the key after the limit = %d, want 429", code)
+	}
+}
+
+func TestRateLimitPerToken(t *testing.T) {
+	cfg := limited_cfg(10)
+	r, tokens_path := test_server(t, cfg)
+
+	secret, err := CreateToken(tokens_path, &Token{
+		Name:       "uploader",
+		Operations: []string{OpUpload},
+		Access:     []string{"private"},
+		RateLimit:  RateLimitRule{MaxRequests: 1, Duration: 3600},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := do(r, http.MethodPut, "/api/upload/a.txt", secret); code != http.StatusOK {
+		t.Fatalf("first token request = %d, want 200", code)
+	}
+	if code := do(r, http.MethodPut, "/api/upload/a.txt", secret); code != http.StatusTooManyRequests {
+		t.Fatalf("second token request = %d, want 429 from the token's own limit", code)
+	}
+	if code := do(r, http.MethodPut, "/api/upload/a.txt", "rw-key"); code != http.StatusOK {
+		t.Fatalf("request with the key from the same IP = %d, want 200", code)
+	}
+}
+
+func TestOptionsBypass(t *testing.T) {
+	cfg := &ServerCfg{}
+	cfg.MWare.MaxPathLength = 1024
+	r, _ := test_server(t, cfg)
+
+	if code := do(r, http.MethodOptions, "/api/tus/a.txt", ""); code != http.StatusOK {
+		t.Fatalf("OPTIONS on tus = %d, want 200 without a key", code)
+	}
+	for _, path := range []string{"/api/upload/a.txt", "/api/delete/a.txt", "/api/multipart/a.txt"} {
+		if code := do(r, http.MethodOptions, path, ""); code != http.StatusUnauthorized {
+			t.Fatalf("OPTIONS on %s = %d, want 401", path, code)
+		}
+	}
+}
+
+func TestRouteClass(t *testing.T) {
+	tests := map[string]string{
+		"/api/upload/a.txt":      RouteUpload,
+		"/api/multipart/a.txt":   RouteUpload,
+		"/api/tus/a.txt":         RouteUpload,
+		"/api/download/a.txt":    RouteServe,
+		"/bstore/a.txt":          RouteServe,
+		"/stream/a/index.mpd":    RouteServe,
+		"/api/delete/a.txt":      RouteDefault,
+		"/api/jobs/0123456789ab": RouteDefault,
+	}
+	for path, want := range tests {
+		if got := route_class(path); got != want {
+			t.Errorf("route_class(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
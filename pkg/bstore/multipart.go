@@ -0,0 +1,468 @@
+package bstore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cartersusi/bstore/pkg/fops"
+	"github.com/cartersusi/bstore/pkg/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// Unfinished uploads are staged in the backend of their access tier under
+// `/.multipart/<upload_id>/`, keys below it are reserved.
+const (
+	MultipartDir            = ".multipart"
+	MaxMultipartParts       = 10000
+	DefaultMultipartTTL     = 24 * 60 * 60
+	DefaultMultipartMaxSize = 100 << 30
+
+	multipartGCInterval = 10 * time.Minute
+	multipartSession    = "session.json"
+	multipartPartExt    = ".part"
+
+	ProtocolMultipart = "multipart"
+	ProtocolTus       = "tus"
+)
+
+// MultipartConfig configures the multipart API, and the tus endpoint which stages uploads the same way.
+type MultipartConfig struct {
+	Enabled bool  `yaml:"enable"`
+	MaxSize int64 `yaml:"max_size"`
+	TTL     int64 `yaml:"ttl"`
+}
+
+type MultipartSession struct {
+	UploadID string      `json:"upload_id"`
+	Protocol string      `json:"protocol"`
+	Key      string      `json:"file_path"`
+	Length   int64       `json:"length,omitempty"` // total size declared by tus clients
+	Offset   int64       `json:"offset,omitempty"` // bytes tus clients sent so far
+	Parts    int         `json:"parts,omitempty"`  // parts the tus offset is staged in
+	Created  time.Time   `json:"created"`
+	Expires  time.Time   `json:"expires"`
+	Meta     *ObjectMeta `json:"meta"`
+}
+
+type MultipartPart struct {
+	PartNumber int       `json:"part_number"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	Uploaded   time.Time `json:"uploaded"`
+
+	key       string
+	encrypted bool
+}
+
+type MultipartResponse struct {
+	UploadID string          `json:"upload_id"`
+	FilePath string          `json:"file_path"`
+	Expires  time.Time       `json:"expires"`
+	Parts    []MultipartPart `json:"parts"`
+	Message  string          `json:"message"`
+}
+
+// MultipartPost starts an upload, or completes the one named by `upload_id`.
+func (bstore *ServerCfg) MultipartPost(c *gin.Context) {
+	if c.Query("upload_id") != "" {
+		bstore.MultipartComplete(c)
+		return
+	}
+	bstore.MultipartInit(c)
+}
+
+func (bstore *ServerCfg) MultipartInit(c *gin.Context) {
+	log.Println("Valid Multipart Init Request for", c.Request.URL.Path)
+	validation := bstore.ValidateReq(c)
+	if validation.Err != nil {
+		HandleError(c, NewError(validation.HttpStatus, validation.Err.Error(), validation.Err))
+		return
+	}
+
+	session, err := create_session(validation, ProtocolMultipart, 0, bstore.Multipart.TTL, bstore.new_meta(c, validation.Fpath))
+	if err != nil {
+		HandleError(c, NewError(http.StatusInternalServerError, "Error creating upload", err))
+		return
+	}
+
+	log.Printf("Multipart upload %s started for %s\n", session.UploadID, session.Key)
+	c.JSON(http.StatusOK, &MultipartResponse{
+		UploadID: session.UploadID,
+		FilePath: session.Key,
+		Expires:  session.Expires,
+		Parts:    []MultipartPart{},
+		Message:  "Multipart upload started",
+	})
+}
+
+// MultipartUpload stages one numbered part, uploading the same number again replaces it.
+func (bstore *ServerCfg) MultipartUpload(c *gin.Context) {
+	log.Println("Valid Multipart Part Request for", c.Request.URL.Path)
+	validation, session, ok := bstore.validate_multipart(c)
+	if !ok {
+		return
+	}
+
+	part_number, err := strconv.Atoi(c.Query("part_number"))
+	if err != nil || part_number < 1 || part_number > MaxMultipartParts {
+		HandleError(c, NewError(http.StatusBadRequest, fmt.Sprintf("part_number must be between 1 and %d", MaxMultipartParts), err))
+		return
+	}
+
+	parts, err := list_parts(validation.Backend, session.UploadID)
+	if err != nil {
+		HandleError(c, NewError(http.StatusInternalServerError, "Error listing parts", err))
+		return
+	}
+
+	// the part may not push the staged parts past the upload limit, a replaced part no longer counts
+	var staged int64
+	for _, part := range parts {
+		if part.PartNumber != part_number {
+			staged += part.Size
+		}
+	}
+
+	limit := min(bstore.MaxFileSize, bstore.Multipart.MaxSize-staged)
+	if limit < 0 || c.Request.ContentLength > limit {
+		HandleError(c, NewError(http.StatusRequestEntityTooLarge, "Part size exceeds maximum allowed size", nil))
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	key := part_key(session.UploadID, part_number)
+
+	// parts are encrypted like any object but not compressed, that happens once on completion
+	part := &ObjectMeta{Encrypted: bstore.Encrypt, Uploaded: time.Now().UTC()}
+	err = put_stream(validation.Backend, key, body, part, false, bstore.CompressionLevel, bstore.Encrypt)
+	if err != nil {
+		var max_err *http.MaxBytesError
+		if errors.As(err, &max_err) {
+			HandleError(c, NewError(http.StatusRequestEntityTooLarge, "Part size exceeds maximum allowed size", err))
+			return
+		}
+		HandleError(c, NewError(http.StatusInternalServerError, "Error writing part", err))
+		return
+	}
+
+	if err = WriteMeta(validation.Backend, key, part); err != nil {
+		HandleError(c, NewError(http.StatusInternalServerError, "Error writing part", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, &MultipartPart{
+		PartNumber: part_number,
+		Size:       part.Size,
+		SHA256:     part.SHA256,
+		Uploaded:   part.Uploaded,
+	})
+}
+
+func (bstore *ServerCfg) MultipartList(c *gin.Context) {
+	log.Println("Valid Multipart List Request for", c.Request.URL.Path)
+	validation, session, ok := bstore.validate_multipart(c)
+	if !ok {
+		return
+	}
+
+	parts, err := list_parts(validation.Backend, session.UploadID)
+	if err != nil {
+		HandleError(c, NewError(http.StatusInternalServerError, "Error listing parts", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, &MultipartResponse{
+		UploadID: session.UploadID,
+		FilePath: session.Key,
+		Expires:  session.Expires,
+		Parts:    parts,
+		Message:  fmt.Sprintf("%d parts uploaded", len(parts)),
+	})
+}
+
+// MultipartComplete joins parts 1..N in order and stores them like a single upload.
+func (bstore *ServerCfg) MultipartComplete(c *gin.Context) {
+	log.Println("Valid Multipart Complete Request for", c.Request.URL.Path)
+	validation, session, ok := bstore.validate_multipart(c)
+	if !ok {
+		return
+	}
+
+	parts, err := list_parts(validation.Backend, session.UploadID)
+	if err != nil {
+		HandleError(c, NewError(http.StatusInternalServerError, "Error listing parts", err))
+		return
+	}
+	if len(parts) == 0 {
+		HandleError(c, NewError(http.StatusBadRequest, "No parts uploaded", nil))
+		return
+	}
+
+	var total int64
+	for i, part := range parts {
+		if part.PartNumber != i+1 {
+			HandleError(c, NewError(http.StatusBadRequest, fmt.Sprintf("Part %d is missing", i+1), nil))
+			return
+		}
+		total += part.Size
+	}
+	if total > bstore.Multipart.MaxSize {
+		HandleError(c, NewError(http.StatusRequestEntityTooLarge, "File size exceeds maximum allowed multipart size", nil))
+		return
+	}
+
+	log.Printf("Completing multipart upload %s, %d parts, %d bytes\n", session.UploadID, len(parts), total)
+	meta := session.Meta
+	meta.Uploaded = time.Now().UTC()
+
+	body := &parts_reader{backend: validation.Backend, parts: parts}
+	defer body.Close()
+	upload_response, err := bstore.store_upload(c, validation, body, meta)
+	if err != nil {
+		HandleError(c, err)
+		return
+	}
+
+	remove_session(validation.Backend, session.UploadID)
+	c.JSON(http.StatusOK, upload_response)
+}
+
+func (bstore *ServerCfg) MultipartAbort(c *gin.Context) {
+	log.Println("Valid Multipart Abort Request for", c.Request.URL.Path)
+	validation, session, ok := bstore.validate_multipart(c)
+	if !ok {
+		return
+	}
+
+	remove_session(validation.Backend, session.UploadID)
+	c.JSON(http.StatusOK, gin.H{"message": "Multipart upload aborted"})
+}
+
+// MultipartGC removes uploads whose session expired, it never returns.
+func (bstore *ServerCfg) MultipartGC() {
+	ticker := time.NewTicker(multipartGCInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, backend := range []storage.Backend{bstore.Public, bstore.Private} {
+			gc_multipart(backend, now)
+		}
+	}
+}
+
+func gc_multipart(backend storage.Backend, now time.Time) {
+	infos, err := backend.List(MultipartDir)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotExist) {
+			log.Println("Error listing multipart uploads:", err)
+		}
+		return
+	}
+
+	// an upload whose session is unreadable expires by the age of its newest file
+	newest := make(map[string]time.Time)
+	for _, info := range infos {
+		id, _, _ := strings.Cut(strings.TrimPrefix(info.Key, MultipartDir+"/"), "/")
+		if info.ModTime.After(newest[id]) {
+			newest[id] = info.ModTime
+		}
+	}
+
+	for id, modified := range newest {
+		expires := modified.Add(DefaultMultipartTTL * time.Second)
+		if session, err := read_session(backend, id); err == nil {
+			expires = session.Expires
+		}
+
+		if now.After(expires) {
+			log.Println("Removing expired multipart upload", id)
+			remove_session(backend, id)
+		}
+	}
+}
+
+func create_session(validation ReqValidation, protocol string, length, ttl int64, meta *ObjectMeta) (*MultipartSession, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	session := &MultipartSession{
+		UploadID: hex.EncodeToString(raw),
+		Protocol: protocol,
+		Key:      validation.Fpath,
+		Length:   length,
+		Created:  now,
+		Expires:  now.Add(time.Duration(ttl) * time.Second),
+		Meta:     meta,
+	}
+
+	return session, write_session(validation.Backend, session)
+}
+
+func write_session(backend storage.Backend, session *MultipartSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return put_bytes(backend, session_key(session.UploadID), data)
+}
+
+func (bstore *ServerCfg) validate_multipart(c *gin.Context) (ReqValidation, *MultipartSession, bool) {
+	return bstore.validate_session(c, ProtocolMultipart)
+}
+
+// validate_session resolves the session named by `upload_id`, it must belong to the key in
+// the path and have been started with protocol.
+func (bstore *ServerCfg) validate_session(c *gin.Context, protocol string) (ReqValidation, *MultipartSession, bool) {
+	validation := bstore.ValidateReq(c)
+	if validation.Err != nil {
+		HandleError(c, NewError(validation.HttpStatus, validation.Err.Error(), validation.Err))
+		return validation, nil, false
+	}
+
+	upload_id := c.Query("upload_id")
+	if _, err := hex.DecodeString(upload_id); err != nil || len(upload_id) != 32 {
+		HandleError(c, NewError(http.StatusBadRequest, "Invalid upload_id", err))
+		return validation, nil, false
+	}
+
+	session, err := read_session(validation.Backend, upload_id)
+	if err != nil || session.Key != validation.Fpath || session.Protocol != protocol || time.Now().After(session.Expires) {
+		HandleError(c, NewError(http.StatusNotFound, "Upload not found", err))
+		return validation, nil, false
+	}
+
+	return validation, session, true
+}
+
+func read_session(backend storage.Backend, upload_id string) (*MultipartSession, error) {
+	file, _, err := backend.Get(session_key(upload_id))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	session := &MultipartSession{}
+	if err = json.NewDecoder(file).Decode(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func remove_session(backend storage.Backend, upload_id string) {
+	tus_locks.Delete(upload_id)
+	if err := backend.DeletePrefix(path.Join(MultipartDir, upload_id)); err != nil && !errors.Is(err, storage.ErrNotExist) {
+		log.Printf("Error removing multipart upload %s: %v\n", upload_id, err)
+	}
+}
+
+// list_parts returns the staged parts sorted by number.
+func list_parts(backend storage.Backend, upload_id string) ([]MultipartPart, error) {
+	infos, err := backend.List(path.Join(MultipartDir, upload_id))
+	if err != nil {
+		return nil, err
+	}
+
+	parts := []MultipartPart{}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Key, multipartPartExt) {
+			continue
+		}
+
+		part_number, err := strconv.Atoi(strings.TrimSuffix(path.Base(info.Key), multipartPartExt))
+		if err != nil {
+			continue
+		}
+
+		// a part without its sidecar is still being written
+		meta, err := ReadMeta(backend, info.Key)
+		if err != nil {
+			continue
+		}
+
+		parts = append(parts, MultipartPart{
+			PartNumber: part_number,
+			Size:       meta.Size,
+			SHA256:     meta.SHA256,
+			Uploaded:   meta.Uploaded,
+			key:        info.Key,
+			encrypted:  meta.Encrypted,
+		})
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	return parts, nil
+}
+
+// parts_reader reads the plaintext of each part in turn, opening one at a time.
+type parts_reader struct {
+	backend storage.Backend
+	parts   []MultipartPart
+	current *fops.Reader
+}
+
+func (pr *parts_reader) Read(p []byte) (int, error) {
+	for {
+		if pr.current == nil {
+			if len(pr.parts) == 0 {
+				return 0, io.EOF
+			}
+
+			part := pr.parts[0]
+			pr.parts = pr.parts[1:]
+
+			file, info, err := pr.backend.Get(part.key)
+			if err != nil {
+				return 0, err
+			}
+			pr.current, err = fops.NewReader(file, info.Size, false, part.encrypted)
+			if err != nil {
+				file.Close()
+				return 0, err
+			}
+		}
+
+		n, err := pr.current.Read(p)
+		if err == io.EOF {
+			pr.current.Close()
+			pr.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (pr *parts_reader) Close() error {
+	if pr.current != nil {
+		return pr.current.Close()
+	}
+	return nil
+}
+
+func is_staging(key string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(key, "/"), MultipartDir+"/")
+}
+
+func session_key(upload_id string) string {
+	return path.Join("/", MultipartDir, upload_id, multipartSession)
+}
+
+func part_key(upload_id string, part_number int) string {
+	return path.Join("/", MultipartDir, upload_id, fmt.Sprintf("%05d%s", part_number, multipartPartExt))
+}
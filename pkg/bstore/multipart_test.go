@@ -0,0 +1,70 @@
+package bstore
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cartersusi/bstore/pkg/storage"
+	"github.com/gin-gonic/gin"
+)
+
+func multipart_server() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	cfg := &ServerCfg{
+		MaxFileNameLen: 255,
+		MaxFileSize:    8,
+		Public:         storage.NewMemory(),
+		Private:        storage.NewMemory(),
+		Multipart:      MultipartConfig{Enabled: true, MaxSize: 10, TTL: 3600},
+	}
+
+	r := gin.New()
+	r.POST("/api/multipart/*file_path", cfg.MultipartPost)
+	r.PUT("/api/multipart/*file_path", cfg.MultipartUpload)
+	return r
+}
+
+func multipart_do(r *gin.Engine, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestMultipartUploadMaxSize(t *testing.T) {
+	r := multipart_server()
+
+	w := multipart_do(r, http.MethodPost, "/api/multipart/a.txt", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("init = %d: %s", w.Code, w.Body)
+	}
+	var resp MultipartResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	target := "/api/multipart/a.txt?upload_id=" + resp.UploadID + "&part_number="
+
+	if w = multipart_do(r, http.MethodPut, target+"1", "123456"); w.Code != http.StatusOK {
+		t.Fatalf("part 1 = %d: %s", w.Code, w.Body)
+	}
+	if w = multipart_do(r, http.MethodPut, target+"2", "12345"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("part past the upload limit = %d, want 413", w.Code)
+	}
+	if w = multipart_do(r, http.MethodPut, target+"2", "1234"); w.Code != http.StatusOK {
+		t.Fatalf("part up to the upload limit = %d: %s", w.Code, w.Body)
+	}
+
+	// replacing a part only counts its new size
+	if w = multipart_do(r, http.MethodPut, target+"1", "12"); w.Code != http.StatusOK {
+		t.Fatalf("replacing part 1 = %d: %s", w.Code, w.Body)
+	}
+	if w = multipart_do(r, http.MethodPut, target+"3", "12345"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("part past the upload limit after a replace = %d, want 413", w.Code)
+	}
+	if w = multipart_do(r, http.MethodPut, target+"3", "1234"); w.Code != http.StatusOK {
+		t.Fatalf("part up to the upload limit after a replace = %d: %s", w.Code, w.Body)
+	}
+}
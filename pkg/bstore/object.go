@@ -0,0 +1,189 @@
+package bstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cartersusi/bstore/pkg/fops"
+	"github.com/cartersusi/bstore/pkg/storage"
+)
+
+// object is a stored blob together with its sidecar, Meta is nil for files
+// written before sidecars existed and for generated stream segments.
+type object struct {
+	Key     string
+	Info    storage.Info
+	Meta    *ObjectMeta
+	Encrypt bool
+	backend storage.Backend
+}
+
+// A sidecar is written after its blob, so for a moment a replaced object has a sidecar
+// describing the previous blob. Lookups read the sidecar again until both agree.
+const (
+	metaRetries    = 5
+	metaRetryDelay = 20 * time.Millisecond
+)
+
+var errStaleMeta = errors.New("sidecar does not describe the stored blob")
+
+// find_object resolves key to the blob actually stored, which may carry a `.zst` suffix.
+func (bstore *ServerCfg) find_object(backend storage.Backend, key string) (*object, error) {
+	for attempt := 1; ; attempt++ {
+		obj, err := bstore.resolve_object(backend, key)
+		if err != nil || obj.Meta == nil || obj.Meta.describes(obj.Info) || attempt == metaRetries {
+			return obj, err
+		}
+		time.Sleep(metaRetryDelay)
+	}
+}
+
+func (bstore *ServerCfg) resolve_object(backend storage.Backend, key string) (*object, error) {
+	obj := &object{Encrypt: bstore.Encrypt, backend: backend}
+	candidates := []string{key, key + ".zst"}
+
+	meta, err := ReadMeta(backend, key)
+	if err == nil {
+		obj.Meta = meta
+		obj.Encrypt = meta.Encrypted
+		if meta.Compressed {
+			candidates = []string{key + ".zst"}
+		} else {
+			candidates = []string{key}
+		}
+	}
+
+	for _, k := range candidates {
+		info, err := backend.Stat(k)
+		if err == nil {
+			obj.Key = k
+			obj.Info = info
+			return obj, nil
+		}
+	}
+
+	return nil, storage.ErrNotExist
+}
+
+// open refuses a blob its sidecar was not written for, decoding it with the wrong index,
+// size or encryption setting would serve garbage.
+func (obj *object) open() (*fops.Reader, error) {
+	file, info, err := obj.backend.Get(obj.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if obj.Meta != nil && !obj.Meta.describes(info) {
+		file.Close()
+		return nil, errStaleMeta
+	}
+
+	// the sidecar records how the object was written, only older files are sniffed
+	var r *fops.Reader
+	if obj.Meta != nil {
+		r, err = fops.NewReader(file, info.Size, obj.Compressed(), obj.Meta.Encrypted)
+	} else {
+		r, err = fops.NewLegacyReader(file, info.Size, obj.Compressed(), obj.Encrypt)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if obj.Meta != nil {
+		r.SetSize(obj.Meta.Size)
+		if obj.Compressed() {
+			r.SetIndex(obj.Meta.Index)
+		}
+	}
+	return r, nil
+}
+
+func (obj *object) Compressed() bool {
+	return strings.HasSuffix(obj.Key, ".zst")
+}
+
+func (obj *object) Name() string {
+	return path.Base(strings.TrimSuffix(obj.Key, ".zst"))
+}
+
+// write_object streams r through the compression/encryption pipeline into the backend and
+// records the plaintext size and checksum in its sidecar. An earlier object under the same
+// key stored with the other compression setting is removed.
+func (bstore *ServerCfg) write_object(backend storage.Backend, key string, r io.Reader, meta *ObjectMeta) error {
+	stored_key, stale_key := key, key+".zst"
+	if bstore.Compress {
+		stored_key, stale_key = stale_key, stored_key
+	}
+
+	err := put_stream(backend, stored_key, r, meta, bstore.Compress, bstore.CompressionLevel, bstore.Encrypt)
+	if err != nil {
+		return err
+	}
+
+	if err = WriteMeta(backend, key, meta); err != nil {
+		_ = backend.Delete(stored_key)
+		return err
+	}
+
+	if err = backend.Delete(stale_key); err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return fmt.Errorf("removing stale %s: %w", stale_key, err)
+	}
+	return nil
+}
+
+// put_stream pipes r through the compression/encryption pipeline into backend.Put and
+// records the plaintext size, SHA-256, frame index and the version of the stored blob in meta.
+func put_stream(backend storage.Backend, key string, r io.Reader, meta *ObjectMeta, compress bool, level int, encrypt bool) error {
+	hash := sha256.New()
+	pr, pw := io.Pipe()
+
+	var n int64
+	var index *fops.Index
+	go func() {
+		var err error
+		n, index, err = copy_object(pw, io.TeeReader(r, hash), compress, level, encrypt)
+		pw.CloseWithError(err)
+	}()
+
+	info, err := backend.Put(key, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+
+	meta.Size = n
+	meta.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	meta.Index = index
+	meta.Blob = &BlobVersion{Size: info.Size, ModTime: info.ModTime}
+	return nil
+}
+
+func copy_object(dst io.Writer, r io.Reader, compress bool, level int, encrypt bool) (int64, *fops.Index, error) {
+	w, err := fops.NewWriter(dst, compress, level, encrypt)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return n, nil, err
+	}
+
+	if err = w.Close(); err != nil {
+		return n, nil, err
+	}
+	return n, w.Index(), nil
+}
+
+func put_bytes(backend storage.Backend, key string, data []byte) error {
+	_, err := backend.Put(key, bytes.NewReader(data))
+	return err
+}
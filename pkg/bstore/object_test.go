@@ -0,0 +1,71 @@
+package bstore
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/cartersusi/bstore/pkg/storage"
+)
+
+func read_object(t *testing.T, cfg *ServerCfg, backend storage.Backend, key string) (string, error) {
+	t.Helper()
+
+	obj, err := cfg.find_object(backend, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := obj.open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), nil
+}
+
+func TestObjectStaleMeta(t *testing.T) {
+	cfg := &ServerCfg{Compress: true, CompressionLevel: 3}
+	backend := storage.NewMemory()
+
+	if err := cfg.write_object(backend, "a.txt", strings.NewReader("first version"), &ObjectMeta{Compressed: true}); err != nil {
+		t.Fatal(err)
+	}
+	old, err := cfg.find_object(backend, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the blob is replaced, its sidecar is not written yet
+	meta := &ObjectMeta{Compressed: true}
+	if err = put_stream(backend, "a.txt.zst", strings.NewReader("other version"), meta, true, 3, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = old.open(); !errors.Is(err, errStaleMeta) {
+		t.Fatalf("open of a replaced blob = %v, want errStaleMeta", err)
+	}
+	if _, err = read_object(t, cfg, backend, "a.txt"); !errors.Is(err, errStaleMeta) {
+		t.Fatalf("read before the sidecar is written = %v, want errStaleMeta", err)
+	}
+
+	if err = WriteMeta(backend, "a.txt", meta); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := read_object(t, cfg, backend, "a.txt"); err != nil || got != "other version" {
+		t.Fatalf("read after the sidecar is written = %q, %v", got, err)
+	}
+
+	// sidecars written before blob versions were recorded are trusted
+	meta.Blob = nil
+	if err = WriteMeta(backend, "a.txt", meta); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := read_object(t, cfg, backend, "a.txt"); err != nil || got != "other version" {
+		t.Fatalf("read with an unversioned sidecar = %q, %v", got, err)
+	}
+}
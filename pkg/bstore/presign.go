@@ -0,0 +1,186 @@
+package bstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cartersusi/bstore/pkg/stream"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DefaultPresignExpiry = 15 * time.Minute
+	MaxPresignExpiry     = 7 * 24 * time.Hour
+)
+
+const (
+	sigMethod    = "X-Bstore-Method"
+	sigExpires   = "X-Bstore-Expires"
+	sigAccess    = "X-Bstore-Access"
+	sigIP        = "X-Bstore-IP"
+	sigSignature = "X-Bstore-Signature"
+)
+
+type PresignResponse struct {
+	Url     string          `json:"url"`
+	Method  string          `json:"method"`
+	Expires time.Time       `json:"expires"`
+	Message string          `json:"message"`
+	Stream  *StreamResponse `json:"stream,omitempty"`
+}
+
+// Presign mints a URL that lets anyone holding it GET or PUT a single object until it expires,
+// without the bearer key. Query: method=GET|PUT|STREAM, expires=<seconds>, ip=<client ip to bind to>.
+// STREAM signs the stream URLs of a video or audio file, `ip` does not apply to them.
+func (bstore *ServerCfg) Presign(c *gin.Context) {
+	log.Println("Valid Presign Request for", c.Request.URL.Path)
+	validation := bstore.ValidateReq(c)
+	if validation.Err != nil {
+		HandleError(c, NewError(validation.HttpStatus, validation.Err.Error(), validation.Err))
+		return
+	}
+
+	method := strings.ToUpper(c.DefaultQuery("method", http.MethodGet))
+	route := ""
+	switch method {
+	case http.MethodGet:
+		route = "/api/download"
+	case http.MethodPut:
+		route = "/api/upload"
+	case "STREAM":
+		if !stream.CheckEXT(validation.Fpath) && !stream.CheckAudioEXT(validation.Fpath) {
+			HandleError(c, NewError(http.StatusBadRequest, "STREAM is only available for videos and audio files", nil))
+			return
+		}
+	default:
+		HandleError(c, NewError(http.StatusBadRequest, "method must be GET, PUT or STREAM", nil))
+		return
+	}
+
+	expiry := DefaultPresignExpiry
+	if s := c.Query("expires"); s != "" {
+		seconds, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || seconds < 1 {
+			HandleError(c, NewError(http.StatusBadRequest, "expires must be a positive number of seconds", err))
+			return
+		}
+		expiry = time.Duration(seconds) * time.Second
+	}
+	if expiry > MaxPresignExpiry {
+		HandleError(c, NewError(http.StatusBadRequest, fmt.Sprintf("expires must not exceed %d seconds", int(MaxPresignExpiry.Seconds())), nil))
+		return
+	}
+
+	access := "private"
+	if bstore.GetAccess(c) == "public" {
+		access = "public"
+	}
+
+	if method == "STREAM" {
+		stream_response := bstore.make_stream_urls(c, validation.Fpath, access, expiry)
+		c.JSON(http.StatusOK, &PresignResponse{
+			Url:     stream_response.Hls,
+			Method:  method,
+			Expires: time.Now().Add(expiry).UTC().Truncate(time.Second),
+			Message: "Stream URLs created for " + validation.Fpath,
+			Stream:  stream_response,
+		})
+		return
+	}
+
+	expires := time.Now().Add(expiry).Unix()
+	path := route + validation.Fpath
+	ip := c.Query("ip")
+
+	q := url.Values{}
+	q.Set(sigMethod, method)
+	q.Set(sigExpires, strconv.FormatInt(expires, 10))
+	q.Set(sigAccess, access)
+	if ip != "" {
+		q.Set(sigIP, ip)
+	}
+	q.Set(sigSignature, sign_url(GetSigningKey(), method, path, access, ip, expires))
+
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+
+	presign_response := &PresignResponse{
+		Url:     fmt.Sprintf("%s://%s%s?%s", scheme, c.Request.Host, (&url.URL{Path: path}).EscapedPath(), q.Encode()),
+		Method:  method,
+		Expires: time.Unix(expires, 0).UTC(),
+		Message: "Presigned URL created for " + validation.Fpath,
+	}
+	c.JSON(http.StatusOK, presign_response)
+}
+
+// GetSigningKey returns BSTORE_SIGNING_KEY, or the read/write key when no separate key is set.
+// Changing it invalidates every URL handed out so far.
+func GetSigningKey() string {
+	if key := os.Getenv("BSTORE_SIGNING_KEY"); key != "" {
+		return key
+	}
+	return os.Getenv("BSTORE_READ_WRITE_KEY")
+}
+
+func is_presigned(c *gin.Context) bool {
+	return c.Query(sigSignature) != ""
+}
+
+// verify_presigned checks a presigned request and, when it is valid, sets X-Access to the
+// signed tier so handlers resolve the same base path the URL was minted for.
+func verify_presigned(c *gin.Context, key string) error {
+	q := c.Request.URL.Query()
+	method := q.Get(sigMethod)
+	access := q.Get(sigAccess)
+	ip := q.Get(sigIP)
+
+	expires, err := strconv.ParseInt(q.Get(sigExpires), 10, 64)
+	if err != nil {
+		return errors.New("Invalid presigned URL")
+	}
+
+	expected := sign_url(key, method, c.Request.URL.Path, access, ip, expires)
+	if !hmac.Equal([]byte(expected), []byte(q.Get(sigSignature))) {
+		return errors.New("Invalid presigned URL signature")
+	}
+
+	if time.Now().Unix() > expires {
+		return errors.New("Presigned URL expired")
+	}
+
+	if c.Request.Method != method && !(method == http.MethodGet && c.Request.Method == http.MethodHead) {
+		return errors.New("Presigned URL not valid for " + c.Request.Method)
+	}
+
+	if ip != "" && ip != c.ClientIP() {
+		return errors.New("Presigned URL not valid for this address")
+	}
+
+	c.Request.Header.Set("X-Access", access)
+	return nil
+}
+
+func sign_url(key, method, path, access, ip string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%d", method, path, access, ip, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func presign_op(method string) string {
+	if strings.ToUpper(method) == http.MethodPut {
+		return OpUpload
+	}
+	return OpDownload
+}
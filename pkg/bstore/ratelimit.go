@@ -0,0 +1,172 @@
+package bstore
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RouteDefault = "default"
+	RouteUpload  = "upload"
+	RouteServe   = "serve"
+)
+
+// RateLimiter keeps one token bucket per key. Buckets hold up to MaxRequests tokens and refill
+// at MaxRequests per Duration, the least recently used bucket is evicted once capacity is reached.
+type RateLimiter struct {
+	buckets  map[string]*list.Element
+	order    *list.List
+	capacity int
+	mu       sync.Mutex
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int64
+	Remaining  int64
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+func NewRateLimiter(capacity int) *RateLimiter {
+	return &RateLimiter{
+		buckets:  make(map[string]*list.Element),
+		order:    list.New(),
+		capacity: capacity,
+	}
+}
+
+func (rl *RateLimiter) Allow(key string, rule RateLimitRule, now time.Time) RateLimitResult {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	limit := float64(rule.MaxRequests)
+	rate := limit / float64(rule.Duration) // tokens per second
+
+	var b *bucket
+	if elem, exists := rl.buckets[key]; exists {
+		b = elem.Value.(*bucket)
+		b.tokens = math.Min(limit, b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+		rl.order.MoveToFront(elem)
+	} else {
+		if len(rl.buckets) >= rl.capacity {
+			oldest := rl.order.Back()
+			if oldest != nil {
+				delete(rl.buckets, oldest.Value.(*bucket).key)
+				rl.order.Remove(oldest)
+			}
+		}
+		b = &bucket{key: key, tokens: limit, last: now}
+		rl.buckets[key] = rl.order.PushFront(b)
+	}
+
+	ret := RateLimitResult{Limit: rule.MaxRequests}
+	if b.tokens >= 1 {
+		b.tokens--
+		ret.Allowed = true
+	} else {
+		ret.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+
+	ret.Remaining = int64(b.tokens)
+	ret.Reset = seconds((limit - b.tokens) / rate)
+	return ret
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s)) * time.Second
+}
+
+// Rule returns the limit for a route class, classes without their own limit use the global one.
+func (cfg *RateLimitConfig) Rule(route string) RateLimitRule {
+	rule := RateLimitRule{MaxRequests: cfg.MaxRequests, Duration: cfg.Duration}
+	switch route {
+	case RouteUpload:
+		if cfg.Upload.MaxRequests > 0 {
+			rule = cfg.Upload
+		}
+	case RouteServe:
+		if cfg.Serve.MaxRequests > 0 {
+			rule = cfg.Serve
+		}
+	}
+	return rule
+}
+
+func route_class(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/api/upload/"), strings.HasPrefix(path, "/api/multipart/"), strings.HasPrefix(path, "/api/tus/"):
+		return RouteUpload
+	case strings.HasPrefix(path, "/api/download/"), strings.HasPrefix(path, "/bstore"), strings.HasPrefix(path, "/stream"):
+		return RouteServe
+	default:
+		return RouteDefault
+	}
+}
+
+// checkIPRateLimit limits every request per client IP. It runs before validateReadWriteKey
+// so requests that fail authentication are limited too and keys cannot be guessed at full speed.
+func checkIPRateLimit(rl *RateLimiter, cfg RateLimitConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := route_class(c.Request.URL.Path)
+		if !rate_limit(c, rl, route+":ip:"+c.ClientIP(), cfg.Rule(route)) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkTokenRateLimit additionally limits authenticated token requests per token, with the
+// token's own limit when it has one. It has to run after validateReadWriteKey so the token is known.
+func checkTokenRateLimit(rl *RateLimiter, cfg RateLimitConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t, exists := c.Get(tokenKey)
+		if !exists {
+			c.Next()
+			return
+		}
+
+		token := t.(*Token)
+		route := route_class(c.Request.URL.Path)
+		rule := cfg.Rule(route)
+		if token.RateLimit.MaxRequests > 0 && token.RateLimit.Duration > 0 {
+			rule = token.RateLimit
+		}
+
+		if !rate_limit(c, rl, route+":token:"+token.Name, rule) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// rate_limit takes a token from the bucket of key and sets the rate limit headers,
+// answering 429 and returning false when the bucket is empty.
+func rate_limit(c *gin.Context, rl *RateLimiter, key string, rule RateLimitRule) bool {
+	res := rl.Allow(key, rule, time.Now())
+	c.Header("X-RateLimit-Limit", strconv.FormatInt(res.Limit, 10))
+	c.Header("X-RateLimit-Remaining", strconv.FormatInt(res.Remaining, 10))
+	c.Header("X-RateLimit-Reset", strconv.FormatInt(int64(res.Reset.Seconds()), 10))
+
+	if !res.Allowed {
+		c.Header("Retry-After", strconv.FormatInt(int64(res.RetryAfter.Seconds()), 10))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+		c.Abort()
+		return false
+	}
+	return true
+}
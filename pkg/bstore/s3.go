@@ -0,0 +1,436 @@
+package bstore
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cartersusi/bstore/pkg/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// The two access tiers are exposed as buckets, path-style: `<prefix>/<bucket>/<key>`.
+const (
+	S3PublicBucket  = "public"
+	S3PrivateBucket = "private"
+	S3DefaultPrefix = "/s3"
+	S3DefaultRegion = "us-east-1"
+
+	s3Namespace      = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat     = "2006-01-02T15:04:05.000Z"
+	s3MetaPrefix     = "X-Amz-Meta-"
+	s3DefaultMaxKeys = 1000
+)
+
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3ListBucketsResponse struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListObjectsResponse struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3LocationResponse struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:",chardata"`
+}
+
+// GetS3Keys returns the single access key pair S3 clients sign requests with.
+func GetS3Keys() (string, string) {
+	return os.Getenv("BSTORE_S3_ACCESS_KEY"), os.Getenv("BSTORE_S3_SECRET_KEY")
+}
+
+// S3Api serves a subset of the S3 API: ListBuckets, HeadBucket, GetBucketLocation,
+// ListObjectsV2, PutObject, GetObject, HeadObject and DeleteObject. Objects go through
+// the same compression/encryption pipeline as `/api/upload`, so both APIs see the same files.
+func (bstore *ServerCfg) S3Api(c *gin.Context) {
+	log.Println("Valid S3 Request for", c.Request.Method, c.Request.URL.Path)
+
+	access_key, secret_key := GetS3Keys()
+	sig, err := verify_sigv4(c.Request, access_key, secret_key, bstore.S3.Region)
+	if err != nil {
+		s3_handle_error(c, err)
+		return
+	}
+
+	bucket, raw_key, _ := strings.Cut(strings.TrimPrefix(c.Param("s3_path"), "/"), "/")
+	if bucket == "" {
+		if c.Request.Method != http.MethodGet {
+			s3_error(c, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource")
+			return
+		}
+		bstore.s3_list_buckets(c)
+		return
+	}
+
+	backend := bstore.s3_backend(bucket)
+	if backend == nil {
+		s3_error(c, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	if raw_key == "" {
+		switch c.Request.Method {
+		case http.MethodHead:
+			c.Status(http.StatusOK)
+		case http.MethodGet:
+			if _, ok := c.GetQuery("location"); ok {
+				c.XML(http.StatusOK, &s3LocationResponse{Xmlns: s3Namespace, Location: bstore.S3.Region})
+				return
+			}
+			if c.Query("list-type") != "2" {
+				s3_error(c, http.StatusNotImplemented, "NotImplemented", "Only ListObjectsV2 (list-type=2) is supported")
+				return
+			}
+			bstore.s3_list_objects(c, bucket, backend)
+		default:
+			s3_error(c, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource")
+		}
+		return
+	}
+
+	key, err := CleanKey(raw_key, bstore.MaxFileNameLen)
+	if err != nil {
+		s3_handle_error(c, err)
+		return
+	}
+
+	switch c.Request.Method {
+	case http.MethodPut:
+		bstore.s3_put_object(c, sig, backend, key)
+	case http.MethodGet, http.MethodHead:
+		bstore.s3_get_object(c, backend, key)
+	case http.MethodDelete:
+		bstore.s3_delete_object(c, backend, key)
+	default:
+		s3_error(c, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource")
+	}
+}
+
+func (bstore *ServerCfg) s3_backend(bucket string) storage.Backend {
+	switch bucket {
+	case S3PublicBucket:
+		return bstore.Public
+	case S3PrivateBucket:
+		return bstore.Private
+	}
+	return nil
+}
+
+func (bstore *ServerCfg) s3_list_buckets(c *gin.Context) {
+	created := time.Now().UTC().Format(s3TimeFormat)
+	c.XML(http.StatusOK, &s3ListBucketsResponse{
+		Xmlns: s3Namespace,
+		Owner: s3Owner{ID: "bstore", DisplayName: "bstore"},
+		Buckets: []s3Bucket{
+			{Name: S3PrivateBucket, CreationDate: created},
+			{Name: S3PublicBucket, CreationDate: created},
+		},
+	})
+}
+
+func (bstore *ServerCfg) s3_put_object(c *gin.Context, sig *sigv4, backend storage.Backend, key string) {
+	if c.GetHeader("X-Amz-Copy-Source") != "" {
+		s3_error(c, http.StatusNotImplemented, "NotImplemented", "CopyObject is not supported")
+		return
+	}
+
+	size := c.Request.ContentLength
+	if decoded := c.GetHeader("X-Amz-Decoded-Content-Length"); decoded != "" {
+		size, _ = strconv.ParseInt(decoded, 10, 64)
+	}
+	if size > bstore.MaxFileSize {
+		s3_error(c, http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size")
+		return
+	}
+
+	body, err := sig.body(c.Request.Body)
+	if err != nil {
+		s3_handle_error(c, err)
+		return
+	}
+
+	if content_md5 := c.GetHeader("Content-MD5"); content_md5 != "" {
+		want, err := base64.StdEncoding.DecodeString(content_md5)
+		if err != nil || len(want) != md5.Size {
+			s3_error(c, http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified is not valid")
+			return
+		}
+		body = verify_reader(body, md5.New(), want, "BadDigest")
+	}
+
+	// aws-chunked bodies are larger than the object, limit what is decoded instead
+	body = http.MaxBytesReader(c.Writer, io.NopCloser(body), bstore.MaxFileSize)
+
+	meta := bstore.new_meta(c, key)
+	for name, values := range c.Request.Header {
+		if len(name) > len(s3MetaPrefix) && strings.EqualFold(name[:len(s3MetaPrefix)], s3MetaPrefix) {
+			meta.UserMeta[strings.ToLower(name[len(s3MetaPrefix):])] = strings.Join(values, ", ")
+		}
+	}
+
+	log.Println("Creating S3 object at", key)
+	if err = bstore.write_object(backend, key, body, meta); err != nil {
+		var max_err *http.MaxBytesError
+		if errors.As(err, &max_err) {
+			s3_error(c, http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size")
+			return
+		}
+		s3_handle_error(c, err)
+		return
+	}
+
+	c.Header("ETag", `"`+meta.SHA256+`"`)
+	c.Status(http.StatusOK)
+}
+
+func (bstore *ServerCfg) s3_get_object(c *gin.Context, backend storage.Backend, key string) {
+	obj, err := bstore.find_object(backend, key)
+	if err != nil {
+		s3_error(c, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+
+	r, err := obj.open()
+	if err != nil {
+		s3_handle_error(c, err)
+		return
+	}
+	defer r.Close()
+
+	c.Header("Accept-Ranges", "bytes")
+	refuse_ranges(c, r)
+	c.Header("ETag", make_etag(obj))
+	c.Header("Content-Type", "application/octet-stream")
+	if obj.Meta != nil {
+		c.Header("Content-Type", obj.Meta.ContentType)
+		for k, v := range obj.Meta.UserMeta {
+			c.Header(s3MetaPrefix+k, v)
+		}
+	}
+	http.ServeContent(c.Writer, c.Request, obj.Name(), obj.Info.ModTime, r)
+}
+
+// s3_delete_object succeeds for missing keys, like S3 does.
+func (bstore *ServerCfg) s3_delete_object(c *gin.Context, backend storage.Backend, key string) {
+	obj, err := bstore.find_object(backend, key)
+	if err == nil {
+		if err = backend.Delete(obj.Key); err != nil && !errors.Is(err, storage.ErrNotExist) {
+			s3_handle_error(c, err)
+			return
+		}
+		RemoveMeta(backend, key)
+		bstore.remove_derivatives(backend, key)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (bstore *ServerCfg) s3_list_objects(c *gin.Context, bucket string, backend storage.Backend) {
+	prefix, err := CleanPrefix(c.Query("prefix"), bstore.MaxFileNameLen)
+	if err != nil {
+		s3_error(c, http.StatusBadRequest, "InvalidArgument", err.(*KeyError).Message)
+		return
+	}
+	delimiter := c.Query("delimiter")
+	start_after := c.Query("start-after")
+
+	max_keys := s3DefaultMaxKeys
+	if s := c.Query("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			s3_error(c, http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer")
+			return
+		}
+		max_keys = min(n, s3DefaultMaxKeys)
+	}
+
+	continuation := c.Query("continuation-token")
+	marker := start_after
+	if continuation != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(continuation)
+		if err != nil {
+			s3_error(c, http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect")
+			return
+		}
+		marker = string(decoded)
+	}
+
+	// backends list directories, so list the one holding prefix and filter below it
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i]
+	}
+	infos, err := backend.List(dir)
+	if err != nil && !errors.Is(err, storage.ErrNotExist) && !errors.Is(err, storage.ErrNotDir) {
+		s3_handle_error(c, err)
+		return
+	}
+
+	by_key := make(map[string]storage.Info)
+	var keys []string
+	for _, info := range infos {
+		if strings.HasSuffix(info.Key, MetaExt) || is_staging(info.Key) {
+			continue
+		}
+		k := strings.TrimSuffix(info.Key, ".zst")
+		if strings.HasPrefix(k, prefix) && k > marker {
+			by_key[k] = info
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	list_response := &s3ListObjectsResponse{
+		Xmlns:             s3Namespace,
+		Name:              bucket,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		StartAfter:        start_after,
+		MaxKeys:           max_keys,
+		ContinuationToken: continuation,
+	}
+
+	seen_prefixes := make(map[string]bool)
+	last := ""
+	for _, k := range keys {
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				common := k[:len(prefix)+i+len(delimiter)]
+				if seen_prefixes[common] {
+					continue
+				}
+				if list_response.KeyCount == max_keys {
+					list_response.IsTruncated = true
+					break
+				}
+				seen_prefixes[common] = true
+				list_response.CommonPrefixes = append(list_response.CommonPrefixes, s3CommonPrefix{Prefix: common})
+				list_response.KeyCount++
+				// everything under the common prefix sorts before this, resume after all of it
+				last = common + "\xff"
+				continue
+			}
+		}
+
+		if list_response.KeyCount == max_keys {
+			list_response.IsTruncated = true
+			break
+		}
+
+		info := by_key[k]
+		obj := &object{Key: info.Key, Info: info}
+		size := info.Size
+		if meta, err := ReadMeta(backend, info.Key); err == nil {
+			obj.Meta = meta
+			size = meta.Size
+		}
+
+		list_response.Contents = append(list_response.Contents, s3Object{
+			Key:          k,
+			LastModified: info.ModTime.UTC().Format(s3TimeFormat),
+			ETag:         make_etag(obj),
+			Size:         size,
+			StorageClass: "STANDARD",
+		})
+		list_response.KeyCount++
+		last = k
+	}
+
+	if list_response.IsTruncated {
+		list_response.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+
+	c.XML(http.StatusOK, list_response)
+}
+
+func s3_error(c *gin.Context, status int, code, message string) {
+	log.Printf("S3 Error: %s: %s\n", code, message)
+	if c.Request.Method == http.MethodHead {
+		c.Status(status)
+	} else {
+		c.XML(status, &s3ErrorResponse{Code: code, Message: message, Resource: c.Request.URL.Path})
+	}
+	c.Abort()
+}
+
+// s3_handle_error maps signature, key and storage errors onto S3 error codes.
+func s3_handle_error(c *gin.Context, err error) {
+	if auth, ok := is_auth_err(err); ok {
+		status := http.StatusForbidden
+		switch auth.Code {
+		case "InvalidRequest", "InvalidArgument", "AuthorizationHeaderMalformed", "AuthorizationQueryParametersError",
+			"IncompleteBody", "XAmzContentSHA256Mismatch", "BadDigest":
+			status = http.StatusBadRequest
+		}
+		s3_error(c, status, auth.Code, auth.Message)
+		return
+	}
+
+	var key_err *KeyError
+	if errors.As(err, &key_err) {
+		code := "InvalidArgument"
+		if key_err.Reason == "name_too_long" {
+			code = "KeyTooLongError"
+		}
+		s3_error(c, http.StatusBadRequest, code, key_err.Message)
+		return
+	}
+
+	log.Printf("Error: %v\n", err)
+	s3_error(c, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+}
@@ -0,0 +1,120 @@
+package bstore
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cartersusi/bstore/pkg/storage"
+	"github.com/gin-gonic/gin"
+)
+
+func s3_server(t *testing.T) *gin.Engine {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	t.Setenv("BSTORE_S3_ACCESS_KEY", "access")
+	t.Setenv("BSTORE_S3_SECRET_KEY", "secret")
+
+	cfg := &ServerCfg{
+		MaxFileNameLen: 255,
+		MaxFileSize:    1 << 20,
+		Public:         storage.NewMemory(),
+		Private:        storage.NewMemory(),
+	}
+	cfg.S3.Region = "us-east-1"
+
+	r := gin.New()
+	r.Any("/s3/*s3_path", cfg.S3Api)
+	return r
+}
+
+// s3_do signs a request with SigV4 the way S3 clients do and serves it.
+func s3_do(r *gin.Engine, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	now := time.Now().UTC()
+	amz_date := now.Format(sigV4TimeFormat)
+	payload_hash := sha256_hex([]byte(body))
+	req.Header.Set("X-Amz-Date", amz_date)
+	req.Header.Set("X-Amz-Content-Sha256", payload_hash)
+
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	signed_headers := strings.Join(headers, ";")
+	canonical_request := strings.Join([]string{
+		method,
+		aws_uri_encode(req.URL.Path, false),
+		canonical_query(req.URL.Query()),
+		canonical_headers(req, headers),
+		signed_headers,
+		payload_hash,
+	}, "\n")
+
+	scope := now.Format("20060102") + "/us-east-1/s3/aws4_request"
+	key := signing_key("secret", now.Format("20060102"), "us-east-1")
+	signature := hex.EncodeToString(hmac_sha256(key, string_to_sign(amz_date, scope, sha256_hex([]byte(canonical_request)))))
+	req.Header.Set("Authorization", sigV4Algorithm+" Credential=access/"+scope+", SignedHeaders="+signed_headers+", Signature="+signature)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func s3_error_code(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	var resp struct {
+		Code string `xml:"Code"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("error response %q: %v", w.Body, err)
+	}
+	return resp.Code
+}
+
+func TestS3ListPrefix(t *testing.T) {
+	r := s3_server(t)
+	for _, key := range []string{"photos/cat.jpg", "photos/dog.jpg", "notes.txt"} {
+		if w := s3_do(r, http.MethodPut, "/s3/private/"+key, "data"); w.Code != http.StatusOK {
+			t.Fatalf("put %s = %d: %s", key, w.Code, w.Body)
+		}
+	}
+
+	valid := map[string]int{
+		"":           3,
+		"photos/":    2,
+		"photos/c":   1,
+		"photos":     2,
+		"photos/.":   0,
+		"photos/..c": 0,
+	}
+	for prefix, want := range valid {
+		w := s3_do(r, http.MethodGet, "/s3/private?list-type=2&prefix="+prefix, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("list prefix %q = %d: %s", prefix, w.Code, w.Body)
+		}
+		if got := strings.Count(w.Body.String(), "<Contents>"); got != want {
+			t.Fatalf("list prefix %q found %d objects, want %d", prefix, got, want)
+		}
+	}
+
+	invalid := []string{"../", "photos/../", "./photos", "/photos", "photos//c", ".multipart/", "photos%5Cc", "photos%00", "photos%01", "ph*", "%ff"}
+	for _, prefix := range invalid {
+		w := s3_do(r, http.MethodGet, "/s3/private?list-type=2&prefix="+prefix, "")
+		if w.Code != http.StatusBadRequest || s3_error_code(t, w) != "InvalidArgument" {
+			t.Fatalf("list prefix %q = %d %s, want 400 InvalidArgument", prefix, w.Code, w.Body)
+		}
+	}
+}
+
+func TestS3PutRefusesStaging(t *testing.T) {
+	r := s3_server(t)
+
+	w := s3_do(r, http.MethodPut, "/s3/private/.multipart/0123456789abcdef0123456789abcdef/session.json", "{}")
+	if w.Code != http.StatusBadRequest || s3_error_code(t, w) != "InvalidArgument" {
+		t.Fatalf("put into the staging directory = %d %s, want 400 InvalidArgument", w.Code, w.Body)
+	}
+}
@@ -1,70 +1,95 @@
 package bstore
 
 import (
+	"bytes"
+	"io"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
 
-	"github.com/cartersusi/bstore/pkg/fops"
+	"github.com/cartersusi/bstore/pkg/imaging"
 	"github.com/gin-gonic/gin"
 )
 
+const MaxCacheItemSize = 4 << 20
+
 func (bstore *ServerCfg) Serve() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// no rw priv needed for public files
-		log.Println("Valid Serve Request for", c.Request.URL.Path)
-		path := strings.Replace(c.Request.URL.Path, "bstore", bstore.PublicBasePath, 1)
-
-		if !strings.HasPrefix(path, "/"+bstore.PublicBasePath) {
+		if !strings.HasPrefix(c.Request.URL.Path, "/bstore/") {
 			c.Next()
 			return
 		}
+		log.Println("Valid Serve Request for", c.Request.URL.Path)
 
-		fpath := filepath.Join(bstore.PublicBasePath, strings.TrimPrefix(path, "/"+bstore.PublicBasePath))
-		isCompressed := true
-
-		info, err := os.Stat(fpath)
-		if err == nil {
-			if !info.IsDir() {
-				isCompressed = false
-			}
-		}
-
-		cached_content, ok := check_OR_get(c, fpath)
-		if ok {
-			contentType := http.DetectContentType(cached_content)
-			c.Header("Content-Type", contentType)
-			c.Data(http.StatusOK, contentType, cached_content)
+		key, err := CleanKey(strings.TrimPrefix(c.Request.URL.Path, "/bstore"), bstore.MaxFileNameLen)
+		if err != nil {
+			HandleError(c, NewError(http.StatusBadRequest, err.Error(), err))
 			return
 		}
 
-		if isCompressed {
-			fpath = fpath + ".zst"
+		obj, err := bstore.find_object(bstore.Public, key)
+		if err != nil {
+			HandleError(c, NewError(http.StatusNotFound, "File not found", err))
+			return
 		}
 
-		if isCompressed {
-			content, err := fops.Decompress(fpath, bstore.Encrypt)
+		if bstore.Images.Enabled {
+			opts, ok, err := imaging.ParseOptions(c.Request.URL.Query())
 			if err != nil {
-				HandleError(c, NewError(http.StatusInternalServerError, "Error decompressing file", err))
+				HandleError(c, NewError(http.StatusBadRequest, err.Error(), err))
 				return
 			}
-			set_cache(c, strings.TrimSuffix(fpath, ".zst"), content)
-
-			contentType := http.DetectContentType(content)
-			c.Header("Content-Type", contentType)
-			c.Data(http.StatusOK, contentType, content)
-		} else {
-			file, err := os.Open(fpath)
-			if err != nil {
-				HandleError(c, NewError(http.StatusNotFound, "File not found", err))
+			if ok {
+				bstore.serve_image(c, obj, key, opts)
 				return
 			}
-			defer file.Close()
-			http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), file)
 		}
+
+		serve_cached(c, obj, key)
+	}
+}
+
+// serve_cached serves obj from the cache when it is there, adding it if it is small enough.
+func serve_cached(c *gin.Context, obj *object, key string) {
+	// keyed by checksum/mtime so a rewritten object is never served from a stale entry
+	cache_key := key + make_etag(obj)
+	cached_content, ok := check_OR_get(c, cache_key)
+	if ok {
+		serve_content(c, obj, bytes.NewReader(cached_content))
+		return
+	}
+
+	r, err := obj.open()
+	if err != nil {
+		HandleError(c, NewError(http.StatusInternalServerError, "Error reading file", err))
+		return
+	}
+	defer r.Close()
+
+	if GetCache(c) == nil || c.Request.Method == http.MethodHead {
+		serve_content(c, obj, r)
+		return
+	}
+
+	// only small objects are kept in memory for the cache, larger ones are streamed
+	head, err := io.ReadAll(io.LimitReader(r, MaxCacheItemSize+1))
+	if err != nil {
+		HandleError(c, NewError(http.StatusInternalServerError, "Error reading file", err))
+		return
+	}
+
+	if len(head) <= MaxCacheItemSize {
+		set_cache(c, cache_key, head)
+		serve_content(c, obj, bytes.NewReader(head))
+		return
+	}
+
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		HandleError(c, NewError(http.StatusInternalServerError, "Error reading file", err))
+		return
 	}
+	serve_content(c, obj, r)
 }
 
 func check_OR_get(c *gin.Context, key string) ([]byte, bool) {
@@ -0,0 +1,356 @@
+package bstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm   = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat  = "20060102T150405Z"
+	sigV4MaxSkew     = 15 * time.Minute
+	sigV4MaxExpires  = 7 * 24 * time.Hour
+	s3MaxChunkSize   = 16 << 20
+	emptySHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	streamingSigned  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingSignedT = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignT = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// s3AuthError is returned for requests that fail SigV4 verification, Code is the S3 error code.
+type s3AuthError struct {
+	Code    string
+	Message string
+}
+
+func (e *s3AuthError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func auth_err(code, message string) error {
+	return &s3AuthError{Code: code, Message: message}
+}
+
+// sigv4 is a verified request signature. It is kept around to check the signatures of
+// `aws-chunked` payload chunks, which chain from the seed signature of the request.
+type sigv4 struct {
+	amz_date     string
+	scope        string
+	key          []byte
+	signature    string
+	payload_hash string
+}
+
+// verify_sigv4 authenticates r with either an `Authorization: AWS4-HMAC-SHA256` header or
+// presigned `X-Amz-*` query parameters, against a single access key pair.
+func verify_sigv4(r *http.Request, access_key, secret_key, region string) (*sigv4, error) {
+	if access_key == "" || secret_key == "" {
+		return nil, auth_err("AccessDenied", "S3 credentials are not configured")
+	}
+
+	q := r.URL.Query()
+	var (
+		credential, signed_headers, signature, amz_date, payload_hash string
+		presigned                                                     bool
+	)
+
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, sigV4Algorithm+" ") {
+			return nil, auth_err("AccessDenied", "Only AWS4-HMAC-SHA256 signatures are supported")
+		}
+		for _, field := range strings.Split(strings.TrimPrefix(auth, sigV4Algorithm+" "), ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch k {
+			case "Credential":
+				credential = v
+			case "SignedHeaders":
+				signed_headers = v
+			case "Signature":
+				signature = v
+			}
+		}
+
+		amz_date = r.Header.Get("X-Amz-Date")
+		payload_hash = r.Header.Get("X-Amz-Content-Sha256")
+		if payload_hash == "" {
+			return nil, auth_err("InvalidRequest", "Missing x-amz-content-sha256 header")
+		}
+	} else if q.Get("X-Amz-Algorithm") != "" {
+		if q.Get("X-Amz-Algorithm") != sigV4Algorithm {
+			return nil, auth_err("AccessDenied", "Only AWS4-HMAC-SHA256 signatures are supported")
+		}
+		presigned = true
+		credential = q.Get("X-Amz-Credential")
+		signed_headers = q.Get("X-Amz-SignedHeaders")
+		signature = q.Get("X-Amz-Signature")
+		amz_date = q.Get("X-Amz-Date")
+		payload_hash = unsignedPayload
+	} else {
+		return nil, auth_err("AccessDenied", "Anonymous requests are not allowed")
+	}
+
+	if credential == "" || signed_headers == "" || signature == "" {
+		return nil, auth_err("AuthorizationHeaderMalformed", "Credential, SignedHeaders and Signature are required")
+	}
+
+	// Credential=<access key>/<yyyymmdd>/<region>/s3/aws4_request
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" {
+		return nil, auth_err("AuthorizationHeaderMalformed", "Malformed credential scope")
+	}
+	if !secure_compare(parts[0], access_key) {
+		return nil, auth_err("InvalidAccessKeyId", "The access key does not exist")
+	}
+	if parts[2] != region {
+		return nil, auth_err("AuthorizationHeaderMalformed", fmt.Sprintf("Region must be `%s`", region))
+	}
+
+	t, err := time.Parse(sigV4TimeFormat, amz_date)
+	if err != nil || t.Format("20060102") != parts[1] {
+		return nil, auth_err("AccessDenied", "Missing or invalid X-Amz-Date")
+	}
+
+	now := time.Now()
+	if presigned {
+		seconds, err := strconv.ParseInt(q.Get("X-Amz-Expires"), 10, 64)
+		if err != nil || seconds < 1 || time.Duration(seconds)*time.Second > sigV4MaxExpires {
+			return nil, auth_err("AuthorizationQueryParametersError", "X-Amz-Expires must be between 1 and 604800")
+		}
+		if now.After(t.Add(time.Duration(seconds) * time.Second)) {
+			return nil, auth_err("AccessDenied", "Request has expired")
+		}
+	} else if now.Sub(t) > sigV4MaxSkew || t.Sub(now) > sigV4MaxSkew {
+		return nil, auth_err("RequestTimeTooSkewed", "The difference between the request time and the server's time is too large")
+	}
+
+	headers := strings.Split(signed_headers, ";")
+	if !contains(headers, "host") {
+		return nil, auth_err("AccessDenied", "The host header must be signed")
+	}
+
+	canonical_request := strings.Join([]string{
+		r.Method,
+		aws_uri_encode(r.URL.Path, false),
+		canonical_query(q),
+		canonical_headers(r, headers),
+		signed_headers,
+		payload_hash,
+	}, "\n")
+
+	scope := strings.Join(parts[1:], "/")
+	key := signing_key(secret_key, parts[1], region)
+	expected := hex.EncodeToString(hmac_sha256(key, string_to_sign(amz_date, scope, sha256_hex([]byte(canonical_request)))))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, auth_err("SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided")
+	}
+
+	return &sigv4{
+		amz_date:     amz_date,
+		scope:        scope,
+		key:          key,
+		signature:    signature,
+		payload_hash: payload_hash,
+	}, nil
+}
+
+// body returns the request payload, decoding `aws-chunked` bodies and checking the
+// payload hash or chunk signatures the client committed to. A mismatch surfaces as an
+// error from Read at the end of the body, before the object is stored.
+func (sig *sigv4) body(r io.Reader) (io.Reader, error) {
+	switch sig.payload_hash {
+	case unsignedPayload:
+		return r, nil
+	case streamingSigned, streamingSignedT:
+		return &chunk_reader{r: bufio.NewReader(r), sig: sig, prev: sig.signature}, nil
+	case streamingUnsignT:
+		return &chunk_reader{r: bufio.NewReader(r)}, nil
+	}
+
+	want, err := hex.DecodeString(sig.payload_hash)
+	if err != nil || len(want) != sha256.Size {
+		return nil, auth_err("InvalidArgument", "Invalid x-amz-content-sha256 header")
+	}
+	return verify_reader(r, sha256.New(), want, "XAmzContentSHA256Mismatch"), nil
+}
+
+// chunk_reader decodes an `aws-chunked` payload: `<hex size>[;chunk-signature=<sig>]\r\n<data>\r\n`
+// repeated, ending with a zero sized chunk and optional trailers, which are not checked.
+type chunk_reader struct {
+	r    *bufio.Reader
+	sig  *sigv4
+	prev string
+	buf  []byte
+	done bool
+}
+
+func (cr *chunk_reader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+func (cr *chunk_reader) next() error {
+	line, err := cr.r.ReadString('\n')
+	if err != nil {
+		return auth_err("IncompleteBody", "Truncated aws-chunked body")
+	}
+
+	size_hex, ext, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+	size, err := strconv.ParseInt(size_hex, 16, 64)
+	if err != nil || size < 0 || size > s3MaxChunkSize {
+		return auth_err("InvalidRequest", "Invalid aws-chunked chunk size")
+	}
+
+	data := make([]byte, size)
+	if _, err = io.ReadFull(cr.r, data); err != nil {
+		return auth_err("IncompleteBody", "Truncated aws-chunked body")
+	}
+	if size > 0 {
+		crlf := make([]byte, 2)
+		if _, err = io.ReadFull(cr.r, crlf); err != nil || string(crlf) != "\r\n" {
+			return auth_err("IncompleteBody", "Malformed aws-chunked body")
+		}
+	}
+
+	if cr.sig != nil {
+		signature := strings.TrimPrefix(ext, "chunk-signature=")
+		chunk_hash := sha256_hex(data)
+		expected := hex.EncodeToString(hmac_sha256(cr.sig.key, strings.Join([]string{
+			sigV4Algorithm + "-PAYLOAD",
+			cr.sig.amz_date,
+			cr.sig.scope,
+			cr.prev,
+			emptySHA256,
+			chunk_hash,
+		}, "\n")))
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			return auth_err("SignatureDoesNotMatch", "Chunk signature does not match")
+		}
+		cr.prev = signature
+	}
+
+	cr.buf = data
+	cr.done = size == 0
+	return nil
+}
+
+type hash_reader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+	code string
+}
+
+// verify_reader hashes everything read from r and fails the final read if the sum is not want.
+func verify_reader(r io.Reader, h hash.Hash, want []byte, code string) io.Reader {
+	return &hash_reader{r: r, h: h, want: want, code: code}
+}
+
+func (hr *hash_reader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(hr.h.Sum(nil), hr.want) {
+		return n, auth_err(hr.code, "The provided digest does not match the uploaded content")
+	}
+	return n, err
+}
+
+func signing_key(secret, date, region string) []byte {
+	key := hmac_sha256([]byte("AWS4"+secret), date)
+	key = hmac_sha256(key, region)
+	key = hmac_sha256(key, "s3")
+	return hmac_sha256(key, "aws4_request")
+}
+
+func string_to_sign(amz_date, scope, request_hash string) string {
+	return strings.Join([]string{sigV4Algorithm, amz_date, scope, request_hash}, "\n")
+}
+
+func canonical_query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		if k != "X-Amz-Signature" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, aws_uri_encode(k, true)+"="+aws_uri_encode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func canonical_headers(r *http.Request, names []string) string {
+	var b strings.Builder
+	for _, name := range names {
+		value := ""
+		if name == "host" {
+			value = r.Host
+		} else {
+			value = strings.Join(r.Header.Values(name), ",")
+		}
+		b.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	return b.String()
+}
+
+// aws_uri_encode percent-encodes everything but unreserved characters, and `/` unless encode_slash.
+func aws_uri_encode(s string, encode_slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || (ch == '/' && !encode_slash) {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func hmac_sha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256_hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func is_auth_err(err error) (*s3AuthError, bool) {
+	var auth *s3AuthError
+	ok := errors.As(err, &auth)
+	return auth, ok
+}
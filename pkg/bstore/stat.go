@@ -0,0 +1,84 @@
+package bstore
+
+import (
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type StatResponse struct {
+	Exists      bool        `json:"exists"`
+	Size        int64       `json:"size"`
+	StoredSize  int64       `json:"stored_size"`
+	ModTime     time.Time   `json:"mod_time"`
+	ContentType string      `json:"content_type"`
+	Compressed  bool        `json:"compressed"`
+	Encrypted   bool        `json:"encrypted"`
+	Metadata    *ObjectMeta `json:"metadata,omitempty"`
+	Message     string      `json:"message"`
+}
+
+func (bstore *ServerCfg) Stat(c *gin.Context) {
+	log.Println("Valid Stat Request for", c.Request.URL.Path)
+	validation := bstore.ValidateReq(c)
+	if validation.Err != nil {
+		HandleError(c, NewError(validation.HttpStatus, validation.Err.Error(), validation.Err))
+		return
+	}
+
+	obj, err := bstore.find_object(validation.Backend, validation.Fpath)
+	if err != nil {
+		c.JSON(http.StatusNotFound, &StatResponse{Message: "File not found"})
+		return
+	}
+
+	stat_response, err := stat_object(obj)
+	if err != nil {
+		HandleError(c, NewError(http.StatusInternalServerError, "Error reading file", err))
+		return
+	}
+
+	stat_response.Message = "File found at " + validation.Fpath
+	c.JSON(http.StatusOK, stat_response)
+}
+
+func stat_object(obj *object) (*StatResponse, error) {
+	ret := &StatResponse{
+		Exists:     true,
+		StoredSize: obj.Info.Size,
+		ModTime:    obj.Info.ModTime.UTC(),
+		Compressed: obj.Compressed(),
+		Metadata:   obj.Meta.public(),
+	}
+
+	if obj.Meta != nil {
+		ret.Size = obj.Meta.Size
+		ret.ContentType = obj.Meta.ContentType
+		ret.Encrypted = obj.Meta.Encrypted
+		return ret, nil
+	}
+
+	// files without a sidecar have to be opened to learn their plaintext size
+	r, err := obj.open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	ret.Size, err = r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	ret.Encrypted = r.Encrypted()
+	ret.ContentType = mime.TypeByExtension(path.Ext(obj.Name()))
+	if ret.ContentType == "" {
+		ret.ContentType = "application/octet-stream"
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,137 @@
+package bstore
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cartersusi/bstore/pkg/stream"
+	"github.com/gin-gonic/gin"
+)
+
+const StreamRoute = "/stream"
+
+// DefaultStreamExpiry is how long the stream URLs of a private video handed out with an
+// upload or job last, `/api/presign/<video>?method=STREAM` mints new ones.
+const DefaultStreamExpiry = 24 * time.Hour
+
+// manifests and tracks are rewritten when a video is transcoded again, segments never change under a name
+const (
+	manifestMaxAge = 60
+	segmentMaxAge  = 365 * 24 * 60 * 60
+)
+
+var streamTypes = map[string]string{
+	".mpd":  "application/dash+xml",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".m4s":  "video/mp4",
+	".ts":   "video/mp2t",
+	".jpg":  "image/jpeg",
+	".vtt":  "text/vtt",
+}
+
+// ServeStream serves the output of a transcode: public videos from
+// `/stream/public/<dir>/<video>/<file>`, private ones from
+// `/stream/private/<expires>-<signature>/<dir>/<video>/<file>`. The token signs the
+// stream directory and sits in the path, so the relative segment URLs in the manifests
+// carry it along.
+func (bstore *ServerCfg) ServeStream(c *gin.Context) {
+	log.Println("Valid Stream Request for", c.Request.URL.Path)
+	tier, rest, _ := strings.Cut(strings.TrimPrefix(c.Param("stream_path"), "/"), "/")
+
+	token := ""
+	switch tier {
+	case "public":
+	case "private":
+		token, rest, _ = strings.Cut(rest, "/")
+	default:
+		HandleError(c, NewError(http.StatusNotFound, "File not found", nil))
+		return
+	}
+
+	key, err := CleanKey("/"+rest, bstore.MaxFileNameLen)
+	if err != nil {
+		HandleError(c, NewError(http.StatusBadRequest, err.Error(), err))
+		return
+	}
+
+	content_type, ok := streamTypes[path.Ext(key)]
+	if !ok {
+		HandleError(c, NewError(http.StatusNotFound, "File not found", nil))
+		return
+	}
+
+	if tier == "private" {
+		if err = verify_stream_token(token, path.Dir(key)); err != nil {
+			HandleError(c, NewError(http.StatusForbidden, err.Error(), err))
+			return
+		}
+	}
+
+	obj, err := bstore.find_object(bstore.get_backend(tier), key)
+	if err != nil {
+		HandleError(c, NewError(http.StatusNotFound, "File not found", err))
+		return
+	}
+
+	cache_control := fmt.Sprintf("%s, max-age=%d, immutable", tier, segmentMaxAge)
+	if ext := path.Ext(key); ext == ".mpd" || ext == ".m3u8" || ext == ".vtt" {
+		cache_control = fmt.Sprintf("%s, max-age=%d", tier, manifestMaxAge)
+	}
+
+	c.Header("Content-Type", content_type)
+	c.Header("Cache-Control", cache_control)
+	serve_cached(c, obj, tier+key)
+}
+
+// make_stream_urls returns where the stream of the video or audio file at key is served,
+// signed for expiry when it is private.
+func (bstore *ServerCfg) make_stream_urls(c *gin.Context, key, access string, expiry time.Duration) *StreamResponse {
+	route := stream_route(stream.OutputKey(key), access, expiry)
+
+	urls := &StreamResponse{
+		Hls:    stream.MakeUrl(c, route, key, stream.HLS),
+		Dash:   stream.MakeUrl(c, route, key, stream.DASH),
+		Poster: stream.MakeUrl(c, route, key, stream.POSTER),
+	}
+	if bstore.Streaming.Thumbnails.Enabled && stream.CheckEXT(key) {
+		urls.Thumbnails = stream.MakeUrl(c, route, key, stream.THUMBNAILS)
+	}
+	return urls
+}
+
+// stream_route is what the files of the stream directory dir are served below.
+func stream_route(dir, access string, expiry time.Duration) string {
+	if access == "public" {
+		return StreamRoute + "/public"
+	}
+	return StreamRoute + "/private/" + stream_token(dir, time.Now().Add(expiry).Unix())
+}
+
+// stream_token grants access to every file of the private stream directory dir until expires.
+func stream_token(dir string, expires int64) string {
+	return fmt.Sprintf("%d-%s", expires, sign_url(GetSigningKey(), "STREAM", dir, "private", "", expires))
+}
+
+func verify_stream_token(token, dir string) error {
+	expires_s, _, _ := strings.Cut(token, "-")
+	expires, err := strconv.ParseInt(expires_s, 10, 64)
+	if err != nil {
+		return errors.New("Invalid stream URL")
+	}
+
+	if !hmac.Equal([]byte(stream_token(dir, expires)), []byte(token)) {
+		return errors.New("Invalid stream URL signature")
+	}
+
+	if time.Now().Unix() > expires {
+		return errors.New("Stream URL expired")
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package bstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/cartersusi/bstore/pkg/storage"
+	"github.com/cartersusi/bstore/pkg/stream"
+)
+
+// MaxSubtitleSize bounds the sidecar subtitles read back to be attached to a stream.
+const MaxSubtitleSize = 16 << 20
+
+// ErrNoStream is returned for a sidecar subtitle without a transcoded video next to it,
+// it is attached once that video is transcoded.
+var ErrNoStream = errors.New("No video stream to attach the subtitle to")
+
+// attach_subtitle adds the sidecar subtitle at sub_key to the stream of its video,
+// `/dir/movie.en.srt` to `/dir/movie/` as `sub_en.vtt` with the language `en`, and
+// returns the stream directory and the file name of the track.
+func (bstore *ServerCfg) attach_subtitle(backend storage.Backend, sub_key string) (string, string, error) {
+	stem := strings.TrimSuffix(sub_key, path.Ext(sub_key))
+	dir, lang := stem, ""
+	mpd, master := bstore.find_manifests(backend, dir)
+	if mpd == nil && master == nil {
+		ext := strings.TrimPrefix(path.Ext(stem), ".")
+		if !stream.IsLanguage(ext) {
+			return "", "", ErrNoStream
+		}
+
+		dir, lang = strings.TrimSuffix(stem, path.Ext(stem)), ext
+		mpd, master = bstore.find_manifests(backend, dir)
+		if mpd == nil && master == nil {
+			return "", "", ErrNoStream
+		}
+	}
+
+	data, err := bstore.read_stream_file(backend, sub_key)
+	if err != nil {
+		return "", "", err
+	}
+	vtt := stream.ToVTT(data)
+
+	sub := stream.Subtitle{ID: "sub_default", Language: lang}
+	if lang != "" {
+		sub.ID = "sub_" + strings.ToLower(lang)
+	}
+
+	if err = bstore.put_stream_file(backend, path.Join(dir, sub.ID+".vtt"), vtt); err != nil {
+		return "", "", err
+	}
+	if err = bstore.put_stream_file(backend, path.Join(dir, sub.ID+".m3u8"), stream.SubtitlePlaylist(sub, stream.VTTDuration(vtt))); err != nil {
+		return "", "", err
+	}
+
+	manifests := []struct {
+		obj *object
+		add func([]byte, stream.Subtitle) []byte
+	}{{mpd, stream.SubtitleMPD}, {master, stream.SubtitleMaster}}
+	for _, m := range manifests {
+		if m.obj == nil {
+			continue
+		}
+
+		key := strings.TrimSuffix(m.obj.Key, ".zst")
+		manifest, err := bstore.read_stream_file(backend, key)
+		if err != nil {
+			return "", "", err
+		}
+		if err = bstore.put_stream_file(backend, key, m.add(manifest, sub)); err != nil {
+			return "", "", err
+		}
+	}
+
+	log.Printf("Attached subtitle %s to %s as %s\n", sub_key, dir, sub.ID)
+	return dir, sub.ID + ".vtt", nil
+}
+
+// attach_sidecars attaches the subtitles uploaded before the video at key was transcoded.
+func (bstore *ServerCfg) attach_sidecars(backend storage.Backend, key string) {
+	stem := path.Base(stream.OutputKey(key))
+	infos, err := backend.List(path.Dir(key))
+	if err != nil {
+		log.Printf("Error listing subtitles of %s: %v\n", key, err)
+		return
+	}
+
+	for _, info := range infos {
+		sub_key := "/" + strings.TrimSuffix(info.Key, ".zst")
+		name := path.Base(sub_key)
+		if path.Dir(sub_key) != path.Dir(key) || !stream.CheckSubEXT(name) {
+			continue
+		}
+		if strings.TrimSuffix(name, path.Ext(name)) != stem && !strings.HasPrefix(name, stem+".") {
+			continue
+		}
+
+		if _, _, err = bstore.attach_subtitle(backend, sub_key); err != nil && !errors.Is(err, ErrNoStream) {
+			log.Printf("Error attaching subtitle %s: %v\n", sub_key, err)
+		}
+	}
+}
+
+// find_manifests returns the DASH and HLS manifests of the stream directory dir, nil when
+// that stream was not made.
+func (bstore *ServerCfg) find_manifests(backend storage.Backend, dir string) (*object, *object) {
+	mpd, _ := bstore.find_object(backend, path.Join(dir, stream.MethodFMap[stream.DASH]))
+	master, _ := bstore.find_object(backend, path.Join(dir, stream.MethodFMap[stream.HLS]))
+	return mpd, master
+}
+
+func (bstore *ServerCfg) read_stream_file(backend storage.Backend, key string) ([]byte, error) {
+	obj, err := bstore.find_object(backend, key)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := obj.open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(io.LimitReader(r, MaxSubtitleSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxSubtitleSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", key, MaxSubtitleSize)
+	}
+	return data, nil
+}
+
+// put_stream_file stores a generated stream file like the transcode output is stored,
+// without a sidecar.
+func (bstore *ServerCfg) put_stream_file(backend storage.Backend, key string, data []byte) error {
+	stored_key, stale_key := key, key+".zst"
+	if bstore.Compress {
+		stored_key, stale_key = stale_key, stored_key
+	}
+
+	if err := put_stream(backend, stored_key, bytes.NewReader(data), &ObjectMeta{}, bstore.Compress, bstore.CompressionLevel, bstore.Encrypt); err != nil {
+		return err
+	}
+
+	if err := backend.Delete(stale_key); err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return fmt.Errorf("removing stale %s: %w", stale_key, err)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package bstore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	TokensFile  = "tokens.yml"
+	TokenPrefix = "bst_"
+	tokenKey    = "token"
+)
+
+const (
+	OpUpload   = "upload"
+	OpDownload = "download"
+	OpDelete   = "delete"
+	OpList     = "list"
+)
+
+var TokenOps = []string{OpUpload, OpDownload, OpDelete, OpList}
+
+// Token grants a subset of operations on a subset of keys. Only the SHA-256 of the
+// secret is stored, the secret itself is printed once when the token is created.
+type Token struct {
+	Name       string        `yaml:"name"`
+	Hash       string        `yaml:"hash"`
+	Operations []string      `yaml:"operations"`
+	Prefixes   []string      `yaml:"prefixes"`
+	Access     []string      `yaml:"access"`
+	Expires    time.Time     `yaml:"expires,omitempty"`
+	Created    time.Time     `yaml:"created"`
+	RateLimit  RateLimitRule `yaml:"rate_limit,omitempty"`
+}
+
+type tokenFile struct {
+	Tokens []*Token `yaml:"tokens"`
+}
+
+// TokenStore keeps the tokens file in memory and reloads it whenever it changes on disk,
+// so tokens created or revoked from the CLI apply without restarting the server.
+type TokenStore struct {
+	fpath   string
+	mu      sync.Mutex
+	mod     time.Time
+	by_hash map[string]*Token
+}
+
+func TokensPath() (string, error) {
+	conf_dir, err := ConfDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(conf_dir, TokensFile), nil
+}
+
+func NewTokenStore(fpath string) *TokenStore {
+	return &TokenStore{
+		fpath:   fpath,
+		by_hash: make(map[string]*Token),
+	}
+}
+
+// Lookup returns the token matching secret, or nil if there is none.
+func (ts *TokenStore) Lookup(secret string) *Token {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	info, err := os.Stat(ts.fpath)
+	if err != nil {
+		ts.by_hash = make(map[string]*Token)
+		ts.mod = time.Time{}
+		return nil
+	}
+
+	if !info.ModTime().Equal(ts.mod) {
+		tokens, err := ReadTokens(ts.fpath)
+		if err != nil {
+			log.Printf("Error loading tokens from %s: %v\n", ts.fpath, err)
+			return nil
+		}
+
+		ts.by_hash = make(map[string]*Token, len(tokens))
+		for _, t := range tokens {
+			ts.by_hash[t.Hash] = t
+		}
+		ts.mod = info.ModTime()
+	}
+
+	return ts.by_hash[hash_secret(secret)]
+}
+
+// Allows reports whether the token may run op on key in the given access tier.
+func (t *Token) Allows(op, access, key string) error {
+	if !t.Expires.IsZero() && time.Now().After(t.Expires) {
+		return errors.New("Token expired")
+	}
+
+	if !contains(t.Operations, op) {
+		return fmt.Errorf("Token not allowed to %s", op)
+	}
+
+	if !contains(t.Access, access) {
+		return fmt.Errorf("Token not allowed to access %s files", access)
+	}
+
+	if len(t.Prefixes) == 0 {
+		return nil
+	}
+
+	key = path.Clean("/" + key)
+	for _, prefix := range t.Prefixes {
+		prefix = path.Clean("/" + prefix)
+		if prefix == "/" || key == prefix || strings.HasPrefix(key, prefix+"/") {
+			return nil
+		}
+	}
+
+	return errors.New("Token not allowed for this path")
+}
+
+func ReadTokens(fpath string) ([]*Token, error) {
+	data, err := os.ReadFile(fpath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tf tokenFile
+	if err = yaml.Unmarshal(data, &tf); err != nil {
+		return nil, err
+	}
+
+	return tf.Tokens, nil
+}
+
+func WriteTokens(fpath string, tokens []*Token) error {
+	data, err := yaml.Marshal(&tokenFile{Tokens: tokens})
+	if err != nil {
+		return err
+	}
+
+	tmp := fpath + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fpath)
+}
+
+// CreateToken adds a token to the tokens file and returns its secret.
+func CreateToken(fpath string, t *Token) (string, error) {
+	if t.Name == "" {
+		return "", errors.New("token name is required")
+	}
+
+	for _, op := range t.Operations {
+		if !contains(TokenOps, op) {
+			return "", fmt.Errorf("invalid operation `%s`, must be one of %v", op, TokenOps)
+		}
+	}
+	if len(t.Operations) == 0 {
+		return "", errors.New("at least one operation is required")
+	}
+
+	for _, access := range t.Access {
+		if access != "public" && access != "private" {
+			return "", fmt.Errorf("invalid access `%s`, must be public or private", access)
+		}
+	}
+	if len(t.Access) == 0 {
+		return "", errors.New("at least one access tier is required")
+	}
+
+	tokens, err := ReadTokens(fpath)
+	if err != nil {
+		return "", err
+	}
+
+	for _, existing := range tokens {
+		if existing.Name == t.Name {
+			return "", fmt.Errorf("token `%s` already exists", t.Name)
+		}
+	}
+
+	raw := make([]byte, 32)
+	if _, err = rand.Read(raw); err != nil {
+		return "", err
+	}
+	secret := TokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	t.Hash = hash_secret(secret)
+	t.Created = time.Now().UTC()
+	tokens = append(tokens, t)
+
+	if err = WriteTokens(fpath, tokens); err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+func RevokeToken(fpath, name string) error {
+	tokens, err := ReadTokens(fpath)
+	if err != nil {
+		return err
+	}
+
+	for i, t := range tokens {
+		if t.Name == name {
+			return WriteTokens(fpath, append(tokens[:i], tokens[i+1:]...))
+		}
+	}
+
+	return fmt.Errorf("token `%s` not found", name)
+}
+
+func hash_secret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func secure_compare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func contains(list []string, target string) bool {
+	for _, s := range list {
+		if s == target {
+			return true
+		}
+	}
+	return false
+}
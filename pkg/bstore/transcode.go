@@ -0,0 +1,165 @@
+package bstore
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cartersusi/bstore/pkg/jobs"
+	"github.com/cartersusi/bstore/pkg/stream"
+	"github.com/gin-gonic/gin"
+)
+
+const JobsDir = "jobs"
+
+// DefaultTranscodeTimeout is how many seconds a transcode may run before ffmpeg is killed.
+const DefaultTranscodeTimeout = 6 * 60 * 60
+
+type JobResponse struct {
+	ID       string         `json:"id"`
+	Status   jobs.Status    `json:"status"`
+	Progress float64        `json:"progress"`
+	Error    string         `json:"error,omitempty"`
+	FilePath string         `json:"file_path"`
+	Stream   StreamResponse `json:"stream"`
+	Created  time.Time      `json:"created"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+}
+
+// StartJobs opens the job queue in `~/.bstore/jobs`, resuming transcodes that did not finish.
+func (bstore *ServerCfg) StartJobs() error {
+	conf_dir, err := ConfDir()
+	if err != nil {
+		return err
+	}
+
+	bstore.Jobs, err = jobs.NewQueue(filepath.Join(conf_dir, JobsDir), bstore.Streaming.Workers, bstore.run_transcode)
+	return err
+}
+
+func (bstore *ServerCfg) GetJob(c *gin.Context) {
+	log.Println("Valid Job Request for", c.Request.URL.Path)
+	if bstore.Jobs == nil {
+		HandleError(c, NewError(http.StatusNotFound, "Job not found", nil))
+		return
+	}
+
+	job, ok := bstore.Jobs.Get(c.Param("id"))
+	if !ok {
+		HandleError(c, NewError(http.StatusNotFound, "Job not found", nil))
+		return
+	}
+
+	// tokens only see jobs for files they could have uploaded
+	if token, ok := c.Get(tokenKey); ok {
+		if err := token.(*Token).Allows(OpUpload, job.Access, job.Key); err != nil {
+			HandleError(c, NewError(http.StatusNotFound, "Job not found", err))
+			return
+		}
+	}
+
+	ret := &JobResponse{
+		ID:       job.ID,
+		Status:   job.Status,
+		Progress: job.Progress,
+		Error:    job.Error,
+		FilePath: job.Key,
+		Created:  job.Created,
+		Started:  job.Started,
+		Finished: job.Finished,
+	}
+	// a failed job has nothing to stream, the URLs are made again so private ones are freshly signed
+	if job.Status != jobs.Failed {
+		urls := bstore.make_stream_urls(c, job.Key, job.Access, DefaultStreamExpiry)
+		for name, url := range map[string]*string{"hls_url": &urls.Hls, "dash_url": &urls.Dash, "poster_url": &urls.Poster, "thumbnails_url": &urls.Thumbnails} {
+			if job.Result[name] == "" {
+				*url = ""
+			}
+		}
+		ret.Stream = *urls
+	}
+
+	c.JSON(http.StatusOK, ret)
+}
+
+// run_transcode builds the HLS and DASH output next to the job's copy of the video or
+// audio file and stores it below its key, `/dir/movie.mp4` streams from `/dir/movie/`. When
+// only some outputs were made the job is partial and lists just their URLs. Subtitles
+// uploaded next to the video before it was transcoded are attached afterwards.
+func (bstore *ServerCfg) run_transcode(job *jobs.Job, progress func(float64)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(bstore.Streaming.Timeout)*time.Second)
+	defer cancel()
+
+	is_audio := stream.CheckAudioEXT(job.Key)
+	backend := bstore.get_backend(job.Access)
+
+	// the upload already probed the file, the encoders use that instead of probing again
+	var video_info *stream.VideoInfo
+	var audio_info *stream.AudioInfo
+	if meta, err := ReadMeta(backend, job.Key); err == nil {
+		video_info, audio_info = meta.Video, meta.Audio
+	}
+
+	var result *stream.Result
+	var err error
+	if is_audio {
+		result, err = stream.MakeAudio(ctx, stream.AudioEncoderRequest{
+			InputPath:   job.Input,
+			Bitrates:    bstore.Streaming.AudioBitrates,
+			Compress:    bstore.Compress,
+			Encrypt:     bstore.Encrypt,
+			CompressLvl: bstore.CompressionLevel,
+			Progress:    progress,
+			Info:        audio_info,
+		})
+	} else {
+		result, err = stream.Make(ctx, stream.VideoEncoderRequest{
+			InputPath:   job.Input,
+			Codec:       bstore.Streaming.Codec,
+			Hardware:    bstore.Streaming.Hardware,
+			Bitrate:     bstore.Streaming.Bitrate,
+			Ladder:      bstore.Streaming.Ladder,
+			Thumbnails:  bstore.Streaming.Thumbnails,
+			Compress:    bstore.Compress,
+			Encrypt:     bstore.Encrypt,
+			CompressLvl: bstore.CompressionLevel,
+			Progress:    progress,
+			Info:        video_info,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	out_dir := strings.TrimSuffix(job.Input, filepath.Ext(job.Input))
+	if err = put_dir(backend, out_dir, stream.OutputKey(job.Key)); err != nil {
+		return err
+	}
+	if !is_audio {
+		bstore.attach_sidecars(backend, job.Key)
+	}
+
+	if result.Err() == nil {
+		return nil
+	}
+
+	made := make(map[string]string)
+	outputs := map[string]error{"dash_url": result.DASH, "hls_url": result.HLS, "poster_url": result.Poster, "thumbnails_url": result.Thumbnails}
+	for name, output_err := range outputs {
+		if output_err == nil && job.Result[name] != "" {
+			made[name] = job.Result[name]
+		}
+	}
+	return &jobs.PartialError{Err: result.Err(), Result: made}
+}
+
+func access_tier(x_access string) string {
+	if x_access == "public" {
+		return "public"
+	}
+	return "private"
+}
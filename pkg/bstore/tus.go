@@ -0,0 +1,302 @@
+package bstore
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tus 1.0.0 with the creation, termination and expiration extensions. The creation URL
+// is `/api/tus/<file_path>` and the upload URL it returns adds `?upload_id=<id>`, so
+// tokens scoped to path prefixes work as they do for `/api/upload`.
+const (
+	TusVersion     = "1.0.0"
+	TusExtensions  = "creation,termination,expiration"
+	tusContentType = "application/offset+octet-stream"
+)
+
+// only one PATCH may append to an upload at a time
+var tus_locks sync.Map
+
+func (bstore *ServerCfg) TusOptions(c *gin.Context) {
+	c.Header("Tus-Resumable", TusVersion)
+	c.Header("Tus-Version", TusVersion)
+	c.Header("Tus-Extension", TusExtensions)
+	c.Header("Tus-Max-Size", strconv.FormatInt(bstore.Tus.MaxSize, 10))
+	c.Status(http.StatusNoContent)
+}
+
+func (bstore *ServerCfg) TusCreate(c *gin.Context) {
+	log.Println("Valid Tus Create Request for", c.Request.URL.Path)
+	if !tus_resumable(c) {
+		return
+	}
+
+	validation := bstore.ValidateReq(c)
+	if validation.Err != nil {
+		HandleError(c, NewError(validation.HttpStatus, validation.Err.Error(), validation.Err))
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		HandleError(c, NewError(http.StatusBadRequest, "Upload-Length must be a non-negative integer", err))
+		return
+	}
+	if length > bstore.Tus.MaxSize {
+		HandleError(c, NewError(http.StatusRequestEntityTooLarge, "Upload-Length exceeds Tus-Max-Size", nil))
+		return
+	}
+
+	meta := bstore.new_meta(c, validation.Fpath)
+	if err = parse_tus_metadata(c.GetHeader("Upload-Metadata"), meta); err != nil {
+		HandleError(c, NewError(http.StatusBadRequest, "Invalid Upload-Metadata", err))
+		return
+	}
+
+	session, err := create_session(validation, ProtocolTus, length, bstore.Tus.TTL, meta)
+	if err != nil {
+		HandleError(c, NewError(http.StatusInternalServerError, "Error creating upload", err))
+		return
+	}
+
+	log.Printf("Tus upload %s started for %s, %d bytes\n", session.UploadID, session.Key, length)
+	c.Header("Location", (&url.URL{Path: c.Request.URL.Path, RawQuery: "upload_id=" + session.UploadID}).String())
+	c.Header("Upload-Expires", session.Expires.Format(http.TimeFormat))
+
+	if length == 0 {
+		bstore.tus_finish(c, validation, session)
+		if c.IsAborted() {
+			return
+		}
+	}
+	c.Status(http.StatusCreated)
+}
+
+func (bstore *ServerCfg) TusHead(c *gin.Context) {
+	if !tus_resumable(c) {
+		return
+	}
+
+	_, session, ok := bstore.validate_session(c, ProtocolTus)
+	if !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(session.Length, 10))
+	c.Header("Upload-Expires", session.Expires.Format(http.TimeFormat))
+	c.Status(http.StatusOK)
+}
+
+// TusPatch appends the body at Upload-Offset. Bytes received before a dropped connection
+// are kept, so the client resumes from whatever offset HEAD reports afterwards.
+func (bstore *ServerCfg) TusPatch(c *gin.Context) {
+	log.Println("Valid Tus Patch Request for", c.Request.URL.Path)
+	if !tus_resumable(c) {
+		return
+	}
+
+	if c.ContentType() != tusContentType {
+		HandleError(c, NewError(http.StatusUnsupportedMediaType, "Content-Type must be "+tusContentType, nil))
+		return
+	}
+
+	validation, session, ok := bstore.validate_session(c, ProtocolTus)
+	if !ok {
+		return
+	}
+
+	lock, _ := tus_locks.LoadOrStore(session.UploadID, &sync.Mutex{})
+	if !lock.(*sync.Mutex).TryLock() {
+		HandleError(c, NewError(http.StatusLocked, "Upload is being written by another request", nil))
+		return
+	}
+	defer lock.(*sync.Mutex).Unlock()
+
+	// another PATCH may have moved the offset since validate_session read it
+	session, err := read_session(validation.Backend, session.UploadID)
+	if err != nil {
+		HandleError(c, NewError(http.StatusInternalServerError, "Error reading upload", err))
+		return
+	}
+	offset := session.Offset
+
+	client_offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || client_offset != offset {
+		c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+		HandleError(c, NewError(http.StatusConflict, "Upload-Offset does not match the upload", err))
+		return
+	}
+
+	c.Header("Upload-Expires", session.Expires.Format(http.TimeFormat))
+	if offset == session.Length {
+		// every byte arrived but storing the upload failed before, try again
+		c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+		bstore.tus_finish(c, validation, session)
+		if !c.IsAborted() {
+			c.Status(http.StatusNoContent)
+		}
+		return
+	}
+
+	body := &tus_reader{r: http.MaxBytesReader(c.Writer, c.Request.Body, session.Length-offset)}
+	key := part_key(session.UploadID, session.Parts+1)
+	part := &ObjectMeta{Encrypted: bstore.Encrypt, Uploaded: time.Now().UTC()}
+	err = put_stream(validation.Backend, key, body, part, false, bstore.CompressionLevel, bstore.Encrypt)
+	n := part.Size
+	if err == nil && n > 0 {
+		err = WriteMeta(validation.Backend, key, part)
+	}
+	if err != nil {
+		_ = validation.Backend.Delete(key)
+		HandleError(c, NewError(http.StatusInternalServerError, "Error writing upload", err))
+		return
+	}
+	if n == 0 {
+		_ = validation.Backend.Delete(key)
+	}
+
+	var max_err *http.MaxBytesError
+	if errors.As(body.err, &max_err) {
+		// the part was cut at Upload-Length, drop it rather than keep a truncated write
+		_ = validation.Backend.Delete(key)
+		RemoveMeta(validation.Backend, key)
+		HandleError(c, NewError(http.StatusRequestEntityTooLarge, "Body exceeds Upload-Length", body.err))
+		return
+	}
+
+	if n > 0 {
+		session.Offset += n
+		session.Parts++
+		if err = write_session(validation.Backend, session); err != nil {
+			// without the session the part is not counted, the client sends it again
+			_ = validation.Backend.Delete(key)
+			RemoveMeta(validation.Backend, key)
+			HandleError(c, NewError(http.StatusInternalServerError, "Error writing upload", err))
+			return
+		}
+	}
+	offset = session.Offset
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	if body.err != nil {
+		log.Printf("Tus upload %s interrupted at %d bytes: %v\n", session.UploadID, offset, body.err)
+		HandleError(c, NewError(http.StatusBadRequest, "Upload interrupted", body.err))
+		return
+	}
+
+	if offset == session.Length {
+		bstore.tus_finish(c, validation, session)
+		if c.IsAborted() {
+			return
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (bstore *ServerCfg) TusDelete(c *gin.Context) {
+	log.Println("Valid Tus Delete Request for", c.Request.URL.Path)
+	if !tus_resumable(c) {
+		return
+	}
+
+	validation, session, ok := bstore.validate_session(c, ProtocolTus)
+	if !ok {
+		return
+	}
+
+	remove_session(validation.Backend, session.UploadID)
+	c.Status(http.StatusNoContent)
+}
+
+// tus_finish stores the assembled upload like `/api/upload` would, stream.Make included.
+func (bstore *ServerCfg) tus_finish(c *gin.Context, validation ReqValidation, session *MultipartSession) {
+	parts, err := list_parts(validation.Backend, session.UploadID)
+	if err != nil {
+		HandleError(c, NewError(http.StatusInternalServerError, "Error reading upload", err))
+		return
+	}
+	// a part the session never counted is left from a PATCH that failed halfway
+	for len(parts) > 0 && parts[len(parts)-1].PartNumber > session.Parts {
+		parts = parts[:len(parts)-1]
+	}
+
+	log.Printf("Completing tus upload %s, %d bytes\n", session.UploadID, session.Length)
+	meta := session.Meta
+	meta.Uploaded = time.Now().UTC()
+
+	body := &parts_reader{backend: validation.Backend, parts: parts}
+	defer body.Close()
+	upload_response, err := bstore.store_upload(c, validation, body, meta)
+	if err != nil {
+		HandleError(c, err)
+		return
+	}
+
+	remove_session(validation.Backend, session.UploadID)
+	c.Header("X-Bstore-Url", upload_response.Url)
+}
+
+func tus_resumable(c *gin.Context) bool {
+	c.Header("Tus-Resumable", TusVersion)
+	if c.GetHeader("Tus-Resumable") != TusVersion {
+		c.Header("Tus-Version", TusVersion)
+		HandleError(c, NewError(http.StatusPreconditionFailed, "Unsupported Tus-Resumable version", nil))
+		return false
+	}
+	return true
+}
+
+// parse_tus_metadata reads `key base64,key base64`. `filetype` becomes the content type,
+// everything else user metadata.
+func parse_tus_metadata(header string, meta *ObjectMeta) error {
+	if header == "" {
+		return nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if k == "" {
+			return errors.New("empty metadata key")
+		}
+
+		value, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return fmt.Errorf("metadata `%s`: %w", k, err)
+		}
+
+		if k == "filetype" && len(value) > 0 {
+			meta.ContentType = string(value)
+		} else {
+			meta.UserMeta[strings.ToLower(k)] = string(value)
+		}
+	}
+	return nil
+}
+
+// tus_reader ends the body at the first read error instead of failing, keeping what
+// arrived; the error is left in err.
+type tus_reader struct {
+	r   io.Reader
+	err error
+}
+
+func (tr *tus_reader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if err != nil && err != io.EOF {
+		tr.err = err
+		return n, io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,110 @@
+package bstore
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cartersusi/bstore/pkg/storage"
+	"github.com/gin-gonic/gin"
+)
+
+func tus_server() (*ServerCfg, *gin.Engine) {
+	gin.SetMode(gin.TestMode)
+	cfg := &ServerCfg{
+		MaxFileNameLen: 255,
+		MaxFileSize:    1 << 20,
+		Public:         storage.NewMemory(),
+		Private:        storage.NewMemory(),
+		Tus:            MultipartConfig{Enabled: true, MaxSize: 1 << 20, TTL: 3600},
+	}
+
+	r := gin.New()
+	r.POST("/api/tus/*file_path", cfg.TusCreate)
+	r.HEAD("/api/tus/*file_path", cfg.TusHead)
+	r.PATCH("/api/tus/*file_path", cfg.TusPatch)
+	r.DELETE("/api/tus/*file_path", cfg.TusDelete)
+	return cfg, r
+}
+
+func tus_do(r *gin.Engine, method, target string, offset int64, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", TusVersion)
+	switch method {
+	case http.MethodPost:
+		req.Header.Set("Upload-Length", strconv.Itoa(len(body)))
+		req.Body = http.NoBody
+	case http.MethodPatch:
+		req.Header.Set("Content-Type", tusContentType)
+		req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestTusOffsetInSession(t *testing.T) {
+	cfg, r := tus_server()
+	const data = "hello tus world"
+
+	w := tus_do(r, http.MethodPost, "/api/tus/a.txt", 0, data)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create = %d: %s", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+	upload_id := strings.TrimPrefix(location, "/api/tus/a.txt?upload_id=")
+
+	if w = tus_do(r, http.MethodPatch, location, 0, data[:5]); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("first PATCH = %d offset %q: %s", w.Code, w.Header().Get("Upload-Offset"), w.Body)
+	}
+
+	session, err := read_session(cfg.Private, upload_id)
+	if err != nil || session.Offset != 5 || session.Parts != 1 {
+		t.Fatalf("session after one PATCH = %+v, %v; want offset 5 in 1 part", session, err)
+	}
+
+	if w = tus_do(r, http.MethodHead, location, 0, ""); w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("HEAD offset = %q, want 5", w.Header().Get("Upload-Offset"))
+	}
+	if w = tus_do(r, http.MethodPatch, location, 3, data[3:]); w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("PATCH at a stale offset = %d offset %q, want 409 at 5", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	// a part the session does not count, left by a PATCH that failed before saving it
+	if err = put_bytes(cfg.Private, part_key(upload_id, 3), []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+	if err = WriteMeta(cfg.Private, part_key(upload_id, 3), &ObjectMeta{Size: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	if w = tus_do(r, http.MethodPatch, location, 5, data[5:]); w.Code != http.StatusNoContent {
+		t.Fatalf("last PATCH = %d: %s", w.Code, w.Body)
+	}
+	if _, ok := tus_locks.Load(upload_id); ok {
+		t.Fatal("lock of the finished upload was kept")
+	}
+
+	file, _, err := cfg.Private.Get("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	got, _ := io.ReadAll(file)
+	if string(got) != data {
+		t.Fatalf("stored upload = %q, want %q", got, data)
+	}
+}
+
+func TestRemoveSessionDropsLock(t *testing.T) {
+	backend := storage.NewMemory()
+	tus_locks.Store("0123456789abcdef0123456789abcdef", nil)
+
+	remove_session(backend, "0123456789abcdef0123456789abcdef")
+	if _, ok := tus_locks.Load("0123456789abcdef0123456789abcdef"); ok {
+		t.Fatal("remove_session kept the upload's lock")
+	}
+}
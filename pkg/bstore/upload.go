@@ -1,13 +1,17 @@
 package bstore
 
 import (
-	"bytes"
+	"errors"
+	"io"
 	"log"
 	"net/http"
 	"os"
-	"strings"
+	"path"
+	"path/filepath"
 
 	"github.com/cartersusi/bstore/pkg/fops"
+	"github.com/cartersusi/bstore/pkg/jobs"
+	"github.com/cartersusi/bstore/pkg/storage"
 	"github.com/cartersusi/bstore/pkg/stream"
 	"github.com/gin-gonic/gin"
 )
@@ -16,108 +20,215 @@ type StreamResponse struct {
 	Hls    string `json:"hls_url"`
 	Dash   string `json:"dash_url"`
 	Poster string `json:"poster_url"`
+	// Thumbnails is the WebVTT track of sprite sheet tiles for scrub previews.
+	Thumbnails string `json:"thumbnails_url,omitempty"`
 }
 type UploadRespone struct {
-	Url     string         `json:"url"`
-	Message string         `json:"message"`
-	Stream  StreamResponse `json:"stream"`
+	Url     string            `json:"url"`
+	Message string            `json:"message"`
+	Stream  StreamResponse    `json:"stream"`
+	Job     string            `json:"job_id,omitempty"`
+	Video   *stream.VideoInfo `json:"video,omitempty"`
+	Audio   *stream.AudioInfo `json:"audio,omitempty"`
+	// Subtitle is the WebVTT track a sidecar subtitle upload was attached to the stream as.
+	Subtitle string `json:"subtitle_url,omitempty"`
 }
 
 func (bstore *ServerCfg) Upload(c *gin.Context) {
 	log.Println("Valid Upload Request for", c.Request.URL.Path)
 	validation := bstore.ValidateReq(c)
 	if validation.Err != nil {
-		HandleError(c, NewError(validation.HttpStatus, validation.Err.Error(), nil))
+		HandleError(c, NewError(validation.HttpStatus, validation.Err.Error(), validation.Err))
 		return
 	}
 
-	fpath, err := fops.MkDirExt(validation.Fpath, validation.BasePath, bstore.Compress)
-	if err != nil {
-		HandleError(c, NewError(http.StatusBadRequest, "Error creating directory", err))
+	if c.Request.ContentLength > bstore.MaxFileSize {
+		HandleError(c, NewError(http.StatusRequestEntityTooLarge, "File size exceeds maximum allowed size", nil))
 		return
 	}
-	log.Println("Creating file at", fpath)
+	log.Println("Creating file at", validation.Fpath)
 
-	file, err := os.Create(fpath)
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, bstore.MaxFileSize)
+	upload_response, err := bstore.store_upload(c, validation, body, bstore.new_meta(c, validation.Fpath))
 	if err != nil {
-		HandleError(c, NewError(http.StatusInternalServerError, "Error creating file", err))
+		HandleError(c, err)
 		return
 	}
-	defer file.Close()
 
-	var buf bytes.Buffer
-	size, err := buf.ReadFrom(c.Request.Body)
-	if err != nil {
-		HandleError(c, NewError(http.StatusInternalServerError, "Error reading request body", err))
-		return
-	}
-	if size > bstore.MaxFileSize {
-		HandleError(c, NewError(http.StatusBadRequest, "File size exceeds maximum allowed size", nil))
-		return
-	}
+	c.JSON(http.StatusOK, upload_response)
+}
 
-	is_video := false
+// store_upload writes body to the validated key. Video and audio files are also kept in
+// the job directory, probed for their metadata and queued for transcoding, the stream
+// URLs work once the job is done. Subtitle files are attached to the stream of the video they sit next to.
+func (bstore *ServerCfg) store_upload(c *gin.Context, validation ReqValidation, body io.Reader, meta *ObjectMeta) (*UploadRespone, error) {
+	is_video, is_audio := false, false
 	stream_response := make_stream_response()
-	v_fpath := strings.TrimSuffix(fpath, ".zst")
 	if bstore.Streaming.Enabled {
-		is_video = stream.CheckEXT(v_fpath)
+		is_video = stream.CheckEXT(validation.Fpath)
+		is_audio = stream.CheckAudioEXT(validation.Fpath)
 	}
+	is_media := is_video || is_audio
+	transcode := is_media && bstore.Compress
 
-	if bstore.Compress {
-		if is_video {
-			log.Println("Video file detected, creating video stream at", v_fpath)
-			err = fops.WriteNewFile(v_fpath, buf.Bytes(), false)
-			if err != nil {
-				HandleError(c, NewError(http.StatusInternalServerError, "Error writing data", err))
-				return
-			}
-
-			err = stream.Make(stream.VideoEncoderRequest{
-				InputPath:   v_fpath,
-				Codec:       bstore.Streaming.Codec,
-				Bitrate:     bstore.Streaming.Bitrate,
-				Compress:    bstore.Compress,
-				Encrypt:     bstore.Encrypt,
-				CompressLvl: bstore.CompressionLevel,
-			})
-			if err != nil {
-				HandleError(c, NewError(http.StatusInternalServerError, "Error making video stream", err))
-				return
-			}
-			_ = os.Remove(v_fpath)
-
-			stream_response.Hls = stream.MakeUrl(c, v_fpath, stream.HLS)
-			stream_response.Dash = stream.MakeUrl(c, v_fpath, stream.DASH)
-			stream_response.Poster = stream.MakeUrl(c, v_fpath, stream.POSTER)
+	var raw *os.File
+	job_id := ""
+	if is_media {
+		// ffmpeg needs the plain file on local disk, whatever the backend is
+		var err error
+		job_id, err = jobs.NewID()
+		if err != nil {
+			return nil, NewError(http.StatusInternalServerError, "Error creating file", err)
+		}
+
+		job_dir := bstore.Jobs.JobDir(job_id)
+		if err = os.MkdirAll(job_dir, os.ModePerm); err != nil {
+			return nil, NewError(http.StatusInternalServerError, "Error creating file", err)
 		}
-		err = fops.Compress(&buf, file, bstore.CompressionLevel, bstore.Encrypt)
+
+		// a fixed name keeps the uploaded file name out of ffmpeg's arguments and output patterns
+		raw, err = os.Create(filepath.Join(job_dir, "source"+path.Ext(validation.Fpath)))
 		if err != nil {
-			HandleError(c, NewError(http.StatusInternalServerError, "Error writing compressed data", err))
-			return
+			_ = os.RemoveAll(job_dir)
+			return nil, NewError(http.StatusInternalServerError, "Error creating file", err)
 		}
-	} else {
-		err = fops.WriteFile(file, buf.Bytes(), bstore.Encrypt)
+		defer raw.Close()
+		body = io.TeeReader(body, raw)
+	}
+
+	err := bstore.write_object(validation.Backend, validation.Fpath, body, meta)
+	if err != nil {
+		if is_media {
+			_ = os.RemoveAll(bstore.Jobs.JobDir(job_id))
+		}
+
+		var max_err *http.MaxBytesError
+		if errors.As(err, &max_err) {
+			return nil, NewError(http.StatusRequestEntityTooLarge, "File size exceeds maximum allowed size", err)
+		}
+		return nil, NewError(http.StatusInternalServerError, "Error writing data", err)
+	}
+
+	if is_media {
+		raw.Close()
+		if is_video {
+			bstore.probe_video(validation, raw.Name(), meta)
+		} else {
+			bstore.probe_audio(validation, raw.Name(), meta)
+		}
+		if !transcode {
+			_ = os.RemoveAll(bstore.Jobs.JobDir(job_id))
+			job_id = ""
+		}
+	}
+
+	if transcode {
+		log.Println("Media file detected, queueing stream job", job_id)
+
+		stream_response = bstore.make_stream_urls(c, validation.Fpath, access_tier(bstore.GetAccess(c)), DefaultStreamExpiry)
+		if is_audio && (meta.Audio == nil || !meta.Audio.CoverArt) {
+			// without cover art there is no poster
+			stream_response.Poster = ""
+		}
+
+		err = bstore.Jobs.Submit(&jobs.Job{
+			ID:     job_id,
+			Key:    validation.Fpath,
+			Access: access_tier(bstore.GetAccess(c)),
+			Input:  raw.Name(),
+			Result: map[string]string{
+				"hls_url":        stream_response.Hls,
+				"dash_url":       stream_response.Dash,
+				"poster_url":     stream_response.Poster,
+				"thumbnails_url": stream_response.Thumbnails,
+			},
+		})
 		if err != nil {
-			HandleError(c, NewError(http.StatusInternalServerError, "Error writing data", err))
-			return
+			_ = os.RemoveAll(bstore.Jobs.JobDir(job_id))
+			return nil, NewError(http.StatusInternalServerError, "Error queueing video stream", err)
 		}
 	}
 
 	upload_response := &UploadRespone{
 		Stream: *stream_response,
+		Job:    job_id,
+		Video:  meta.Video,
+		Audio:  meta.Audio,
+	}
+
+	if bstore.Streaming.Enabled && stream.CheckSubEXT(validation.Fpath) {
+		// the video may not be transcoded yet, its job picks the subtitle up then
+		dir, fname, err := bstore.attach_subtitle(validation.Backend, validation.Fpath)
+		if err == nil {
+			upload_response.Subtitle = stream.MakeFileUrl(c, stream_route(dir, access_tier(bstore.GetAccess(c)), DefaultStreamExpiry), dir, fname)
+		} else if !errors.Is(err, ErrNoStream) {
+			log.Printf("Error attaching subtitle %s: %v\n", validation.Fpath, err)
+		}
 	}
 	upload_response.Url = "UNAUTHORIZED"
 	if bstore.GetAccess(c) != "private" {
 		upload_response.Url = bstore.MakeUrl(c, validation.Fpath)
 		upload_response.Message = "Public File Uploaded Successfully"
-		log.Printf("Public file (%s) uploaded successfully to: %s\n", upload_response.Url, fpath)
+		log.Printf("Public file (%s) uploaded successfully to: %s\n", upload_response.Url, validation.Fpath)
 	} else {
 		upload_response.Message = "Private File Uploaded Successfully. No URL available"
-		log.Printf("Private file (UNAUTHORIZED) uploaded successfully to: %s\n", fpath)
+		log.Printf("Private file (UNAUTHORIZED) uploaded successfully to: %s\n", validation.Fpath)
 	}
 
-	file.Sync()
-	c.JSON(http.StatusOK, upload_response)
+	return upload_response, nil
+}
+
+// probe_video adds what ffprobe reports about the local copy of the video to its sidecar.
+// A video that cannot be probed is still stored, just without the information.
+func (bstore *ServerCfg) probe_video(validation ReqValidation, input string, meta *ObjectMeta) {
+	info, err := stream.Probe(input)
+	if err != nil {
+		log.Printf("Error probing video %s: %v\n", validation.Fpath, err)
+		return
+	}
+
+	meta.Video = info
+	if err = WriteMeta(validation.Backend, validation.Fpath, meta); err != nil {
+		log.Printf("Error saving video metadata of %s: %v\n", validation.Fpath, err)
+	}
+}
+
+// probe_audio adds the stream information and tags of the local copy of the audio file to
+// its sidecar.
+func (bstore *ServerCfg) probe_audio(validation ReqValidation, input string, meta *ObjectMeta) {
+	info, err := stream.ProbeAudio(input)
+	if err != nil {
+		log.Printf("Error probing audio %s: %v\n", validation.Fpath, err)
+		return
+	}
+
+	meta.Audio = info
+	if err = WriteMeta(validation.Backend, validation.Fpath, meta); err != nil {
+		log.Printf("Error saving audio metadata of %s: %v\n", validation.Fpath, err)
+	}
+}
+
+// put_dir copies every file generated in a local directory into the backend below key_prefix.
+func put_dir(backend storage.Backend, dir, key_prefix string) error {
+	files, err := fops.ListDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		file, err := os.Open(filepath.Join(dir, f))
+		if err != nil {
+			return err
+		}
+
+		_, err = backend.Put(path.Join(key_prefix, f), file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func make_stream_response() *StreamResponse {
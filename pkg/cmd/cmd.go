@@ -1,55 +1,148 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 )
 
-func RunCMD_fs(fs string) error {
-	cmd := exec.Command("bash", "-c", fs)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		fmt.Println("Error running command:", err)
+// StderrTail is how much of the end of stderr an Error keeps.
+const StderrTail = 4096
+
+// GetTimeout bounds GetCMD, it is meant for quick probes.
+const GetTimeout = time.Minute
+
+// a killed process gets this long to close its output before Wait gives up on it
+const waitDelay = 5 * time.Second
+
+// Error is returned when a command cannot start, exits with a non-zero code or is
+// stopped by its context.
+type Error struct {
+	Args     []string
+	ExitCode int // -1 when the command never ran or was killed by a signal
+	Stderr   string
+	Duration time.Duration
+	Err      error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s exited with code %d after %s", e.Args[0], e.ExitCode, e.Duration.Round(time.Millisecond))
+	if e.ExitCode == -1 {
+		msg = fmt.Sprintf("%s failed after %s: %v", e.Args[0], e.Duration.Round(time.Millisecond), e.Err)
+	}
+
+	// the last line is usually the reason
+	lines := strings.Split(strings.TrimSpace(e.Stderr), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		msg += ": " + last
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// tail_writer keeps the last max bytes written to it.
+type tail_writer struct {
+	buf []byte
+	max int
+}
+
+func (t *tail_writer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
 	}
+	return len(p), nil
+}
 
-	return nil
+// command runs name directly, never through a shell, and is killed when ctx is done.
+// A name only found through a relative PATH entry fails with exec.ErrDot.
+func command(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, arg...)
+	cmd.WaitDelay = waitDelay
+	return cmd
 }
 
-func RunCMD_fs_loose(fs string) {
-	cmd := exec.Command("bash", "-c", fs)
-	_ = cmd.Run()
-	return
+// run calls wait for cmd, stderr is still printed but its tail is kept for the Error.
+func run(ctx context.Context, cmd *exec.Cmd, wait func() error) error {
+	tail := &tail_writer{max: StderrTail}
+	cmd.Stderr = io.MultiWriter(os.Stderr, tail)
+
+	start := time.Now()
+	err := wait()
+	if err == nil {
+		return nil
+	}
+
+	exit_code := -1
+	var exit_err *exec.ExitError
+	if errors.As(err, &exit_err) {
+		exit_code = exit_err.ExitCode()
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("%w (%v)", ctx.Err(), err)
+	}
+
+	return &Error{
+		Args:     cmd.Args,
+		ExitCode: exit_code,
+		Stderr:   string(tail.buf),
+		Duration: time.Since(start),
+		Err:      err,
+	}
 }
 
-func RunCMD(name string, arg ...string) error {
-	fs := name + " " + strings.Join(arg, " ")
-	fmt.Printf("Running %s\n", fs)
+func RunCMD(ctx context.Context, name string, arg ...string) error {
+	log.Printf("Running %s %s\n", name, strings.Join(arg, " "))
 
-	cmd := exec.Command("bash", "-c", fs)
-	cmd.Stdin = os.Stdin
+	cmd := command(ctx, name, arg...)
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	err := run(ctx, cmd, cmd.Run)
 	if err != nil {
-		fmt.Println("Error running command:", err)
+		log.Println("Error running command:", err)
 	}
 
-	return nil
+	return err
 }
 
-func GetCMD(name string, arg ...string) (string, error) {
-	cmd := exec.Command(name, arg...)
-	if errors.Is(cmd.Err, exec.ErrDot) {
-		cmd.Err = nil
+// RunCMD_lines runs name like RunCMD, handing every line it prints on stdout to on_line.
+func RunCMD_lines(ctx context.Context, on_line func(string), name string, arg ...string) error {
+	cmd := command(ctx, name, arg...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
 	}
 
-	output, err := cmd.CombinedOutput()
+	return run(ctx, cmd, func() error {
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			on_line(scanner.Text())
+		}
+		// drain whatever a too long line left behind so the process is not blocked
+		_, _ = io.Copy(io.Discard, stdout)
+
+		return cmd.Wait()
+	})
+}
+
+func GetCMD(name string, arg ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), GetTimeout)
+	defer cancel()
+
+	output, err := command(ctx, name, arg...).CombinedOutput()
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// A binary only found through a relative PATH entry must not be run.
+func TestCommandRefusesRelativePath(t *testing.T) {
+	dir := t.TempDir()
+	stub := filepath.Join(dir, "bstore-stub")
+	if err := os.WriteFile(stub, []byte("#!/bin/sh\nexit 0\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Setenv("PATH", ".")
+
+	err = RunCMD(context.Background(), "bstore-stub")
+	if !errors.Is(err, exec.ErrDot) {
+		t.Fatalf("RunCMD from a relative PATH entry = %v, want exec.ErrDot", err)
+	}
+
+	t.Setenv("PATH", dir)
+	if err = RunCMD(context.Background(), "bstore-stub"); err != nil {
+		t.Fatalf("RunCMD from an absolute PATH entry = %v", err)
+	}
+}
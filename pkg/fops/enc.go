@@ -1,77 +1,335 @@
 package fops
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strings"
 )
 
-func DecryptFile(fpath string) ([]byte, error) {
-	file, err := os.Open(fpath)
+// decrypt_legacy opens a file sealed whole as one GCM message, the layout used before
+// chunked encryption. Only NewLegacyReader needs it.
+func decrypt_legacy(data []byte) ([]byte, error) {
+	key, err := get_key()
 	if err != nil {
 		return nil, err
 	}
 
-	var buf bytes.Buffer
-	_, err = io.Copy(&buf, file)
+	gcm, err := new_gcm(key)
 	if err != nil {
 		return nil, err
 	}
 
-	return Decrypt(buf.Bytes())
+	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+	return gcm.Open(nil, nonce, ciphertext, nil)
 }
 
-func Encrypt(data []byte) ([]byte, error) {
-	key_string := os.Getenv("BSTORE_ENC_KEY")
-	if key_string == "" {
-		return nil, errors.New("BSTORE_ENC_KEY not set")
-	}
-	key := []byte(key_string)
+// Chunked format written by EncryptWriter:
+//
+//	header: magic(6) | version(1) | reserved(1) | key_id(8) | chunk_size(4)
+//	chunk:  nonce(12) | ciphertext(<= chunk_size) | tag(16)
+//
+// Every chunk is sealed with the header, its index and a final flag as
+// additional data so chunks cannot be reordered, dropped or truncated.
+const (
+	EncMagic         = "BSTORE"
+	EncVersion       = 1
+	EncHeaderSize    = 20
+	DefaultChunkSize = 64 * 1024
 
-	block, err := aes.NewCipher(key)
+	enc_nonce_size = 12
+	enc_tag_size   = 16
+)
+
+type EncryptWriter struct {
+	dst        io.Writer
+	gcm        cipher.AEAD
+	header     []byte
+	buf        []byte
+	chunk_size int
+	index      uint64
+	closed     bool
+}
+
+func NewEncryptWriter(dst io.Writer) (*EncryptWriter, error) {
+	key, err := get_key()
 	if err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := new_gcm(key)
 	if err != nil {
 		return nil, err
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+	header := make([]byte, EncHeaderSize)
+	copy(header, EncMagic)
+	header[6] = EncVersion
+	copy(header[8:16], KeyID(key))
+	binary.BigEndian.PutUint32(header[16:20], DefaultChunkSize)
+
+	if _, err := dst.Write(header); err != nil {
 		return nil, err
 	}
 
-	return gcm.Seal(nonce, nonce, data, nil), nil
+	return &EncryptWriter{
+		dst:        dst,
+		gcm:        gcm,
+		header:     header,
+		buf:        make([]byte, 0, DefaultChunkSize),
+		chunk_size: DefaultChunkSize,
+	}, nil
 }
 
-func Decrypt(data []byte) ([]byte, error) {
-	key_string := os.Getenv("BSTORE_ENC_KEY")
-	if key_string == "" {
-		return nil, errors.New("BSTORE_ENC_KEY not set")
+func (w *EncryptWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed EncryptWriter")
 	}
-	key := []byte(key_string)
 
-	block, err := aes.NewCipher(key)
+	n := len(p)
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data arrives, the last one is sealed on Close
+		if len(w.buf) == w.chunk_size {
+			if err := w.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+
+		take := min(w.chunk_size-len(w.buf), len(p))
+		w.buf = append(w.buf, p[:take]...)
+		p = p[take:]
+	}
+
+	return n, nil
+}
+
+func (w *EncryptWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+func (w *EncryptWriter) seal(final bool) error {
+	nonce := make([]byte, enc_nonce_size)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	record := w.gcm.Seal(nonce, nonce, w.buf, chunk_aad(w.header, w.index, final))
+	if _, err := w.dst.Write(record); err != nil {
+		return err
+	}
+
+	w.buf = w.buf[:0]
+	w.index++
+	return nil
+}
+
+// SeekReader decrypts a chunked file with random access, only the chunk holding
+// the current offset is kept in memory.
+type SeekReader struct {
+	src        io.ReaderAt
+	gcm        cipher.AEAD
+	header     []byte
+	record     []byte
+	chunk      []byte
+	chunk_size int64
+	body_size  int64
+	n_chunks   int64
+	size       int64
+	off        int64
+	index      int64
+}
+
+func NewSeekReader(src io.ReaderAt, size int64) (*SeekReader, error) {
+	header := make([]byte, EncHeaderSize)
+	if _, err := src.ReadAt(header, 0); err != nil {
+		return nil, errors.New("encrypted header too short")
+	}
+
+	gcm, chunk_size, err := open_header(header)
 	if err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	record_size := int64(enc_nonce_size + chunk_size + enc_tag_size)
+	body_size := size - EncHeaderSize
+	n_chunks := (body_size + record_size - 1) / record_size
+	if n_chunks < 1 || body_size-(n_chunks-1)*record_size < enc_nonce_size+enc_tag_size {
+		return nil, errors.New("encrypted data truncated")
+	}
+
+	return &SeekReader{
+		src:        src,
+		gcm:        gcm,
+		header:     header,
+		record:     make([]byte, record_size),
+		chunk_size: int64(chunk_size),
+		body_size:  body_size,
+		n_chunks:   n_chunks,
+		size:       body_size - n_chunks*(enc_nonce_size+enc_tag_size),
+		index:      -1,
+	}, nil
+}
+
+// Size returns the plaintext size.
+func (r *SeekReader) Size() int64 {
+	return r.size
+}
+
+func (r *SeekReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+
+	index := r.off / r.chunk_size
+	if index != r.index {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.chunk[r.off-index*r.chunk_size:])
+	r.off += int64(n)
+	return n, nil
+}
+
+func (r *SeekReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.off = offset
+	return offset, nil
+}
+
+func (r *SeekReader) load(index int64) error {
+	record_size := int64(len(r.record))
+	start := index * record_size
+	n := min(record_size, r.body_size-start)
+
+	record := r.record[:n]
+	if _, err := r.src.ReadAt(record, EncHeaderSize+start); err != nil && err != io.EOF {
+		return err
+	}
+
+	nonce, ciphertext := record[:enc_nonce_size], record[enc_nonce_size:]
+	final := index == r.n_chunks-1
+	plain, err := r.gcm.Open(ciphertext[:0], nonce, ciphertext, chunk_aad(r.header, uint64(index), final))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	nonceSize := gcm.NonceSize()
-	if len(data) < nonceSize {
-		return nil, errors.New("ciphertext too short")
+	r.chunk = plain
+	r.index = index
+	return nil
+}
+
+// IsEncrypted reports whether r starts with a chunked encryption header without consuming it.
+func IsEncrypted(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(EncMagic))
+	return err == nil && string(magic) == EncMagic
+}
+
+func KeyID(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:8]
+}
+
+// open_header validates a chunked encryption header and returns the cipher for the key it names.
+func open_header(header []byte) (cipher.AEAD, int, error) {
+	if string(header[:6]) != EncMagic {
+		return nil, 0, errors.New("invalid encrypted header")
+	}
+	if header[6] != EncVersion {
+		return nil, 0, fmt.Errorf("unsupported encryption version %d", header[6])
 	}
 
-	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	return gcm.Open(nil, nonce, ciphertext, nil)
+	chunk_size := int(binary.BigEndian.Uint32(header[16:20]))
+	if chunk_size < 1 {
+		return nil, 0, errors.New("invalid chunk size")
+	}
+
+	key, err := find_key(header[8:16])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	gcm, err := new_gcm(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return gcm, chunk_size, nil
+}
+
+func chunk_aad(header []byte, index uint64, final bool) []byte {
+	aad := make([]byte, len(header)+9)
+	copy(aad, header)
+	binary.BigEndian.PutUint64(aad[len(header):], index)
+	if final {
+		aad[len(aad)-1] = 1
+	}
+	return aad
+}
+
+func get_key() ([]byte, error) {
+	key_string := os.Getenv("BSTORE_ENC_KEY")
+	if key_string == "" {
+		return nil, errors.New("BSTORE_ENC_KEY not set")
+	}
+	return []byte(key_string), nil
+}
+
+// find_key looks up the key a file was written with. Besides the current BSTORE_ENC_KEY,
+// retired keys listed comma separated in BSTORE_OLD_ENC_KEYS can still decrypt older files.
+func find_key(id []byte) ([]byte, error) {
+	keys := []string{os.Getenv("BSTORE_ENC_KEY")}
+	keys = append(keys, strings.Split(os.Getenv("BSTORE_OLD_ENC_KEYS"), ",")...)
+
+	for _, k := range keys {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		if bytes.Equal(KeyID([]byte(k)), id) {
+			return []byte(k), nil
+		}
+	}
+
+	return nil, fmt.Errorf("no encryption key found for key id %x", id)
+}
+
+func new_gcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
 }
@@ -1,69 +1,277 @@
 package fops
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
+	"io"
 	"os"
-	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
 )
 
-func ReadFile(fpath string, decrypt bool) ([]byte, error) {
-	data, err := os.ReadFile(fpath)
+// Reader exposes the plaintext of a stored file regardless of how it was written:
+// plain, zstd compressed, chunk encrypted, or the legacy whole-file AES-GCM layout.
+// Compressed streams seek frame-wise when they carry an Index, without one a seek
+// decodes forward from the start and Seekable reports false.
+type Reader struct {
+	r         io.Reader
+	file      Source
+	zr        *zstd.Decoder
+	zsrc      io.ReadSeeker
+	index     *Index
+	size      int64
+	pos       int64
+	want      int64
+	encrypted bool
+}
+
+// Source is the raw stored data a Reader decodes, an *os.File or a storage backend object.
+type Source interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// Open opens a stored file for reading. Compression is detected from the `.zst` suffix and
+// chunked encryption from the file header, encrypt is only used to recognise legacy encrypted files.
+func Open(fpath string, encrypt bool) (*Reader, error) {
+	file, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	r, err := NewLegacyReader(file, info.Size(), strings.HasSuffix(fpath, ".zst"), encrypt)
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
 
-	if decrypt {
-		data, err = Decrypt(data)
+	return r, nil
+}
+
+// NewReader decodes file, which holds size stored bytes. encrypted says whether it is in
+// the chunked encryption format, as recorded when it was written. Closing the Reader closes file.
+func NewReader(file Source, size int64, compressed, encrypted bool) (*Reader, error) {
+	ret := &Reader{file: file, size: -1, encrypted: encrypted}
+
+	switch {
+	case encrypted:
+		sr, err := NewSeekReader(file, size)
 		if err != nil {
 			return nil, err
 		}
+		if !compressed {
+			ret.r = sr
+			ret.size = sr.Size()
+			return ret, nil
+		}
+		ret.zsrc = sr
+		if err := ret.reset_stream(); err != nil {
+			return nil, err
+		}
+	case compressed:
+		ret.zsrc = file
+		if err := ret.reset_stream(); err != nil {
+			return nil, err
+		}
+	default:
+		ret.r = file
+		ret.size = size
+	}
+	return ret, nil
+}
+
+// NewLegacyReader decodes a file written without a record of how it was encrypted. It is
+// chunk encrypted when it starts with the header, otherwise whole-file AES-GCM when encrypt
+// is set, the layout used before chunked encryption.
+func NewLegacyReader(file Source, size int64, compressed, encrypt bool) (*Reader, error) {
+	chunked := IsEncrypted(bufio.NewReader(file))
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	ret, err := NewReader(file, size, compressed, chunked)
+	if err != nil || chunked || !encrypt {
+		return ret, err
+	}
+
+	// legacy whole-file AES-GCM can only be opened in one piece
+	data, err := io.ReadAll(ret.r)
+	if err != nil {
+		return nil, err
+	}
+	data, err = decrypt_legacy(data)
+	if err != nil {
+		return nil, err
 	}
 
-	return data, nil
+	ret.close_decoder()
+	ret.encrypted = true
+	ret.r = bytes.NewReader(data)
+	ret.size = int64(len(data))
+	return ret, nil
 }
 
-func WriteFile(file *os.File, data []byte, encrypt bool) error {
+// reset_stream_at restarts decoding of a compressed file at the compressed offset off,
+// which must be the start of a frame holding plaintext from pos on.
+func (r *Reader) reset_stream_at(off, pos int64) error {
+	if _, err := r.zsrc.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+
+	src := bufio.NewReader(r.zsrc)
+
 	var err error
-	if encrypt {
-		data, err = Encrypt(data)
-		if err != nil {
-			return err
+	if r.zr == nil {
+		r.zr, err = zstd.NewReader(src)
+	} else {
+		err = r.zr.Reset(src)
+	}
+	if err != nil {
+		return err
+	}
+
+	r.r = r.zr
+	r.pos = pos
+	r.want = pos
+	return nil
+}
+
+// reset_stream restarts decoding of a compressed file from its first byte.
+func (r *Reader) reset_stream() error {
+	return r.reset_stream_at(0, 0)
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.zr != nil && r.want != r.pos {
+		if err := r.position(); err != nil {
+			return 0, err
 		}
 	}
 
-	_, err = file.Write(data)
-	return err
+	n, err := r.r.Read(p)
+	r.pos += int64(n)
+	r.want = r.pos
+	return n, err
 }
 
-func WriteNewFile(fpath string, data []byte, encrypt bool) error {
-	file, err := os.Create(fpath)
-	if err != nil {
-		return err
+// Seek only records the target of a compressed stream, the decoder is moved there on the next Read.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := r.r.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.want
+	case io.SeekEnd:
+		if r.size < 0 {
+			// the decompressed size is only known after decoding everything once
+			r.want = r.pos
+			if _, err := io.Copy(io.Discard, r); err != nil {
+				return 0, err
+			}
+			r.size = r.pos
+		}
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
 	}
-	defer file.Close()
 
-	return WriteFile(file, data, encrypt)
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.want = offset
+	return offset, nil
 }
 
-func MkDirExt(fpath, base_path string, compress bool) (string, error) {
-	if fpath == "" {
-		return "", errors.New("file path is required")
+// position moves the decoder to r.want, restarting at the frame holding it when that is
+// behind or well ahead of the current position.
+func (r *Reader) position() error {
+	target := r.want
+
+	switch {
+	case r.index != nil:
+		frame := r.index.frame(target)
+		start := int64(frame) * r.index.FrameSize
+		if target < r.pos || start > r.pos {
+			if err := r.reset_stream_at(r.index.Offsets[frame], start); err != nil {
+				return err
+			}
+		}
+	case target < r.pos:
+		if err := r.reset_stream(); err != nil {
+			return err
+		}
 	}
 
-	fpath = filepath.Join(base_path, fpath)
-	if compress {
-		fpath += ".zst"
+	n, err := io.CopyN(io.Discard, r.r, target-r.pos)
+	r.pos += n
+	if err != nil && err != io.EOF {
+		return err
 	}
 
-	dir := filepath.Dir(fpath)
-	if dir == "" {
-		return "", errors.New("error getting directory")
+	// past the end every further Read returns io.EOF
+	r.pos = target
+	r.want = target
+	return nil
+}
+
+// Size returns the plaintext size, or -1 when it is not known without reading the whole file.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// Encrypted reports whether the file was stored encrypted, in either layout.
+func (r *Reader) Encrypted() bool {
+	return r.encrypted
+}
+
+// Seekable reports whether a seek costs at most one frame of decoding. Compressed files
+// written before frame indexes existed have to be decoded from the start instead.
+func (r *Reader) Seekable() bool {
+	return r.zr == nil || r.index != nil
+}
+
+// SetSize records a plaintext size known from elsewhere, sparing compressed streams a full decode on SeekEnd.
+func (r *Reader) SetSize(size int64) {
+	if r.size < 0 {
+		r.size = size
 	}
-	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-		return "", errors.New("error creating directory")
+}
+
+// SetIndex gives a compressed stream the frame index it was written with, usually kept in
+// its sidecar, so seeks restart at the frame holding the target.
+func (r *Reader) SetIndex(index *Index) {
+	if r.zr == nil || !index.valid() {
+		return
 	}
 
-	return fpath, nil
+	r.index = index
+	r.SetSize(index.Size)
+}
+
+func (r *Reader) Close() error {
+	r.close_decoder()
+	return r.file.Close()
+}
+
+func (r *Reader) close_decoder() {
+	if r.zr != nil {
+		r.zr.Close()
+		r.zr = nil
+	}
 }
 
 func MkDir(fpath string) error {
@@ -0,0 +1,215 @@
+package fops
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// source wraps stored bytes as the Source a Reader decodes.
+type source struct {
+	*bytes.Reader
+}
+
+func (source) Close() error { return nil }
+
+// seal_legacy encrypts data whole as one GCM message, the layout written before chunked encryption.
+func seal_legacy(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	key, err := get_key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := new_gcm(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	return gcm.Seal(nonce, nonce, data, nil)
+}
+
+func write_stored(t *testing.T, data []byte, compress, encrypt bool) ([]byte, *Index) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, compress, 2, encrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), w.Index()
+}
+
+func test_data(n int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, n)
+	for i := range data {
+		// compressible but not uniform
+		data[i] = byte(rng.Intn(16))
+	}
+	return data
+}
+
+func TestReaderSeek(t *testing.T) {
+	t.Setenv("BSTORE_ENC_KEY", "0123456789abcdef0123456789abcdef")
+	data := test_data(3*FrameSize + 12345)
+
+	tests := []struct {
+		name     string
+		compress bool
+		encrypt  bool
+		index    bool
+		seekable bool
+	}{
+		{name: "plain", seekable: true},
+		{name: "encrypted", encrypt: true, seekable: true},
+		{name: "compressed", compress: true, index: true, seekable: true},
+		{name: "compressed encrypted", compress: true, encrypt: true, index: true, seekable: true},
+		{name: "compressed without index", compress: true},
+		{name: "compressed encrypted without index", compress: true, encrypt: true},
+	}
+
+	offsets := []int64{0, 1, FrameSize - 1, FrameSize, 2*FrameSize + 7, 17, 3 * FrameSize, int64(len(data)) - 1, 5}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored, index := write_stored(t, data, tt.compress, tt.encrypt)
+			if tt.compress && len(index.Offsets) != 4 {
+				t.Fatalf("got %d frames, want 4", len(index.Offsets))
+			}
+
+			r, err := NewReader(source{bytes.NewReader(stored)}, int64(len(stored)), tt.compress, tt.encrypt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			if tt.index {
+				r.SetIndex(index)
+			}
+			if r.Seekable() != tt.seekable {
+				t.Fatalf("Seekable() = %t, want %t", r.Seekable(), tt.seekable)
+			}
+
+			end, err := r.Seek(0, io.SeekEnd)
+			if err != nil || end != int64(len(data)) {
+				t.Fatalf("Seek(0, SeekEnd) = %d, %v, want %d", end, err, len(data))
+			}
+
+			buf := make([]byte, 1000)
+			for _, off := range offsets {
+				if _, err = r.Seek(off, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+				n, err := io.ReadFull(r, buf)
+				if err != nil && err != io.ErrUnexpectedEOF {
+					t.Fatalf("read at %d: %v", off, err)
+				}
+				want := data[off:min(off+int64(len(buf)), int64(len(data)))]
+				if !bytes.Equal(buf[:n], want) {
+					t.Fatalf("read at %d returned wrong data", off)
+				}
+			}
+
+			if _, err = r.Seek(int64(len(data))+10, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := r.Read(buf); n != 0 || err != io.EOF {
+				t.Fatalf("read past the end = %d, %v, want io.EOF", n, err)
+			}
+		})
+	}
+}
+
+// With an index a seek restarts at the frame holding the target instead of decoding from
+// the start, so a damaged first frame does not affect reads from later frames.
+func TestReaderSeekSkipsFrames(t *testing.T) {
+	data := test_data(2*FrameSize + 100)
+	stored, index := write_stored(t, data, true, false)
+
+	damaged := bytes.Clone(stored)
+	for i := index.Offsets[0] + 16; i < index.Offsets[1]-16; i++ {
+		damaged[i] ^= 0xff
+	}
+
+	r, err := NewReader(source{bytes.NewReader(damaged)}, int64(len(damaged)), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.SetIndex(index)
+
+	off := int64(FrameSize + 50)
+	if _, err = r.Seek(off, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[off:]) {
+		t.Fatal("read after seek returned wrong data")
+	}
+}
+
+func TestWriterIndex(t *testing.T) {
+	if _, index := write_stored(t, []byte("data"), false, false); index != nil {
+		t.Fatalf("uncompressed Index() = %v, want nil", index)
+	}
+
+	_, index := write_stored(t, nil, true, false)
+	if index.Size != 0 || len(index.Offsets) != 1 {
+		t.Fatalf("empty Index() = %+v", index)
+	}
+
+	_, index = write_stored(t, test_data(FrameSize), true, false)
+	if index.Size != FrameSize || len(index.Offsets) != 1 {
+		t.Fatalf("single frame Index() = %+v", index)
+	}
+}
+
+func TestReaderEncryptionMode(t *testing.T) {
+	t.Setenv("BSTORE_ENC_KEY", "0123456789abcdef0123456789abcdef")
+
+	read := func(t *testing.T, r *Reader, err error) []byte {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	// a plain file may start with the header's magic bytes
+	plain := []byte(EncMagic + " is how this upload starts")
+	r, err := NewReader(source{bytes.NewReader(plain)}, int64(len(plain)), false, false)
+	if got := read(t, r, err); !bytes.Equal(got, plain) {
+		t.Fatalf("plain file starting with %q = %q", EncMagic, got)
+	}
+
+	if _, err = NewReader(source{bytes.NewReader(plain)}, int64(len(plain)), false, true); err == nil {
+		t.Fatal("reading a plain file as encrypted succeeded")
+	}
+
+	chunked, _ := write_stored(t, plain, false, true)
+	r, err = NewLegacyReader(source{bytes.NewReader(chunked)}, int64(len(chunked)), false, false)
+	if got := read(t, r, err); !bytes.Equal(got, plain) || !r.Encrypted() {
+		t.Fatalf("legacy read of a chunked file = %q", got)
+	}
+
+	whole := seal_legacy(t, plain)
+	r, err = NewLegacyReader(source{bytes.NewReader(whole)}, int64(len(whole)), false, true)
+	if got := read(t, r, err); !bytes.Equal(got, plain) {
+		t.Fatalf("legacy read of a whole-file encrypted file = %q", got)
+	}
+}
@@ -1,113 +1,149 @@
 package fops
 
 import (
-	"bytes"
 	"io"
-	"os"
 
 	"github.com/klauspost/compress/zstd"
 )
 
-func CompressData(data []byte, file *os.File, level int, encrypt bool) error {
-	var compression_lvl zstd.EncoderLevel
-	switch level {
-	case 1:
-		compression_lvl = zstd.SpeedFastest
-	case 2:
-		compression_lvl = zstd.SpeedDefault
-	case 3:
-		compression_lvl = zstd.SpeedBetterCompression
-	case 4:
-		compression_lvl = zstd.SpeedBestCompression
-	default:
-		compression_lvl = zstd.SpeedDefault
-	}
-	opts := []zstd.EOption{zstd.WithEncoderLevel(compression_lvl)}
+// FrameSize is how much plaintext goes into each independently decodable zstd frame.
+const FrameSize = 1 << 20
 
-	enc, err := zstd.NewWriter(file, opts...)
-	if err != nil {
-		return err
-	}
-	defer enc.Close()
+// Index locates the zstd frames of a compressed stream. Frame i holds the plaintext from
+// i*FrameSize on and starts Offsets[i] bytes into the compressed (decrypted) stream.
+type Index struct {
+	Size      int64   `json:"size"`
+	FrameSize int64   `json:"frame_size"`
+	Offsets   []int64 `json:"offsets"`
+}
+
+func (idx *Index) valid() bool {
+	return idx != nil && idx.FrameSize > 0 && len(idx.Offsets) > 0
+}
+
+// frame returns the frame holding the plaintext offset off, the last one for offsets past the end.
+func (idx *Index) frame(off int64) int {
+	return int(min(off/idx.FrameSize, int64(len(idx.Offsets)-1)))
+}
+
+// Writer compresses and/or encrypts everything written to it before it reaches the
+// underlying writer. Data is compressed first, in frames of FrameSize plaintext bytes,
+// and the compressed stream is encrypted in chunks.
+type Writer struct {
+	zw    *zstd.Encoder
+	ew    *EncryptWriter
+	cw    *count_writer
+	w     io.Writer
+	index *Index
+	frame int64
+}
+
+func NewWriter(dst io.Writer, compress bool, level int, encrypt bool) (*Writer, error) {
+	w := &Writer{w: dst}
 
-	var data_enc []byte
 	if encrypt {
-		data_enc, err = Encrypt(data)
+		ew, err := NewEncryptWriter(dst)
 		if err != nil {
-			return err
+			return nil, err
 		}
-	} else {
-		data_enc = data
+		w.ew = ew
+		w.w = ew
 	}
 
-	_, err = enc.Write(data_enc)
-	if err != nil {
-		return err
+	if compress {
+		w.cw = &count_writer{w: w.w}
+		zw, err := zstd.NewWriter(w.cw, zstd.WithEncoderLevel(encoder_level(level)))
+		if err != nil {
+			return nil, err
+		}
+		w.zw = zw
+		w.w = zw
+		w.index = &Index{FrameSize: FrameSize, Offsets: []int64{0}}
 	}
 
-	return nil
+	return w, nil
 }
-func Compress(buf *bytes.Buffer, file *os.File, level int, encrypt bool) error {
-	var compression_lvl zstd.EncoderLevel
-	switch level {
-	case 1:
-		compression_lvl = zstd.SpeedFastest
-	case 2:
-		compression_lvl = zstd.SpeedDefault
-	case 3:
-		compression_lvl = zstd.SpeedBetterCompression
-	case 4:
-		compression_lvl = zstd.SpeedBestCompression
-	default:
-		compression_lvl = zstd.SpeedDefault
-	}
-	opts := []zstd.EOption{zstd.WithEncoderLevel(compression_lvl)}
 
-	enc, err := zstd.NewWriter(file, opts...)
-	if err != nil {
-		return err
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.zw == nil {
+		return w.w.Write(p)
 	}
-	defer enc.Close()
 
-	var data []byte
-	if encrypt {
-		data, err = Encrypt(buf.Bytes())
+	written := 0
+	for len(p) > 0 {
+		if w.frame == FrameSize {
+			if err := w.next_frame(); err != nil {
+				return written, err
+			}
+		}
+
+		take := min(FrameSize-w.frame, int64(len(p)))
+		n, err := w.zw.Write(p[:take])
+		written += n
+		w.frame += int64(n)
+		w.index.Size += int64(n)
 		if err != nil {
-			return err
+			return written, err
 		}
-	} else {
-		data = buf.Bytes()
+		p = p[n:]
 	}
 
-	_, err = enc.Write(data)
-	if err != nil {
+	return written, nil
+}
+
+// next_frame ends the current zstd frame and starts a new one, so decoding can restart there.
+func (w *Writer) next_frame() error {
+	if err := w.zw.Close(); err != nil {
 		return err
 	}
 
+	w.index.Offsets = append(w.index.Offsets, w.cw.n)
+	w.zw.Reset(w.cw)
+	w.frame = 0
 	return nil
 }
 
-func Decompress(fpath string, encrypt bool) ([]byte, error) {
-	file, err := os.Open(fpath)
-	if err != nil {
-		return nil, err
+func (w *Writer) Close() error {
+	if w.zw != nil {
+		if err := w.zw.Close(); err != nil {
+			return err
+		}
 	}
-	defer file.Close()
 
-	zstdReader, err := zstd.NewReader(file)
-	if err != nil {
-		return nil, err
+	if w.ew != nil {
+		return w.ew.Close()
 	}
-	defer zstdReader.Close()
 
-	var buf bytes.Buffer
-	_, err = io.Copy(&buf, zstdReader)
-	if err != nil {
-		return nil, err
-	}
+	return nil
+}
 
-	if encrypt {
-		return Decrypt(buf.Bytes())
+// Index returns the frame index of a compressed stream once the Writer is closed, nil when not compressing.
+func (w *Writer) Index() *Index {
+	return w.index
+}
+
+type count_writer struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *count_writer) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func encoder_level(level int) zstd.EncoderLevel {
+	switch level {
+	case 1:
+		return zstd.SpeedFastest
+	case 2:
+		return zstd.SpeedDefault
+	case 3:
+		return zstd.SpeedBetterCompression
+	case 4:
+		return zstd.SpeedBestCompression
+	default:
+		return zstd.SpeedDefault
 	}
-	return buf.Bytes(), nil
 }
@@ -0,0 +1,223 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const DefaultQuality = 85
+
+// Fit is how an image is brought to both a width and a height.
+const (
+	// Contain scales the image to fit inside the box, keeping its aspect ratio.
+	Contain = "contain"
+	// Cover scales the image to fill the box and crops what sticks out.
+	Cover = "cover"
+	// Fill stretches the image to the box.
+	Fill = "fill"
+)
+
+// ContentTypes are the formats derivatives are encoded to.
+var ContentTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"webp": "image/webp",
+}
+
+var IMGEXT = []string{".jpg", ".jpeg", ".png", ".gif", ".webp"}
+
+// Options is a derivative of an image, a zero Width or Height follows the aspect ratio
+// and an empty Format keeps the source format. Quality only applies to JPEG, PNG and
+// WebP derivatives are lossless.
+type Options struct {
+	Width   int
+	Height  int
+	Fit     string
+	Format  string
+	Quality int
+}
+
+func CheckEXT(fname string) bool {
+	ext := strings.ToLower(path.Ext(fname))
+	for _, e := range IMGEXT {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseOptions reads `width`, `height`, `fit`, `format` and `quality` from the query, ok is
+// false when none of them is set.
+func ParseOptions(query url.Values) (Options, bool, error) {
+	opts := Options{Fit: Contain}
+	ok := false
+	for name, dst := range map[string]*int{"width": &opts.Width, "height": &opts.Height, "quality": &opts.Quality} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		ok = true
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, true, fmt.Errorf("%s must be a positive number", name)
+		}
+		*dst = n
+	}
+
+	if fit := query.Get("fit"); fit != "" {
+		ok = true
+		if fit != Contain && fit != Cover && fit != Fill {
+			return opts, true, errors.New("fit must be contain, cover or fill")
+		}
+		opts.Fit = fit
+	}
+
+	if format := strings.ToLower(query.Get("format")); format != "" {
+		ok = true
+		if format == "jpg" {
+			format = "jpeg"
+		}
+		if ContentTypes[format] == "" {
+			return opts, true, errors.New("format must be jpeg, png or webp")
+		}
+		opts.Format = format
+	}
+
+	if opts.Quality > 100 {
+		return opts, true, errors.New("quality must be at most 100")
+	}
+	if opts.Quality != 0 && opts.Format != "" && opts.Format != "jpeg" {
+		return opts, true, errors.New("quality only applies to jpeg, png and webp are lossless")
+	}
+	return opts, ok, nil
+}
+
+// Lossy reports whether the derivative of the image fname is a JPEG, the only format
+// Quality applies to.
+func (o Options) Lossy(fname string) bool {
+	if o.Format != "" {
+		return o.Format == "jpeg"
+	}
+	ext := strings.ToLower(path.Ext(fname))
+	return ext == ".jpg" || ext == ".jpeg"
+}
+
+// Key identifies the derivative, the same options always give the same key.
+func (o Options) Key() string {
+	return fmt.Sprintf("w=%d&h=%d&fit=%s&format=%s&q=%d", o.Width, o.Height, o.Fit, o.Format, o.Quality)
+}
+
+// Transform decodes an image, resizes it and encodes it in the requested format,
+// returning the content type. Images larger than max_pixels are refused before they are
+// decoded.
+func Transform(data []byte, opts Options, max_pixels int) ([]byte, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width*config.Height > max_pixels {
+		return nil, "", fmt.Errorf("Image is larger than %d pixels", max_pixels)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if opts.Format == "" {
+		opts.Format = format
+	}
+	if opts.Format == "gif" {
+		// only the first frame is resized, it is no animation anymore
+		opts.Format = "png"
+	}
+
+	img = resize(img, opts)
+
+	var out bytes.Buffer
+	if err = encode(&out, img, opts); err != nil {
+		return nil, "", err
+	}
+	return out.Bytes(), ContentTypes[opts.Format], nil
+}
+
+// resize applies the fit, images are never enlarged past their own size.
+func resize(img image.Image, opts Options) image.Image {
+	b := img.Bounds()
+	src_w, src_h := b.Dx(), b.Dy()
+	width, height := opts.Width, opts.Height
+
+	src := b
+	switch {
+	case width == 0 && height == 0:
+		return img
+	case width == 0 || height == 0:
+		// with one side the fit does not matter, the other follows the aspect ratio
+		scale := float64(height) / float64(src_h)
+		if height == 0 {
+			scale = float64(width) / float64(src_w)
+		}
+		scale = min(scale, 1)
+		width, height = max(1, int(float64(src_w)*scale+0.5)), max(1, int(float64(src_h)*scale+0.5))
+	case opts.Fit == Contain:
+		scale := min(float64(width)/float64(src_w), float64(height)/float64(src_h), 1)
+		width, height = max(1, int(float64(src_w)*scale+0.5)), max(1, int(float64(src_h)*scale+0.5))
+	case opts.Fit == Cover:
+		scale := max(float64(width)/float64(src_w), float64(height)/float64(src_h))
+		if scale > 1 {
+			width, height = max(1, int(float64(width)/scale+0.5)), max(1, int(float64(height)/scale+0.5))
+			scale = 1
+		}
+		// the centered part of the source that ends up in the box
+		crop_w, crop_h := min(src_w, int(float64(width)/scale+0.5)), min(src_h, int(float64(height)/scale+0.5))
+		x, y := b.Min.X+(src_w-crop_w)/2, b.Min.Y+(src_h-crop_h)/2
+		src = image.Rect(x, y, x+crop_w, y+crop_h)
+	case opts.Fit == Fill:
+		width, height = min(width, src_w), min(height, src_h)
+	}
+
+	if width == src.Dx() && height == src.Dy() && src == b {
+		return img
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	return dst
+}
+
+func encode(out io.Writer, img image.Image, opts Options) error {
+	switch opts.Format {
+	case "jpeg":
+		quality := opts.Quality
+		if quality == 0 {
+			quality = DefaultQuality
+		}
+		// JPEG has no alpha, transparent parts turn white instead of black
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		return jpeg.Encode(out, flat, &jpeg.Options{Quality: quality})
+	case "png":
+		return png.Encode(out, img)
+	case "webp":
+		return EncodeWebP(out, img)
+	default:
+		return fmt.Errorf("Cannot encode %s images", opts.Format)
+	}
+}
@@ -0,0 +1,53 @@
+package imaging
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseOptionsQuality(t *testing.T) {
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		{query: "quality=75", ok: true},
+		{query: "quality=75&format=jpeg", ok: true},
+		{query: "quality=75&format=jpg", ok: true},
+		{query: "format=png", ok: true},
+		{query: "format=webp&width=64", ok: true},
+		{query: "quality=75&format=png"},
+		{query: "quality=75&format=webp"},
+		{query: "quality=101"},
+	}
+
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		_, _, err := ParseOptions(query)
+		if (err == nil) != tt.ok {
+			t.Fatalf("ParseOptions(%q) = %v, want ok %t", tt.query, err, tt.ok)
+		}
+	}
+}
+
+func TestLossy(t *testing.T) {
+	tests := []struct {
+		opts  Options
+		fname string
+		want  bool
+	}{
+		{Options{}, "/a.jpg", true},
+		{Options{}, "/a.JPEG", true},
+		{Options{}, "/a.png", false},
+		{Options{}, "/a.webp", false},
+		{Options{}, "/a.gif", false},
+		{Options{Format: "jpeg"}, "/a.png", true},
+		{Options{Format: "webp"}, "/a.jpg", false},
+		{Options{Format: "png"}, "/a.jpg", false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.opts.Lossy(tt.fname); got != tt.want {
+			t.Fatalf("%+v.Lossy(%q) = %t, want %t", tt.opts, tt.fname, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"sort"
+)
+
+// the Go image libraries only decode WebP, this writes lossless (VP8L) WebP: the subtract
+// green transform and one set of prefix codes, no backward references or color cache
+
+const vp8lMaxSize = 16384
+
+// the order the code length code lengths are written in
+var codeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+type bit_writer struct {
+	buf  []byte
+	acc  uint64
+	bits uint
+}
+
+// write appends the n low bits of v, least significant first.
+func (w *bit_writer) write(v uint32, n uint) {
+	w.acc |= uint64(v) << w.bits
+	w.bits += n
+	for w.bits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.bits -= 8
+	}
+}
+
+func (w *bit_writer) bytes() []byte {
+	if w.bits > 0 {
+		return append(w.buf, byte(w.acc))
+	}
+	return w.buf
+}
+
+// prefix_code is a Huffman code, codes are stored bit reversed ready to be written.
+type prefix_code struct {
+	lengths []uint8
+	codes   []uint32
+}
+
+func (p *prefix_code) put(w *bit_writer, symbol int) {
+	if p.codes != nil {
+		w.write(p.codes[symbol], uint(p.lengths[symbol]))
+	}
+}
+
+// EncodeWebP writes img as a lossless WebP file, which can be larger than the source.
+func EncodeWebP(out io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 || width > vp8lMaxSize || height > vp8lMaxSize {
+		return errors.New("WebP images must be between 1 and 16384 pixels wide and high")
+	}
+
+	nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(nrgba, nrgba.Bounds(), img, b.Min, draw.Src)
+
+	// subtract green leaves red and blue as differences, which are mostly small
+	alpha := false
+	hist := [4][]int{make([]int, 256+24), make([]int, 256), make([]int, 256), make([]int, 256)}
+	pix := nrgba.Pix
+	for i := 0; i < len(pix); i += 4 {
+		pix[i] -= pix[i+1]
+		pix[i+2] -= pix[i+1]
+		hist[0][pix[i+1]]++
+		hist[1][pix[i]]++
+		hist[2][pix[i+2]]++
+		hist[3][pix[i+3]]++
+		alpha = alpha || pix[i+3] != 0xff
+	}
+
+	w := &bit_writer{}
+	w.write(0x2f, 8)
+	w.write(uint32(width-1), 14)
+	w.write(uint32(height-1), 14)
+	if alpha {
+		w.write(1, 1)
+	} else {
+		w.write(0, 1)
+	}
+	w.write(0, 3)
+
+	// one transform, subtract green (2), then the main image without color cache or meta codes
+	w.write(1, 1)
+	w.write(2, 2)
+	w.write(0, 1)
+	w.write(0, 1)
+	w.write(0, 1)
+
+	var codes [4]*prefix_code
+	for i := range hist {
+		codes[i] = write_prefix_code(w, hist[i])
+	}
+	// distance codes, unused without backward references
+	write_prefix_code(w, make([]int, 40))
+
+	for i := 0; i < len(pix); i += 4 {
+		codes[0].put(w, int(pix[i+1]))
+		codes[1].put(w, int(pix[i]))
+		codes[2].put(w, int(pix[i+2]))
+		codes[3].put(w, int(pix[i+3]))
+	}
+
+	data := w.bytes()
+	chunk_size := len(data)
+	if len(data)%2 == 1 {
+		data = append(data, 0)
+	}
+
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(12+len(data)))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(chunk_size))
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+	_, err := out.Write(data)
+	return err
+}
+
+// write_prefix_code writes the code for the symbol counts, as a simple code when at most
+// two symbols below 256 are used.
+func write_prefix_code(w *bit_writer, counts []int) *prefix_code {
+	var used []int
+	for symbol, count := range counts {
+		if count > 0 {
+			used = append(used, symbol)
+		}
+	}
+	if len(used) == 0 {
+		used = []int{0}
+	}
+
+	code := &prefix_code{lengths: make([]uint8, len(counts))}
+	if len(used) <= 2 && used[len(used)-1] < 256 {
+		// a lone symbol takes no bits, two take one each in the order written
+		w.write(1, 1)
+		w.write(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			w.write(0, 1)
+			w.write(uint32(used[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			w.write(uint32(used[1]), 8)
+			code.lengths[used[0]], code.lengths[used[1]] = 1, 1
+		}
+		code.codes = canonical_codes(code.lengths)
+		return code
+	}
+
+	code.lengths = huffman_lengths(counts, 15)
+	code.codes = canonical_codes(code.lengths)
+
+	// the lengths are written with a code of their own, limited to 7 bits
+	length_counts := make([]int, 19)
+	for _, l := range code.lengths {
+		length_counts[l]++
+	}
+	length_code := &prefix_code{lengths: huffman_lengths(length_counts, 7)}
+	length_code.codes = canonical_codes(length_code.lengths)
+
+	n := 4
+	for i, symbol := range codeLengthOrder {
+		if length_code.lengths[symbol] > 0 {
+			n = max(n, i+1)
+		}
+	}
+
+	w.write(0, 1)
+	w.write(uint32(n-4), 4)
+	for _, symbol := range codeLengthOrder[:n] {
+		w.write(uint32(length_code.lengths[symbol]), 3)
+	}
+	// every symbol's length follows, no max_symbol
+	w.write(0, 1)
+	for _, l := range code.lengths {
+		length_code.put(w, int(l))
+	}
+	return code
+}
+
+// huffman_lengths returns the code length of every symbol, at most limit bits. Rare
+// symbols are counted as more common until the tree is shallow enough.
+func huffman_lengths(counts []int, limit uint8) []uint8 {
+	for count_min := 1; ; count_min *= 2 {
+		lengths := tree_lengths(counts, count_min)
+		deepest := uint8(0)
+		for _, l := range lengths {
+			deepest = max(deepest, l)
+		}
+		if deepest <= limit {
+			return lengths
+		}
+	}
+}
+
+func tree_lengths(counts []int, count_min int) []uint8 {
+	type node struct {
+		weight, symbol, left, right int
+	}
+
+	var nodes []node
+	for symbol, count := range counts {
+		if count > 0 {
+			nodes = append(nodes, node{max(count, count_min), symbol, -1, -1})
+		}
+	}
+
+	lengths := make([]uint8, len(counts))
+	if len(nodes) == 1 {
+		lengths[nodes[0].symbol] = 1
+		return lengths
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].weight < nodes[j].weight })
+
+	// leaves and merged nodes both come out in increasing weight, take the lighter head
+	leaves := len(nodes)
+	next_leaf, next_merged := 0, leaves
+	lightest := func() int {
+		if next_leaf < leaves && (next_merged >= len(nodes) || nodes[next_leaf].weight <= nodes[next_merged].weight) {
+			next_leaf++
+			return next_leaf - 1
+		}
+		next_merged++
+		return next_merged - 1
+	}
+	for len(nodes) < 2*leaves-1 {
+		a, b := lightest(), lightest()
+		nodes = append(nodes, node{nodes[a].weight + nodes[b].weight, -1, a, b})
+	}
+
+	var walk func(i int, depth uint8)
+	walk = func(i int, depth uint8) {
+		if nodes[i].left < 0 {
+			lengths[nodes[i].symbol] = depth
+			return
+		}
+		walk(nodes[i].left, depth+1)
+		walk(nodes[i].right, depth+1)
+	}
+	walk(len(nodes)-1, 0)
+	return lengths
+}
+
+// canonical_codes assigns codes in order of length then symbol. A lone symbol is decoded
+// without reading any bits whatever its length, so it has no codes.
+func canonical_codes(lengths []uint8) []uint32 {
+	var count [16]uint32
+	used := 0
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+			used++
+		}
+	}
+	if used <= 1 {
+		return nil
+	}
+
+	codes := make([]uint32, len(lengths))
+
+	var next [16]uint32
+	code := uint32(0)
+	for bits := 1; bits < 16; bits++ {
+		code = (code + count[bits-1]) << 1
+		next[bits] = code
+	}
+
+	for symbol, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		codes[symbol] = reverse_bits(next[l], l)
+		next[l]++
+	}
+	return codes
+}
+
+func reverse_bits(code uint32, n uint8) uint32 {
+	reversed := uint32(0)
+	for i := uint8(0); i < n; i++ {
+		reversed = reversed<<1 | code&1
+		code >>= 1
+	}
+	return reversed
+}
@@ -0,0 +1,96 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func to_nrgba(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, b.Min, draw.Src)
+	return nrgba
+}
+
+func noise(w, h int, alpha bool) *image.NRGBA {
+	rng := rand.New(rand.NewSource(int64(w*h + 1)))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	rng.Read(img.Pix)
+	if !alpha {
+		for i := 3; i < len(img.Pix); i += 4 {
+			img.Pix[i] = 0xff
+		}
+	}
+	return img
+}
+
+func gradient(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 255 / w), G: uint8(y * 255 / h), B: 128, A: uint8((x + y) * 255 / (w + h))})
+		}
+	}
+	return img
+}
+
+func uniform(w, h int, c color.Color) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestEncodeWebPRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{name: "1x1", img: noise(1, 1, false)},
+		{name: "1x1 transparent", img: uniform(1, 1, color.Transparent)},
+		{name: "odd", img: noise(3, 5, false)},
+		{name: "odd wide", img: noise(101, 7, false)},
+		{name: "odd tall", img: noise(9, 77, false)},
+		{name: "alpha noise", img: noise(33, 17, true)},
+		{name: "alpha gradient", img: gradient(64, 31)},
+		{name: "uniform", img: uniform(16, 16, color.NRGBA{R: 200, G: 100, B: 50, A: 255})},
+		{name: "uniform white", img: uniform(7, 3, color.White)},
+		{name: "gray", img: image.NewGray(image.Rect(0, 0, 5, 5))},
+		{name: "offset bounds", img: noise(20, 20, true).SubImage(image.Rect(3, 5, 16, 18))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeWebP(&buf, tt.img); err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := webp.Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("decoding the encoded image: %v", err)
+			}
+
+			want, got := to_nrgba(tt.img), to_nrgba(decoded)
+			if got.Rect != want.Rect {
+				t.Fatalf("size = %v, want %v", got.Rect, want.Rect)
+			}
+			if !bytes.Equal(got.Pix, want.Pix) {
+				t.Fatal("decoded pixels differ, WebP output is not lossless")
+			}
+		})
+	}
+}
+
+func TestEncodeWebPSize(t *testing.T) {
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 0, 1), image.Rect(0, 0, vp8lMaxSize+1, 1)} {
+		if err := EncodeWebP(&bytes.Buffer{}, image.NewNRGBA(r)); err == nil {
+			t.Fatalf("encoding a %v image succeeded", r)
+		}
+	}
+}
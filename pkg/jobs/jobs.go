@@ -0,0 +1,292 @@
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Status string
+
+const (
+	Queued  Status = "queued"
+	Running Status = "running"
+	Failed  Status = "failed"
+	Done    Status = "done"
+	// Partial jobs finished but only some of their outputs were made.
+	Partial Status = "partial"
+)
+
+// Finished jobs are kept this long so clients polling for them still get an answer.
+const Retention = 7 * 24 * time.Hour
+
+// progress is written to disk at most this often, the in-memory copy is always current
+const saveInterval = 2 * time.Second
+
+type Job struct {
+	ID       string            `json:"id"`
+	Status   Status            `json:"status"`
+	Progress float64           `json:"progress"`
+	Error    string            `json:"error,omitempty"`
+	Key      string            `json:"file_path"`
+	Access   string            `json:"access"`
+	Input    string            `json:"input"`
+	Result   map[string]string `json:"result,omitempty"`
+	Created  time.Time         `json:"created"`
+	Started  time.Time         `json:"started,omitempty"`
+	Finished time.Time         `json:"finished,omitempty"`
+
+	saved time.Time
+}
+
+// Runner does the work of a job, reporting progress between 0 and 1.
+type Runner func(job *Job, progress func(float64)) error
+
+// PartialError is returned by a Runner that made only some of the outputs, Result
+// replaces the job's so it only lists what exists.
+type PartialError struct {
+	Err    error
+	Result map[string]string
+}
+
+func (e *PartialError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// Queue runs jobs on a fixed number of workers. Every job is persisted as `<dir>/<id>.json`
+// and its files live in `<dir>/<id>/`, so jobs that were queued or running when the
+// process stopped are run again on the next start.
+type Queue struct {
+	dir     string
+	run     Runner
+	mu      sync.Mutex
+	cond    *sync.Cond
+	jobs    map[string]*Job
+	pending []string
+}
+
+func NewQueue(dir string, workers int, run Runner) (*Queue, error) {
+	if workers < 1 {
+		return nil, errors.New("at least one worker is required")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		dir:  dir,
+		run:  run,
+		jobs: make(map[string]*Job),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+
+	return q, nil
+}
+
+// NewID returns an id for a job whose files are written before it is submitted.
+func NewID() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// JobDir is where the files of job id belong, removed once the job finishes.
+func (q *Queue) JobDir(id string) string {
+	return filepath.Join(q.dir, id)
+}
+
+func (q *Queue) Submit(job *Job) error {
+	if job.ID == "" {
+		id, err := NewID()
+		if err != nil {
+			return err
+		}
+		job.ID = id
+	}
+
+	job.Status = Queued
+	job.Created = time.Now().UTC()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.save(job); err != nil {
+		return err
+	}
+
+	q.jobs[job.ID] = job
+	q.pending = append(q.pending, job.ID)
+	q.cond.Signal()
+	return nil
+}
+
+// Get returns a snapshot of the job.
+func (q *Queue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+func (q *Queue) worker() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 {
+			q.cond.Wait()
+		}
+		job := q.jobs[q.pending[0]]
+		q.pending = q.pending[1:]
+
+		job.Status = Running
+		job.Progress = 0
+		job.Started = time.Now().UTC()
+		q.save_log(job)
+		q.mu.Unlock()
+
+		log.Printf("Running job %s for %s\n", job.ID, job.Key)
+		err := q.run(job, func(p float64) { q.progress(job, p) })
+
+		q.mu.Lock()
+		job.Finished = time.Now().UTC()
+		var partial *PartialError
+		if errors.As(err, &partial) {
+			log.Printf("Job %s partly failed: %v\n", job.ID, err)
+			job.Status = Partial
+			job.Error = err.Error()
+			job.Result = partial.Result
+			job.Progress = 1
+		} else if err != nil {
+			log.Printf("Job %s failed: %v\n", job.ID, err)
+			job.Status = Failed
+			job.Error = err.Error()
+		} else {
+			log.Printf("Job %s done\n", job.ID)
+			job.Status = Done
+			job.Progress = 1
+		}
+		q.save_log(job)
+		q.prune()
+		q.mu.Unlock()
+
+		if err := os.RemoveAll(q.JobDir(job.ID)); err != nil {
+			log.Printf("Error removing files of job %s: %v\n", job.ID, err)
+		}
+	}
+}
+
+func (q *Queue) progress(job *Job, p float64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job.Progress = min(max(p, 0), 1)
+	if time.Since(job.saved) >= saveInterval {
+		q.save_log(job)
+	}
+}
+
+// load reads persisted jobs, queueing again the ones that never finished.
+func (q *Queue) load() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+
+	var unfinished []*Job
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(q.dir, e.Name()))
+		if err != nil {
+			return err
+		}
+
+		job := &Job{}
+		if err = json.Unmarshal(data, job); err != nil {
+			log.Printf("Skipping unreadable job %s: %v\n", e.Name(), err)
+			continue
+		}
+
+		q.jobs[job.ID] = job
+		if job.Status == Queued || job.Status == Running {
+			unfinished = append(unfinished, job)
+		}
+	}
+
+	// oldest first, like they were submitted
+	sort.Slice(unfinished, func(i, j int) bool { return unfinished[i].Created.Before(unfinished[j].Created) })
+	for _, job := range unfinished {
+		log.Printf("Resuming job %s for %s\n", job.ID, job.Key)
+		job.Status = Queued
+		job.Progress = 0
+		q.pending = append(q.pending, job.ID)
+	}
+
+	q.prune()
+	return nil
+}
+
+// prune forgets finished jobs older than Retention, q.mu must be held.
+func (q *Queue) prune() {
+	for id, job := range q.jobs {
+		if (job.Status == Done || job.Status == Failed || job.Status == Partial) && time.Since(job.Finished) > Retention {
+			delete(q.jobs, id)
+			_ = os.Remove(filepath.Join(q.dir, id+".json"))
+			_ = os.RemoveAll(q.JobDir(id))
+		}
+	}
+}
+
+// save writes the job atomically, q.mu must be held.
+func (q *Queue) save(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	fpath := filepath.Join(q.dir, job.ID+".json")
+	tmp := fpath + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, fpath); err != nil {
+		return err
+	}
+
+	job.saved = time.Now()
+	return nil
+}
+
+func (q *Queue) save_log(job *Job) {
+	if err := q.save(job); err != nil {
+		log.Printf("Error saving job %s: %v\n", job.ID, err)
+	}
+}
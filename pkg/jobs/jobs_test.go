@@ -0,0 +1,222 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// wait polls until ok holds, workers finish jobs asynchronously.
+func wait(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func wait_status(t *testing.T, q *Queue, id string, status Status) Job {
+	t.Helper()
+
+	var job Job
+	wait(t, "job "+id+" to be "+string(status), func() bool {
+		job, _ = q.Get(id)
+		return job.Status == status
+	})
+	return job
+}
+
+func write_job(t *testing.T, dir string, job *Job) {
+	t.Helper()
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, job.ID+".json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// unstarted returns a Queue over dir without workers, so what load queues stays pending.
+func unstarted(dir string) *Queue {
+	q := &Queue{dir: dir, jobs: make(map[string]*Job)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func TestSubmitGet(t *testing.T) {
+	release := make(chan struct{})
+	q, err := NewQueue(t.TempDir(), 1, func(job *Job, progress func(float64)) error {
+		<-release
+		job.Result = map[string]string{"out": "done"}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := &Job{Key: "a.mp4", Access: "private", Input: "in.mp4"}
+	if err = q.Submit(job); err != nil {
+		t.Fatal(err)
+	}
+	if job.ID == "" {
+		t.Fatal("Submit did not assign an id")
+	}
+
+	got, ok := q.Get(job.ID)
+	if !ok || got.Key != "a.mp4" || (got.Status != Queued && got.Status != Running) || got.Created.IsZero() {
+		t.Fatalf("Get after Submit = %+v, %t", got, ok)
+	}
+	if _, err = os.Stat(filepath.Join(q.dir, job.ID+".json")); err != nil {
+		t.Fatalf("submitted job was not saved: %v", err)
+	}
+
+	close(release)
+	got = wait_status(t, q, job.ID, Done)
+	if got.Progress != 1 || got.Result["out"] != "done" || got.Finished.IsZero() {
+		t.Fatalf("finished job = %+v", got)
+	}
+
+	if _, ok = q.Get("missing"); ok {
+		t.Fatal("Get of an unknown id succeeded")
+	}
+}
+
+func TestLoadRequeues(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UTC()
+	write_job(t, dir, &Job{ID: "newest", Status: Queued, Created: now})
+	write_job(t, dir, &Job{ID: "oldest", Status: Running, Progress: 0.5, Created: now.Add(-2 * time.Hour)})
+	write_job(t, dir, &Job{ID: "middle", Status: Queued, Created: now.Add(-time.Hour)})
+	write_job(t, dir, &Job{ID: "done", Status: Done, Created: now.Add(-3 * time.Hour), Finished: now})
+
+	q := unstarted(dir)
+	if err := q.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(q.pending, " "); got != "oldest middle newest" {
+		t.Fatalf("pending = %q, want oldest first", got)
+	}
+	if job := q.jobs["oldest"]; job.Status != Queued || job.Progress != 0 {
+		t.Fatalf("requeued running job = %+v", job)
+	}
+	if job, ok := q.jobs["done"]; !ok || job.Status != Done {
+		t.Fatalf("finished job after load = %+v, %t", job, ok)
+	}
+}
+
+func TestLoadSkipsCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	write_job(t, dir, &Job{ID: "good", Status: Queued, Created: time.Now().UTC()})
+	if err := os.WriteFile(filepath.Join(dir, "bad.json"), []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	q := unstarted(dir)
+	if err := q.load(); err != nil {
+		t.Fatalf("load with a corrupt job = %v", err)
+	}
+	if len(q.jobs) != 1 || strings.Join(q.pending, " ") != "good" {
+		t.Fatalf("jobs after load = %v, pending %v", q.jobs, q.pending)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().UTC().Add(-Retention - time.Hour)
+	write_job(t, dir, &Job{ID: "expired", Status: Done, Created: old, Finished: old})
+	write_job(t, dir, &Job{ID: "expired-failed", Status: Failed, Created: old, Finished: old})
+	write_job(t, dir, &Job{ID: "recent", Status: Partial, Created: old, Finished: time.Now().UTC()})
+	for _, id := range []string{"expired", "recent"} {
+		if err := os.MkdirAll(filepath.Join(dir, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := unstarted(dir)
+	if err := q.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"expired", "expired-failed"} {
+		if _, ok := q.jobs[id]; ok {
+			t.Fatalf("job %s older than Retention was kept", id)
+		}
+		if _, err := os.Stat(filepath.Join(dir, id+".json")); !os.IsNotExist(err) {
+			t.Fatalf("file of pruned job %s = %v", id, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "expired")); !os.IsNotExist(err) {
+		t.Fatalf("directory of pruned job = %v", err)
+	}
+
+	if _, ok := q.jobs["recent"]; !ok {
+		t.Fatal("recently finished job was pruned")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "recent")); err != nil {
+		t.Fatalf("directory of a kept job = %v", err)
+	}
+}
+
+func TestPartialError(t *testing.T) {
+	q, err := NewQueue(t.TempDir(), 1, func(job *Job, progress func(float64)) error {
+		job.Result = map[string]string{"720p": "a", "1080p": "b"}
+		return &PartialError{Err: errors.New("1080p failed"), Result: map[string]string{"720p": "a"}}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := &Job{Key: "a.mp4"}
+	if err = q.Submit(job); err != nil {
+		t.Fatal(err)
+	}
+
+	got := wait_status(t, q, job.ID, Partial)
+	if got.Error != "1080p failed" || got.Progress != 1 || len(got.Result) != 1 || got.Result["720p"] != "a" {
+		t.Fatalf("partial job = %+v", got)
+	}
+}
+
+func TestJobDirRemoved(t *testing.T) {
+	for name, run_err := range map[string]error{"done": nil, "failed": errors.New("boom")} {
+		t.Run(name, func(t *testing.T) {
+			q, err := NewQueue(t.TempDir(), 1, func(job *Job, progress func(float64)) error {
+				return run_err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id, err := NewID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = os.MkdirAll(q.JobDir(id), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err = os.WriteFile(filepath.Join(q.JobDir(id), "input"), []byte("data"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = q.Submit(&Job{ID: id}); err != nil {
+				t.Fatal(err)
+			}
+			wait(t, "the job directory to be removed", func() bool {
+				_, err := os.Stat(q.JobDir(id))
+				return os.IsNotExist(err)
+			})
+		})
+	}
+}
@@ -20,6 +20,12 @@ func Start(conf_file string) {
 	}
 	bstore.Print()
 
+	if bstore.Streaming.Enabled {
+		if err = bstore.StartJobs(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
 	bstore.Cors(r)
@@ -53,8 +59,41 @@ func Start(conf_file string) {
 	r.Use(bstore.Serve())
 	r.PUT("/api/upload/*file_path", bstore.Upload)
 	r.GET("/api/download/*file_path", bstore.Get)
+	r.HEAD("/api/download/*file_path", bstore.Get)
+	r.GET("/api/stat/*file_path", bstore.Stat)
+	r.GET("/api/presign/*file_path", bstore.Presign)
 	r.DELETE("/api/delete/*file_path", bstore.Delete)
 	r.GET("/api/list/*file_path", bstore.List)
+	r.GET("/api/jobs/:id", bstore.GetJob)
+	r.GET(bs.StreamRoute+"/*stream_path", bstore.ServeStream)
+	r.HEAD(bs.StreamRoute+"/*stream_path", bstore.ServeStream)
+
+	if bstore.Multipart.Enabled {
+		r.POST("/api/multipart/*file_path", bstore.MultipartPost)
+		r.PUT("/api/multipart/*file_path", bstore.MultipartUpload)
+		r.GET("/api/multipart/*file_path", bstore.MultipartList)
+		r.DELETE("/api/multipart/*file_path", bstore.MultipartAbort)
+	}
+
+	if bstore.Tus.Enabled {
+		r.OPTIONS("/api/tus/*file_path", bstore.TusOptions)
+		r.POST("/api/tus/*file_path", bstore.TusCreate)
+		r.HEAD("/api/tus/*file_path", bstore.TusHead)
+		r.PATCH("/api/tus/*file_path", bstore.TusPatch)
+		r.DELETE("/api/tus/*file_path", bstore.TusDelete)
+	}
+
+	if bstore.Multipart.Enabled || bstore.Tus.Enabled {
+		go bstore.MultipartGC()
+	}
+
+	if bstore.Images.Enabled {
+		go bstore.ImagesGC()
+	}
+
+	if bstore.S3.Enabled {
+		r.Any(bstore.S3.Prefix+"/*s3_path", bstore.S3Api)
+	}
 
 	r.Run(bstore.Host)
 }
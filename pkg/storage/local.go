@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Local keeps objects as files below Root, mirroring their keys.
+type Local struct {
+	Root string
+}
+
+func NewLocal(root string) *Local {
+	return &Local{Root: root}
+}
+
+// Path maps a key to its file, refusing keys that would resolve outside Root.
+func (l *Local) Path(key string) (string, error) {
+	fpath := filepath.Join(l.Root, filepath.FromSlash(clean(key)))
+
+	rel, err := filepath.Rel(l.Root, fpath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("key escapes the storage root")
+	}
+
+	return fpath, nil
+}
+
+func (l *Local) Put(key string, r io.Reader) (Info, error) {
+	fpath, err := l.Path(key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+		return Info{}, err
+	}
+
+	// written next to the target and renamed over it, readers never see a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(fpath), "."+filepath.Base(fpath)+".*.tmp")
+	if err != nil {
+		return Info{}, err
+	}
+
+	n, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	var info Info
+	if err == nil {
+		info, err = l.version(tmp.Name(), fpath)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fpath)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return Info{Size: n}, err
+	}
+
+	info.Key = clean(key)
+	return info, nil
+}
+
+// version stats the file written at tmp, moving its mtime past that of the file it
+// replaces when the filesystem clock is too coarse to tell them apart.
+func (l *Local) version(tmp, fpath string) (Info, error) {
+	info, err := l.stat(os.Stat(tmp))
+	if err != nil {
+		return Info{}, err
+	}
+
+	old, err := os.Stat(fpath)
+	if err != nil || old.ModTime().Before(info.ModTime) {
+		return info, nil
+	}
+
+	// filesystems truncate mtimes to their own precision, the second step suits the coarsest
+	for _, step := range []time.Duration{time.Microsecond, time.Second} {
+		mod := old.ModTime().Add(step)
+		if err = os.Chtimes(tmp, mod, mod); err != nil {
+			return Info{}, err
+		}
+		if info, err = l.stat(os.Stat(tmp)); err != nil || old.ModTime().Before(info.ModTime) {
+			return info, err
+		}
+	}
+	return Info{}, errors.New("cannot give the replacing file a later mtime")
+}
+
+func (l *Local) Get(key string) (File, Info, error) {
+	fpath, err := l.Path(key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+
+	file, err := os.Open(fpath)
+	if err != nil {
+		return nil, Info{}, not_exist(err)
+	}
+
+	info, err := l.stat(file.Stat())
+	if err != nil {
+		file.Close()
+		return nil, Info{}, err
+	}
+	info.Key = clean(key)
+
+	return file, info, nil
+}
+
+func (l *Local) Stat(key string) (Info, error) {
+	fpath, err := l.Path(key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	info, err := l.stat(os.Stat(fpath))
+	info.Key = clean(key)
+	return info, err
+}
+
+func (l *Local) stat(fi fs.FileInfo, err error) (Info, error) {
+	if err != nil {
+		return Info{}, not_exist(err)
+	}
+	if fi.IsDir() {
+		return Info{}, ErrNotExist
+	}
+
+	return Info{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (l *Local) Delete(key string) error {
+	fpath, err := l.Path(key)
+	if err != nil {
+		return err
+	}
+
+	return not_exist(os.Remove(fpath))
+}
+
+func (l *Local) DeletePrefix(prefix string) error {
+	dpath, err := l.Path(prefix)
+	if err != nil {
+		return err
+	}
+
+	// a directory left without objects does not exist, as it would not in Memory
+	if _, err = l.List(prefix); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(dpath)
+}
+
+func (l *Local) List(prefix string) ([]Info, error) {
+	dpath, err := l.Path(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(dpath)
+	if err != nil {
+		return nil, not_exist(err)
+	}
+	if !fi.IsDir() {
+		return nil, ErrNotDir
+	}
+
+	var infos []Info
+	err = filepath.WalkDir(dpath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(d.Name(), ".tmp") {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(l.Root, path)
+		if err != nil {
+			return err
+		}
+
+		infos = append(infos, Info{Key: filepath.ToSlash(rel), Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(infos) == 0 && clean(prefix) != "" {
+		return nil, ErrNotExist
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+func not_exist(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotExist
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps objects in a map, for tests and throwaway servers.
+type Memory struct {
+	mu      sync.RWMutex
+	objects map[string]memObject
+}
+
+type memObject struct {
+	data []byte
+	mod  time.Time
+}
+
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() error {
+	return nil
+}
+
+func NewMemory() *Memory {
+	return &Memory{objects: make(map[string]memObject)}
+}
+
+func (m *Memory) Put(key string, r io.Reader) (Info, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Info{Size: int64(len(data))}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mod := time.Now()
+	if old, ok := m.objects[clean(key)]; ok && !old.mod.Before(mod) {
+		mod = old.mod.Add(time.Nanosecond)
+	}
+	m.objects[clean(key)] = memObject{data: data, mod: mod}
+	return Info{Key: clean(key), Size: int64(len(data)), ModTime: mod}, nil
+}
+
+func (m *Memory) Get(key string) (File, Info, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.objects[clean(key)]
+	if !ok {
+		return nil, Info{}, ErrNotExist
+	}
+
+	return memFile{bytes.NewReader(obj.data)}, Info{Key: clean(key), Size: int64(len(obj.data)), ModTime: obj.mod}, nil
+}
+
+func (m *Memory) Stat(key string) (Info, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.objects[clean(key)]
+	if !ok {
+		return Info{}, ErrNotExist
+	}
+
+	return Info{Key: clean(key), Size: int64(len(obj.data)), ModTime: obj.mod}, nil
+}
+
+func (m *Memory) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.objects[clean(key)]; !ok {
+		return ErrNotExist
+	}
+	delete(m.objects, clean(key))
+	return nil
+}
+
+func (m *Memory) DeletePrefix(prefix string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefix = dir_prefix(prefix)
+	found := false
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			delete(m.objects, key)
+			found = true
+		}
+	}
+
+	if !found {
+		return m.missing(prefix)
+	}
+	return nil
+}
+
+func (m *Memory) List(prefix string) ([]Info, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	prefix = dir_prefix(prefix)
+	var infos []Info
+	for key, obj := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, Info{Key: key, Size: int64(len(obj.data)), ModTime: obj.mod})
+		}
+	}
+
+	if len(infos) == 0 && prefix != "" {
+		return nil, m.missing(prefix)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// missing is the error for a directory prefix without objects, ErrNotDir when an object
+// has its name.
+func (m *Memory) missing(prefix string) error {
+	if _, ok := m.objects[clean(prefix)]; ok {
+		return ErrNotDir
+	}
+	return ErrNotExist
+}
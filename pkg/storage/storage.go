@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotExist = errors.New("object does not exist")
+	ErrNotDir   = errors.New("prefix is not a directory")
+)
+
+// File is a stored object opened for reading. Random access is required so encrypted
+// objects can be decrypted chunk by chunk and compressed ones rewound.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend stores opaque blobs under slash separated keys. Keys are what bstore writes,
+// including suffixes such as `.zst`; objects are never partially visible, Put either
+// stores all of r or nothing.
+type Backend interface {
+	// Put returns the Info of the stored object, its ModTime is always later than that of
+	// the object it replaced so Size and ModTime together identify this version.
+	Put(key string, r io.Reader) (Info, error)
+	Get(key string) (File, Info, error)
+	Stat(key string) (Info, error)
+	Delete(key string) error
+	// DeletePrefix removes every object below the directory prefix.
+	DeletePrefix(prefix string) error
+	// List returns every object below the directory prefix, recursively and sorted by key.
+	// A prefix without objects is ErrNotExist, one naming an object ErrNotDir.
+	List(prefix string) ([]Info, error)
+}
+
+func clean(key string) string {
+	return strings.Trim(key, "/")
+}
+
+func dir_prefix(prefix string) string {
+	prefix = clean(prefix)
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
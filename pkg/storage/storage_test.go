@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// backends are every Backend, each test runs against all of them so they behave the same.
+func backends(t *testing.T) map[string]Backend {
+	return map[string]Backend{
+		"local":  NewLocal(t.TempDir()),
+		"memory": NewMemory(),
+	}
+}
+
+func put(t *testing.T, b Backend, key, data string) {
+	t.Helper()
+	info, err := b.Put(key, strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Put(%q) = %v", key, err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Fatalf("Put(%q) wrote %d bytes, want %d", key, info.Size, len(data))
+	}
+}
+
+func get(t *testing.T, b Backend, key string) string {
+	t.Helper()
+	file, info, err := b.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q) = %v", key, err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Fatalf("Get(%q) size = %d, read %d bytes", key, info.Size, len(data))
+	}
+	return string(data)
+}
+
+func keys(infos []Info) string {
+	var ks []string
+	for _, info := range infos {
+		ks = append(ks, info.Key)
+	}
+	return strings.Join(ks, " ")
+}
+
+func TestPutGet(t *testing.T) {
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			put(t, b, "/a/b.txt", "hello")
+			if got := get(t, b, "a/b.txt"); got != "hello" {
+				t.Fatalf("Get = %q, want hello", got)
+			}
+
+			put(t, b, "a/b.txt", "replaced")
+			if got := get(t, b, "/a/b.txt"); got != "replaced" {
+				t.Fatalf("Get after overwrite = %q", got)
+			}
+
+			file, _, err := b.Get("a/b.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 3)
+			if _, err = file.ReadAt(buf, 2); err != nil || string(buf) != "pla" {
+				t.Fatalf("ReadAt = %q, %v", buf, err)
+			}
+			if _, err = file.Seek(-2, io.SeekEnd); err != nil {
+				t.Fatal(err)
+			}
+			rest, _ := io.ReadAll(file)
+			file.Close()
+			if string(rest) != "ed" {
+				t.Fatalf("read after Seek = %q", rest)
+			}
+
+			put(t, b, "empty", "")
+			if got := get(t, b, "empty"); got != "" {
+				t.Fatalf("Get of an empty object = %q", got)
+			}
+
+			if _, _, err = b.Get("missing"); !errors.Is(err, ErrNotExist) {
+				t.Fatalf("Get of a missing key = %v, want ErrNotExist", err)
+			}
+			if _, _, err = b.Get("a"); !errors.Is(err, ErrNotExist) {
+				t.Fatalf("Get of a directory = %v, want ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestPutVersion(t *testing.T) {
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			var last Info
+			for i := 0; i < 5; i++ {
+				info, err := b.Put("/a.txt", strings.NewReader("same"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Key != "a.txt" || info.Size != 4 {
+					t.Fatalf("Put = %+v", info)
+				}
+				if !last.ModTime.Before(info.ModTime) {
+					t.Fatalf("Put %d ModTime = %v, not after the replaced %v", i, info.ModTime, last.ModTime)
+				}
+				last = info
+
+				file, got, err := b.Get("a.txt")
+				if err != nil {
+					t.Fatal(err)
+				}
+				file.Close()
+				if !got.ModTime.Equal(info.ModTime) || got.Size != info.Size {
+					t.Fatalf("Get = %+v, Put returned %+v", got, info)
+				}
+			}
+		})
+	}
+}
+
+type failing_reader struct{}
+
+func (failing_reader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestPutFailure(t *testing.T) {
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			put(t, b, "a.txt", "kept")
+
+			r := io.MultiReader(strings.NewReader("partial"), failing_reader{})
+			if _, err := b.Put("a.txt", r); err == nil {
+				t.Fatal("Put from a failing reader succeeded")
+			}
+			if got := get(t, b, "a.txt"); got != "kept" {
+				t.Fatalf("object after a failed Put = %q, want it untouched", got)
+			}
+
+			if _, err := b.Put("new.txt", io.MultiReader(strings.NewReader("partial"), failing_reader{})); err == nil {
+				t.Fatal("Put from a failing reader succeeded")
+			}
+			if _, err := b.Stat("new.txt"); !errors.Is(err, ErrNotExist) {
+				t.Fatalf("Stat after a failed Put = %v, want ErrNotExist", err)
+			}
+			if infos, err := b.List(""); err != nil || keys(infos) != "a.txt" {
+				t.Fatalf("List after a failed Put = %q, %v", keys(infos), err)
+			}
+		})
+	}
+}
+
+func TestStat(t *testing.T) {
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			put(t, b, "dir/a.txt", "12345")
+
+			info, err := b.Stat("/dir/a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Key != "dir/a.txt" || info.Size != 5 || info.ModTime.IsZero() {
+				t.Fatalf("Stat = %+v", info)
+			}
+
+			for _, key := range []string{"missing", "dir", "dir/"} {
+				if _, err = b.Stat(key); !errors.Is(err, ErrNotExist) {
+					t.Fatalf("Stat(%q) = %v, want ErrNotExist", key, err)
+				}
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			if infos, err := b.List(""); err != nil || len(infos) != 0 {
+				t.Fatalf("List of an empty root = %q, %v", keys(infos), err)
+			}
+
+			put(t, b, "a.txt", "1")
+			put(t, b, "a/c.txt", "22")
+			put(t, b, "a/b/d.txt", "333")
+			put(t, b, "ab.txt", "4444")
+
+			infos, err := b.List("")
+			if err != nil || keys(infos) != "a.txt a/b/d.txt a/c.txt ab.txt" {
+				t.Fatalf("List of the root = %q, %v", keys(infos), err)
+			}
+
+			infos, err = b.List("/a/")
+			if err != nil || keys(infos) != "a/b/d.txt a/c.txt" {
+				t.Fatalf("List(a) = %q, %v", keys(infos), err)
+			}
+			if infos[0].Size != 3 || infos[0].ModTime.IsZero() {
+				t.Fatalf("List info = %+v", infos[0])
+			}
+
+			if _, err = b.List("missing"); !errors.Is(err, ErrNotExist) {
+				t.Fatalf("List of a missing prefix = %v, want ErrNotExist", err)
+			}
+			if _, err = b.List("a.txt"); !errors.Is(err, ErrNotDir) {
+				t.Fatalf("List of an object = %v, want ErrNotDir", err)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			put(t, b, "a/b.txt", "1")
+			put(t, b, "a/c.txt", "2")
+
+			if err := b.Delete("/a/b.txt"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.Stat("a/b.txt"); !errors.Is(err, ErrNotExist) {
+				t.Fatalf("Stat after Delete = %v, want ErrNotExist", err)
+			}
+			if err := b.Delete("a/b.txt"); !errors.Is(err, ErrNotExist) {
+				t.Fatalf("second Delete = %v, want ErrNotExist", err)
+			}
+
+			if err := b.Delete("a/c.txt"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.List("a"); !errors.Is(err, ErrNotExist) {
+				t.Fatalf("List of a prefix without objects = %v, want ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			put(t, b, "a/b.txt", "1")
+			put(t, b, "a/b/c.txt", "2")
+			put(t, b, "ab.txt", "3")
+
+			if err := b.DeletePrefix("/a/"); err != nil {
+				t.Fatal(err)
+			}
+			if infos, err := b.List(""); err != nil || keys(infos) != "ab.txt" {
+				t.Fatalf("List after DeletePrefix = %q, %v", keys(infos), err)
+			}
+
+			if err := b.DeletePrefix("a"); !errors.Is(err, ErrNotExist) {
+				t.Fatalf("second DeletePrefix = %v, want ErrNotExist", err)
+			}
+			if err := b.DeletePrefix("ab.txt"); !errors.Is(err, ErrNotDir) {
+				t.Fatalf("DeletePrefix of an object = %v, want ErrNotDir", err)
+			}
+			if _, err := b.Stat("ab.txt"); err != nil {
+				t.Fatalf("object named by a refused DeletePrefix = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// languages go into ffmpeg's var_stream_map, which splits on spaces, commas and colons
+var validLanguage = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]{0,15}$`)
+
+// IsLanguage reports whether lang can tag a track, e.g. `en`, `fra` or `pt-BR`.
+func IsLanguage(lang string) bool {
+	return validLanguage.MatchString(lang)
+}
+
+// defaultAudio is the track players start with, the one flagged default or the first.
+func defaultAudio(tracks []Track) int {
+	for i, track := range tracks {
+		if track.Default {
+			return i
+		}
+	}
+	return 0
+}
+
+// audio_label is what players list the track as, its title or its language and layout.
+func audio_label(i int, track Track) string {
+	if track.Title != "" {
+		return track.Title
+	}
+
+	label := fmt.Sprintf("Track %d", i+1)
+	if track.Language != "" && track.Language != "und" {
+		label = track.Language
+	}
+	if track.ChannelLayout != "" {
+		label += " (" + track.ChannelLayout + ")"
+	}
+	return label
+}
+
+// label_audio names the audio renditions ffmpeg wrote to the manifests in output_dir.
+// ffmpeg cannot write these itself: adaptation set descriptors stop at the first `>` and
+// var_stream_map names may not hold spaces. Tracks whose rendition is not found are an
+// error, so a change in ffmpeg's output shows up in the log instead of going unnoticed.
+func label_audio(output_dir string, tracks []Track) error {
+	if len(tracks) == 0 {
+		return nil
+	}
+
+	return patch_manifests(output_dir, map[int]func([]byte) ([]byte, error){
+		DASH: func(mpd []byte) ([]byte, error) { return audioMPD(mpd, tracks) },
+		HLS:  func(master []byte) ([]byte, error) { return audioMaster(master, tracks) },
+	})
+}
+
+var (
+	adaptationSetTag = regexp.MustCompile(`<AdaptationSet\s[^>]*>`)
+	adaptationSetID  = regexp.MustCompile(`\sid="(\d+)"`)
+	labelTag         = regexp.MustCompile(`^\s*<Label>`)
+)
+
+// audioMPD adds a Label to the adaptation set of every audio track, `id=1` onwards,
+// right after its opening tag where the schema expects it.
+func audioMPD(mpd []byte, tracks []Track) ([]byte, error) {
+	found := make([]bool, len(tracks))
+
+	var out []byte
+	last := 0
+	for _, loc := range adaptationSetTag.FindAllIndex(mpd, -1) {
+		m := adaptationSetID.FindSubmatch(mpd[loc[0]:loc[1]])
+		if m == nil {
+			continue
+		}
+		id, _ := strconv.Atoi(string(m[1]))
+		if id < 1 || id > len(tracks) {
+			continue
+		}
+		found[id-1] = true
+		if labelTag.Match(mpd[loc[1]:]) {
+			continue
+		}
+
+		line_start := bytes.LastIndexByte(mpd[:loc[0]], '\n') + 1
+		indent := mpd[line_start:loc[0]]
+		if len(bytes.TrimSpace(indent)) > 0 {
+			indent = nil
+		}
+
+		out = append(out, mpd[last:loc[1]]...)
+		out = append(out, '\n')
+		out = append(out, indent...)
+		out = append(out, fmt.Sprintf("\t<Label>%s</Label>", xml_escape(audio_label(id-1, tracks[id-1])))...)
+		last = loc[1]
+	}
+	out = append(out, mpd[last:]...)
+
+	return out, missing_tracks("DASH adaptation set", found)
+}
+
+var audioRenditionName = regexp.MustCompile(`NAME="audio_(\d+)",?`)
+
+// audioMaster replaces the `audio_<n>` names of the audio renditions with their labels,
+// adding the channel count where ffmpeg is too old to write it.
+func audioMaster(master []byte, tracks []Track) ([]byte, error) {
+	found := make([]bool, len(tracks))
+
+	lines := strings.Split(string(master), "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "#EXT-X-MEDIA:") || !strings.Contains(line, "TYPE=AUDIO") {
+			continue
+		}
+
+		loc := audioRenditionName.FindStringSubmatchIndex(line)
+		if loc == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(line[loc[2]:loc[3]])
+		if n >= len(tracks) {
+			continue
+		}
+		found[n] = true
+		track := tracks[n]
+
+		attrs := fmt.Sprintf(`NAME="%s"`, hls_quote(audio_label(n, track)))
+		if !strings.Contains(line, "AUTOSELECT=") {
+			attrs += ",AUTOSELECT=YES"
+		}
+		if track.Channels > 0 && !strings.Contains(line, "CHANNELS=") {
+			attrs += fmt.Sprintf(`,CHANNELS="%d"`, track.Channels)
+		}
+		if strings.HasSuffix(line[loc[0]:loc[1]], ",") {
+			attrs += ","
+		}
+		lines[i] = line[:loc[0]] + attrs + line[loc[1]:]
+	}
+
+	return []byte(strings.Join(lines, "\n")), missing_tracks("HLS audio rendition", found)
+}
+
+// missing_tracks reports the audio tracks that were not found in a manifest.
+func missing_tracks(what string, found []bool) error {
+	var missing []string
+	for i, ok := range found {
+		if !ok {
+			missing = append(missing, strconv.Itoa(i))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("no %s for audio tracks %s", what, strings.Join(missing, ", "))
+}
@@ -0,0 +1,138 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The fixtures in testdata are manifests as ffmpeg's dash and hls muxers write them for
+// two rungs and two audio tracks. audio_no_channels.m3u8 is the master playlist of
+// releases that did not write CHANNELS yet.
+
+var testTracks = []Track{
+	{Index: 1, Codec: "aac", Language: "eng", Channels: 2, ChannelLayout: "stereo", Default: true},
+	{Index: 2, Codec: "ac3", Language: "fra", Title: `Commentary "director"`, Channels: 6, ChannelLayout: "5.1(side)"},
+}
+
+func read_fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestAudioMPD(t *testing.T) {
+	mpd, err := audioMPD(read_fixture(t, "audio.mpd"), testTracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed struct {
+		Sets []struct {
+			ID          string   `xml:"id,attr"`
+			ContentType string   `xml:"contentType,attr"`
+			Labels      []string `xml:"Label"`
+			Role        struct {
+				Value string `xml:"value,attr"`
+			} `xml:"Role"`
+		} `xml:"Period>AdaptationSet"`
+	}
+	if err = xml.Unmarshal(mpd, &parsed); err != nil {
+		t.Fatalf("labelled manifest is not valid XML: %v", err)
+	}
+
+	want := map[string]string{"1": "eng (stereo)", "2": `Commentary "director"`}
+	for _, set := range parsed.Sets {
+		if set.ContentType != "audio" {
+			if len(set.Labels) != 0 {
+				t.Fatalf("video adaptation set got labels %v", set.Labels)
+			}
+			continue
+		}
+		if len(set.Labels) != 1 || set.Labels[0] != want[set.ID] {
+			t.Fatalf("adaptation set %s labels = %q, want %q", set.ID, set.Labels, want[set.ID])
+		}
+		if set.Role.Value == "" {
+			t.Fatalf("adaptation set %s lost its Role", set.ID)
+		}
+	}
+
+	if !bytes.Contains(mpd, []byte("lang=\"eng\">\n\t\t\t<Label>eng (stereo)</Label>\n\t\t\t<Role")) {
+		t.Fatalf("Label not placed before Role with the manifest's indentation:\n%s", mpd)
+	}
+
+	again, err := audioMPD(mpd, testTracks)
+	if err != nil || !bytes.Equal(again, mpd) {
+		t.Fatalf("labelling twice changed the manifest (err %v)", err)
+	}
+}
+
+func TestAudioMPDMissingSet(t *testing.T) {
+	tracks := append(testTracks, Track{Language: "deu"})
+	mpd, err := audioMPD(read_fixture(t, "audio.mpd"), tracks)
+	if err == nil || !strings.Contains(err.Error(), "audio tracks 2") {
+		t.Fatalf("audioMPD with a track ffmpeg did not write = %v, want an error naming track 2", err)
+	}
+	if bytes.Count(mpd, []byte("<Label>")) != 2 {
+		t.Fatal("the tracks that were found were not labelled")
+	}
+}
+
+func TestAudioMaster(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    []string
+	}{
+		{
+			fixture: "audio.m3u8",
+			want: []string{
+				`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="group_audio",NAME="eng (stereo)",AUTOSELECT=YES,DEFAULT=YES,LANGUAGE="eng",CHANNELS="2",URI="index_audio_0.m3u8"`,
+				`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="group_audio",NAME="Commentary 'director'",AUTOSELECT=YES,DEFAULT=NO,LANGUAGE="fra",CHANNELS="6",URI="index_audio_1.m3u8"`,
+			},
+		},
+		{
+			fixture: "audio_no_channels.m3u8",
+			want: []string{
+				`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="group_audio",NAME="eng (stereo)",AUTOSELECT=YES,CHANNELS="2",DEFAULT=YES,LANGUAGE="eng",URI="index_audio_0.m3u8"`,
+				`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="group_audio",NAME="Commentary 'director'",AUTOSELECT=YES,CHANNELS="6",DEFAULT=NO,LANGUAGE="fra",URI="index_audio_1.m3u8"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			master, err := audioMaster(read_fixture(t, tt.fixture), testTracks)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var media []string
+			for _, line := range strings.Split(string(master), "\n") {
+				if strings.HasPrefix(line, "#EXT-X-MEDIA:") {
+					media = append(media, line)
+				}
+			}
+			if strings.Join(media, "\n") != strings.Join(tt.want, "\n") {
+				t.Fatalf("renditions =\n%s\nwant\n%s", strings.Join(media, "\n"), strings.Join(tt.want, "\n"))
+			}
+
+			again, err := audioMaster(master, testTracks)
+			if err == nil || !bytes.Equal(again, master) {
+				t.Fatalf("labelling twice = %v, want the manifest unchanged and the names reported missing", err)
+			}
+		})
+	}
+}
+
+func TestAudioMasterMissingRendition(t *testing.T) {
+	tracks := append(testTracks, Track{Language: "deu"})
+	if _, err := audioMaster(read_fixture(t, "audio.m3u8"), tracks); err == nil || !strings.Contains(err.Error(), "audio tracks 2") {
+		t.Fatalf("audioMaster with a track ffmpeg did not write = %v, want an error naming track 2", err)
+	}
+}
@@ -0,0 +1,142 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cartersusi/bstore/pkg/cmd"
+)
+
+// AudEXT are the audio files streamed without video, music and podcasts.
+var AudEXT = []string{".mp3", ".flac", ".wav", ".m4a"}
+
+// DefaultAudioBitrates are the renditions audio files are encoded at, in kbps.
+var DefaultAudioBitrates = []int{64, 128, 256}
+
+type AudioEncoderRequest struct {
+	InputPath string
+	// Bitrates lists the renditions in kbps, DefaultAudioBitrates when empty.
+	Bitrates    []int
+	Compress    bool
+	Encrypt     bool
+	CompressLvl int
+	// Progress, when set, is called with the share of the audio transcoded so far.
+	Progress func(float64)
+	// Info is the probe of the input taken at upload, MakeAudio probes it itself when nil.
+	Info *AudioInfo
+}
+
+func CheckAudioEXT(fname string) bool {
+	ext := filepath.Ext(fname)
+	for _, e := range AudEXT {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// MakeAudio encodes an audio file to DASH (Opus) and HLS (AAC) streams with a rendition
+// per bitrate next to the input, and its cover art, if it has one, to the poster. Like
+// Make it only fails when neither stream could be made.
+func MakeAudio(ctx context.Context, areq AudioEncoderRequest) (*Result, error) {
+	if !CheckAudioEXT(areq.InputPath) {
+		return nil, errors.New("Invalid file extension")
+	}
+
+	info := areq.Info
+	if info == nil {
+		var err error
+		if info, err = ProbeAudio(areq.InputPath); err != nil {
+			return nil, err
+		}
+	}
+
+	output_dir := strings.TrimSuffix(areq.InputPath, filepath.Ext(areq.InputPath))
+	if err := os.MkdirAll(output_dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	bitrates := audioBitrates(areq.Bitrates, info.Bitrate)
+	result := &Result{}
+	if info.CoverArt {
+		result.Poster = cmd.RunCMD(ctx, "ffmpeg", "-i", areq.InputPath, "-map", "0:v:0", "-frames:v", "1", "-update", "1", filepath.Join(output_dir, MethodFMap[POSTER]))
+	}
+
+	dash_args := append(audioArgs(areq, bitrates, "libopus"),
+		"-f", "dash", "-seg_duration", "4", "-use_template", "1", "-use_timeline", "1",
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number$.m4s",
+		"-dash_segment_type", "mp4", "-adaptation_sets", "id=0,streams=a",
+		filepath.Join(output_dir, MethodFMap[DASH]))
+
+	var variants []string
+	for i, bitrate := range bitrates {
+		variants = append(variants, fmt.Sprintf("a:%d,name:%dk", i, bitrate))
+	}
+	hls_args := append(audioArgs(areq, bitrates, "aac"),
+		"-f", "hls", "-hls_time", "4", "-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(output_dir, "segment_%v_%03d.ts"),
+		"-master_pl_name", MethodFMap[HLS],
+		"-var_stream_map", strings.Join(variants, " "),
+		filepath.Join(output_dir, "index_%v.m3u8"))
+
+	run_streams(ctx, info.Duration, areq.Progress, dash_args, hls_args, nil, result)
+
+	for method, err := range map[int]error{DASH: result.DASH, HLS: result.HLS, POSTER: result.Poster} {
+		if err != nil {
+			remove_output(output_dir, method)
+		}
+	}
+
+	if result.DASH != nil && result.HLS != nil {
+		return result, result.Err()
+	}
+
+	if err := CleanUp(areq.Compress, areq.Encrypt, areq.CompressLvl, output_dir); err != nil {
+		return result, fmt.Errorf("Audio file is stream compatible but not able to compress/encrypt. %w", err)
+	}
+	return result, nil
+}
+
+// audioBitrates drops the renditions above the source bitrate, keeping at least the smallest.
+func audioBitrates(bitrates []int, source int64) []int {
+	if len(bitrates) == 0 {
+		bitrates = DefaultAudioBitrates
+	}
+	if source <= 0 {
+		return bitrates
+	}
+
+	var kept []int
+	smallest := bitrates[0]
+	for _, bitrate := range bitrates {
+		if int64(bitrate)*1000 <= source {
+			kept = append(kept, bitrate)
+		}
+		smallest = min(smallest, bitrate)
+	}
+
+	if len(kept) == 0 {
+		return []int{smallest}
+	}
+	return kept
+}
+
+// audioArgs maps the first audio stream once per bitrate, everything up to the muxer.
+func audioArgs(areq AudioEncoderRequest, bitrates []int, codec string) []string {
+	var args []string
+	if areq.Progress != nil {
+		args = append(args, "-progress", "pipe:1", "-nostats")
+	}
+
+	args = append(args, "-i", areq.InputPath)
+	for i, bitrate := range bitrates {
+		args = append(args, "-map", "0:a:0", fmt.Sprintf("-b:a:%d", i), fmt.Sprintf("%dk", bitrate))
+	}
+	return append(args, "-c:a", codec)
+}
@@ -0,0 +1,218 @@
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/cartersusi/bstore/pkg/cmd"
+)
+
+// VideoInfo is what ffprobe reports about an uploaded video, kept in its metadata sidecar.
+type VideoInfo struct {
+	Duration   float64 `json:"duration"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	FrameRate  float64 `json:"frame_rate"`
+	VideoCodec string  `json:"video_codec"`
+	Format     string  `json:"format"`
+	Bitrate    int64   `json:"bitrate"`
+	Audio      []Track `json:"audio"`
+	Subtitles  []Track `json:"subtitles"`
+}
+
+type Track struct {
+	Index         int    `json:"index"`
+	Codec         string `json:"codec"`
+	Language      string `json:"language,omitempty"`
+	Title         string `json:"title,omitempty"`
+	Channels      int    `json:"channels,omitempty"`
+	ChannelLayout string `json:"channel_layout,omitempty"`
+	SampleRate    int    `json:"sample_rate,omitempty"`
+	Default       bool   `json:"default"`
+}
+
+type ffprobe_output struct {
+	Streams []struct {
+		Index         int    `json:"index"`
+		CodecType     string `json:"codec_type"`
+		CodecName     string `json:"codec_name"`
+		Width         int    `json:"width"`
+		Height        int    `json:"height"`
+		AvgFrameRate  string `json:"avg_frame_rate"`
+		Channels      int    `json:"channels"`
+		ChannelLayout string `json:"channel_layout"`
+		SampleRate    string `json:"sample_rate"`
+		Disposition   struct {
+			Default     int `json:"default"`
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+		Tags map[string]string `json:"tags"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string            `json:"format_name"`
+		Duration   string            `json:"duration"`
+		BitRate    string            `json:"bit_rate"`
+		Tags       map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+// run_ffprobe runs a full ffprobe pass over input.
+func run_ffprobe(input string) (*ffprobe_output, error) {
+	output, err := cmd.GetCMD("ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", input)
+	if err != nil {
+		return nil, err
+	}
+
+	probe := &ffprobe_output{}
+	if err = json.Unmarshal([]byte(output), probe); err != nil {
+		return nil, err
+	}
+	return probe, nil
+}
+
+// Probe reports the video stream and the audio and subtitle tracks of input.
+func Probe(input string) (*VideoInfo, error) {
+	probe, err := run_ffprobe(input)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &VideoInfo{
+		Format:    probe.Format.FormatName,
+		Audio:     []Track{},
+		Subtitles: []Track{},
+	}
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	info.Bitrate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+
+	for _, s := range probe.Streams {
+		track := Track{
+			Index:    s.Index,
+			Codec:    s.CodecName,
+			Language: s.Tags["language"],
+			Title:    s.Tags["title"],
+			Default:  s.Disposition.Default == 1,
+		}
+
+		switch s.CodecType {
+		case "video":
+			// cover art shows up as a video stream too
+			if info.VideoCodec != "" || s.Disposition.AttachedPic == 1 {
+				continue
+			}
+			info.VideoCodec = s.CodecName
+			info.Width = s.Width
+			info.Height = s.Height
+			info.FrameRate = parse_rate(s.AvgFrameRate)
+		case "audio":
+			track.Channels = s.Channels
+			track.ChannelLayout = s.ChannelLayout
+			track.SampleRate, _ = strconv.Atoi(s.SampleRate)
+			info.Audio = append(info.Audio, track)
+		case "subtitle":
+			info.Subtitles = append(info.Subtitles, track)
+		}
+	}
+
+	if info.VideoCodec == "" {
+		return nil, errors.New("No video stream found")
+	}
+	return info, nil
+}
+
+// parse_rate reads ffprobe's `num/den` rates, 0 when unknown.
+func parse_rate(rate string) float64 {
+	num, den, ok := strings.Cut(rate, "/")
+	if !ok {
+		r, _ := strconv.ParseFloat(rate, 64)
+		return r
+	}
+
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// AudioInfo is what ffprobe reports about an uploaded audio file, Tags are its ID3 or
+// Vorbis comment tags with lowercase names.
+type AudioInfo struct {
+	Duration      float64           `json:"duration"`
+	Codec         string            `json:"codec"`
+	Format        string            `json:"format"`
+	Bitrate       int64             `json:"bitrate"`
+	SampleRate    int               `json:"sample_rate"`
+	Channels      int               `json:"channels"`
+	ChannelLayout string            `json:"channel_layout,omitempty"`
+	CoverArt      bool              `json:"cover_art"`
+	Tags          map[string]string `json:"tags"`
+}
+
+// only these tags are kept, others can hold lyrics or whole images
+var audioTags = map[string]bool{
+	"title":        true,
+	"artist":       true,
+	"album":        true,
+	"album_artist": true,
+	"composer":     true,
+	"genre":        true,
+	"date":         true,
+	"track":        true,
+	"disc":         true,
+	"comment":      true,
+	"publisher":    true,
+	"copyright":    true,
+	"language":     true,
+}
+
+// ProbeAudio reports the first audio stream, the tags and whether input carries cover art.
+func ProbeAudio(input string) (*AudioInfo, error) {
+	probe, err := run_ffprobe(input)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &AudioInfo{
+		Format: probe.Format.FormatName,
+		Tags:   make(map[string]string),
+	}
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	info.Bitrate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	add_tags(info.Tags, probe.Format.Tags)
+
+	for _, s := range probe.Streams {
+		switch s.CodecType {
+		case "video":
+			// mp3, flac and m4a carry the cover as an attached picture
+			info.CoverArt = true
+		case "audio":
+			if info.Codec != "" {
+				continue
+			}
+			info.Codec = s.CodecName
+			info.Channels = s.Channels
+			info.ChannelLayout = s.ChannelLayout
+			info.SampleRate, _ = strconv.Atoi(s.SampleRate)
+			// ogg and opus keep their Vorbis comments on the stream
+			add_tags(info.Tags, s.Tags)
+		}
+	}
+
+	if info.Codec == "" {
+		return nil, errors.New("No audio stream found")
+	}
+	return info, nil
+}
+
+func add_tags(dst, tags map[string]string) {
+	for k, v := range tags {
+		k = strings.ToLower(k)
+		if audioTags[k] && dst[k] == "" {
+			dst[k] = v
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package stream
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -14,79 +17,255 @@ import (
 )
 
 type VideoEncoderRequest struct {
-	InputPath   string
-	Codec       string
+	InputPath string
+	Codec     string
+	// Hardware forces an encoder from Hardware, empty or `auto` detects one.
+	Hardware    string
 	Bitrate     int
 	Compress    bool
 	Encrypt     bool
 	CompressLvl int
+	// Ladder lists the renditions to encode, empty encodes the source size once at Bitrate.
+	Ladder []Rung
+	// Thumbnails, when enabled, adds sprite sheets and a WebVTT track for scrub previews.
+	Thumbnails Thumbnails
+	// Progress, when set, is called with the share of the video transcoded so far.
+	Progress func(float64)
+	// Info is the probe of the input taken at upload, Make probes it itself when nil.
+	Info *VideoInfo
 }
 
-func Make(vreq VideoEncoderRequest) error {
+// Result tells which outputs Make produced, a failed one holds its error.
+type Result struct {
+	DASH       error
+	HLS        error
+	Poster     error
+	Thumbnails error
+	Subtitles  error
+}
+
+// Err joins the errors of the outputs that failed, nil if all were made.
+func (r *Result) Err() error {
+	var errs []error
+	if r.DASH != nil {
+		errs = append(errs, fmt.Errorf("DASH: %w", r.DASH))
+	}
+	if r.HLS != nil {
+		errs = append(errs, fmt.Errorf("HLS: %w", r.HLS))
+	}
+	if r.Poster != nil {
+		errs = append(errs, fmt.Errorf("Poster: %w", r.Poster))
+	}
+	if r.Thumbnails != nil {
+		errs = append(errs, fmt.Errorf("Thumbnails: %w", r.Thumbnails))
+	}
+	if r.Subtitles != nil {
+		errs = append(errs, fmt.Errorf("Subtitles: %w", r.Subtitles))
+	}
+	return errors.Join(errs...)
+}
+
+// outputGlobs are the files each output writes, removed when it fails so its URL does
+// not point at a broken stream.
+var outputGlobs = map[int][]string{
+	DASH:       {"index.mpd", "init-*.m4s", "chunk-*.m4s"},
+	HLS:        {"index*.m3u8", "segment_*.ts"},
+	POSTER:     {"index.jpg"},
+	THUMBNAILS: {"sprite_*.jpg", "thumbnails.vtt"},
+}
+
+// Make encodes the DASH and HLS streams with the video's text subtitles, the poster and
+// the thumbnails next to the input, ffmpeg is killed once ctx is done. It only fails when
+// neither stream could be made, check the Result for outputs that are missing.
+func Make(ctx context.Context, vreq VideoEncoderRequest) (*Result, error) {
+	info := vreq.Info
+	if info == nil {
+		var err error
+		if info, err = Probe(vreq.InputPath); err != nil {
+			// still encodable, just without audio tracks, ladder or progress
+			log.Println("Error probing video:", err)
+			info = &VideoInfo{}
+		}
+	}
+
 	dash := &VideoEncoder{
 		InputFile: vreq.InputPath,
 		Codec:     vreq.Codec,
 		Bitrate:   formatBitrate(vreq.Bitrate),
+		Hardware:  vreq.Hardware,
+		Progress:  vreq.Progress != nil,
+		Ladder:    vreq.Ladder,
+		Info:      info,
+	}
+	if err := dash.VideoBuilder(DASH); err != nil {
+		return nil, err
 	}
-	dash.VideoBuilder(DASH)
-
-	thumbnail_cmd := fmt.Sprintf("ffmpeg -i %s -vf \"select=eq(n\\,0)\" -frames:v 1 -update 1 %s", vreq.InputPath, filepath.Join(dash.OutputDir, "index.jpg"))
-	_ = cmd.RunCMD_fs(thumbnail_cmd)
 
 	hls := &VideoEncoder{
 		InputFile: vreq.InputPath,
 		Codec:     vreq.Codec,
 		Bitrate:   formatBitrate(vreq.Bitrate),
+		Hardware:  vreq.Hardware,
+		Progress:  vreq.Progress != nil,
+		Ladder:    vreq.Ladder,
+		Info:      info,
+	}
+	if err := hls.VideoBuilder(HLS); err != nil {
+		return nil, err
+	}
+
+	if dash.OutputDir != hls.OutputDir {
+		return nil, errors.New("Output directories do not match")
+	}
+
+	result := &Result{}
+	result.Poster = cmd.RunCMD(ctx, "ffmpeg", "-i", vreq.InputPath, "-vf", "select=eq(n\\,0)", "-frames:v", "1", "-update", "1", filepath.Join(dash.OutputDir, MethodFMap[POSTER]))
+
+	var wg sync.WaitGroup
+	if vreq.Thumbnails.Enabled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result.Thumbnails = make_thumbnails(ctx, vreq.InputPath, dash.OutputDir, info, vreq.Thumbnails)
+			if result.Thumbnails != nil {
+				log.Println("Error with Thumbnails:", result.Thumbnails)
+			}
+		}()
+	}
+
+	fallback := map[int][]string{DASH: dash.SoftwareArgs(), HLS: hls.SoftwareArgs()}
+	run_streams(ctx, info.Duration, vreq.Progress, dash.Args, hls.Args, fallback, result)
+	wg.Wait()
+
+	for method, err := range map[int]error{DASH: result.DASH, HLS: result.HLS, POSTER: result.Poster, THUMBNAILS: result.Thumbnails} {
+		if err != nil {
+			remove_output(dash.OutputDir, method)
+		}
 	}
-	hls.VideoBuilder(HLS)
 
-	// TODO: Removed for concurrent task execution, needs testing
-	//dash_err := cmd.RunCMD_fs(dash.Command)
-	//hls_err := cmd.RunCMD_fs(hls.Command)
+	if result.DASH != nil && result.HLS != nil {
+		return result, result.Err()
+	}
+
+	if err := label_audio(dash.OutputDir, dash.Audio); err != nil {
+		log.Println("Error labelling audio tracks:", err)
+	}
+
+	result.Subtitles = extract_subtitles(ctx, vreq.InputPath, dash.OutputDir, info)
+	if result.Subtitles != nil {
+		log.Println("Error with Subtitles:", result.Subtitles)
+		remove_files(dash.OutputDir, "sub_*")
+	}
+
+	// If there is an error, still run the cleanup
+	if err := CleanUp(vreq.Compress, vreq.Encrypt, vreq.CompressLvl, dash.OutputDir); err != nil {
+		return result, fmt.Errorf("Video file is stream compatible but not able to compress/encrypt. %w", err)
+	}
+	return result, nil
+}
+
+func run_ffmpeg(ctx context.Context, args []string) error {
+	return cmd.RunCMD(ctx, "ffmpeg", args...)
+}
 
-	var dash_err, hls_err error
+// run_streams runs the DASH and HLS commands side by side and records how they went. A
+// command that exits with an error is run again with its fallback args, if it has any.
+// Progress is reported against duration, the length of the input in seconds.
+func run_streams(ctx context.Context, duration float64, progress func(float64), dash_args, hls_args []string, fallback map[int][]string, result *Result) {
+	run_dash, run_hls := run_ffmpeg, run_ffmpeg
+	if progress != nil {
+		run_dash, run_hls = track_progress(duration, progress)
+	}
+	run_dash, run_hls = with_fallback(run_dash, fallback[DASH]), with_fallback(run_hls, fallback[HLS])
 
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
-		dash_err = cmd.RunCMD_fs(dash.Command)
-		if dash_err != nil {
-			log.Println("Error with DASH:", dash_err)
+		result.DASH = run_dash(ctx, dash_args)
+		if result.DASH != nil {
+			log.Println("Error with DASH:", result.DASH)
 		}
 	}()
 
 	go func() {
 		defer wg.Done()
-		hls_err = cmd.RunCMD_fs(hls.Command)
-		if hls_err != nil {
-			log.Println("Error with HLS:", hls_err)
+		result.HLS = run_hls(ctx, hls_args)
+		if result.HLS != nil {
+			log.Println("Error with HLS:", result.HLS)
 		}
 	}()
 
 	wg.Wait()
+}
 
-	// If there is an error, still run the cleanup
-	carry_over_errormsg := ""
-	if dash_err != nil {
-		carry_over_errormsg += fmt.Sprintf("DASH: %s\n", dash_err)
-		log.Println("Error with DASH")
+// with_fallback retries run with the fallback args when ffmpeg exited non-zero, a hardware
+// encoder that is listed but cannot open its device fails like this.
+func with_fallback(run func(context.Context, []string) error, fallback []string) func(context.Context, []string) error {
+	if fallback == nil {
+		return run
 	}
-	if hls_err != nil {
-		carry_over_errormsg += fmt.Sprintf("HLS: %s\n", hls_err)
-		log.Println("Error with HLS")
+
+	return func(ctx context.Context, args []string) error {
+		err := run(ctx, args)
+		var cmd_err *cmd.Error
+		if err == nil || ctx.Err() != nil || !errors.As(err, &cmd_err) || cmd_err.ExitCode < 1 {
+			return err
+		}
+
+		log.Println("Hardware encode failed, retrying in software:", err)
+		return run(ctx, fallback)
 	}
+}
 
-	if dash.OutputDir == hls.OutputDir {
-		err := CleanUp(vreq.Compress, vreq.Encrypt, vreq.CompressLvl, dash.OutputDir)
-		if err != nil {
-			return errors.New(fmt.Sprintf("%sVideo file is stream compatible but not able to compress/encrypt. %s", carry_over_errormsg, err))
+func remove_output(output_dir string, method int) {
+	remove_files(output_dir, outputGlobs[method]...)
+}
+
+func remove_files(output_dir string, globs ...string) {
+	for _, glob := range globs {
+		matches, _ := filepath.Glob(filepath.Join(output_dir, glob))
+		for _, m := range matches {
+			_ = os.Remove(m)
 		}
-	} else {
-		return errors.New(fmt.Sprintf("%sVideo file is stream compatible but not able to compress/encrypt. Output directories do not match", carry_over_errormsg))
 	}
-	return nil
+}
+
+// track_progress returns runners for the DASH and HLS commands that parse ffmpeg's
+// `-progress` output and report the average of both against duration.
+func track_progress(duration float64, progress func(float64)) (func(context.Context, []string) error, func(context.Context, []string) error) {
+	var mu sync.Mutex
+	done := [2]float64{}
+	runner := func(i int) func(context.Context, []string) error {
+		return func(ctx context.Context, args []string) error {
+			return cmd.RunCMD_lines(ctx, func(line string) {
+				k, v, _ := strings.Cut(line, "=")
+				share := -1.0
+				switch {
+				case k == "progress" && v == "end":
+					share = 1
+				case k == "out_time_us" && duration > 0:
+					us, err := strconv.ParseInt(v, 10, 64)
+					if err != nil {
+						return
+					}
+					share = min(float64(us)/1e6/duration, 1)
+				}
+				if share < 0 {
+					return
+				}
+
+				mu.Lock()
+				done[i] = share
+				p := (done[0] + done[1]) / 2
+				mu.Unlock()
+				progress(p)
+			}, "ffmpeg", args...)
+		}
+	}
+
+	return runner(0), runner(1)
 }
 
 func CleanUp(compress, encrypt bool, compress_lvl int, output_dir string) error {
@@ -107,36 +286,21 @@ func CleanUp(compress, encrypt bool, compress_lvl int, output_dir string) error
 			continue
 		}
 		fpath := filepath.Join(output_dir, f)
-		fdata, err := fops.ReadFile(fpath, false)
-		if err != nil {
-			return errors.New("Error reading file")
-		}
-
+		out_path := fpath + ".tmp"
 		if compress {
-			fpath += ".zst"
+			out_path = fpath + ".zst"
 		}
 
-		file, err := os.Create(fpath)
+		err = seal_file(fpath, out_path, compress, encrypt, compress_lvl)
 		if err != nil {
-			return errors.New("Error creating file")
+			_ = os.Remove(out_path)
+			return err
 		}
-		defer file.Close()
 
 		if compress { // 1,0 & 1,1
-			err = fops.CompressData(fdata, file, compress_lvl, encrypt)
-			if err != nil {
-				return errors.New("Error compressing data")
-			}
-			_ = os.Remove(strings.TrimSuffix(fpath, ".zst"))
-		} else { // 0,1
-			// check here again later
 			_ = os.Remove(fpath)
-			data_enc, err := fops.Encrypt(fdata)
-			if err != nil {
-				return err
-			}
-			_, err = file.Write(data_enc)
-			if err != nil {
+		} else { // 0,1
+			if err = os.Rename(out_path, fpath); err != nil {
 				return errors.New("Error writing data")
 			}
 		}
@@ -144,3 +308,38 @@ func CleanUp(compress, encrypt bool, compress_lvl int, output_dir string) error
 
 	return nil
 }
+
+func seal_file(src_path, dst_path string, compress, encrypt bool, compress_lvl int) error {
+	src, err := os.Open(src_path)
+	if err != nil {
+		return errors.New("Error reading file")
+	}
+	defer src.Close()
+
+	dst, err := os.Create(dst_path)
+	if err != nil {
+		return errors.New("Error creating file")
+	}
+
+	w, err := fops.NewWriter(dst, compress, compress_lvl, encrypt)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+
+	if _, err = io.Copy(w, src); err != nil {
+		dst.Close()
+		return errors.New("Error compressing data")
+	}
+
+	// the source is removed or replaced once this returns, dst has to be on disk by then
+	if err = w.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err = dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,209 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cartersusi/bstore/pkg/cmd"
+	"github.com/cartersusi/bstore/pkg/fops"
+)
+
+// stubFFmpeg stands in for ffmpeg: it lists $STUB_HWACCELS and $STUB_ENCODERS, fails
+// every encode using $STUB_FAIL with exit code 187 and logs its arguments to $STUB_LOG.
+const stubFFmpeg = `#!/bin/sh
+echo "$*" >> "$STUB_LOG"
+case "$*" in
+*-hwaccels*)
+	echo "Hardware acceleration methods:"
+	for h in $STUB_HWACCELS; do echo "$h"; done
+	exit 0 ;;
+*-encoders*)
+	echo "Encoders:"
+	for e in $STUB_ENCODERS; do echo " V....D $e           stub encoder"; done
+	exit 0 ;;
+*"-h encoder="*)
+	echo "Encoder stub:"
+	exit 0 ;;
+esac
+if [ -n "$STUB_FAIL" ]; then
+	case "$*" in *"$STUB_FAIL"*)
+		echo "Failed to initialise $STUB_FAIL" >&2
+		exit 187 ;;
+	esac
+fi
+exit 0
+`
+
+// stub_ffmpeg puts stubFFmpeg first on PATH, in an absolute directory so it is not
+// refused as relative, and returns the file it logs its calls to.
+func stub_ffmpeg(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(stubFFmpeg), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	log := filepath.Join(dir, "calls.log")
+	t.Setenv("PATH", dir)
+	t.Setenv("STUB_LOG", log)
+	t.Setenv("STUB_HWACCELS", "")
+	t.Setenv("STUB_ENCODERS", "")
+	t.Setenv("STUB_FAIL", "")
+	return log
+}
+
+func stub_calls(t *testing.T, log string) []string {
+	t.Helper()
+
+	data, err := os.ReadFile(log)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestWithFallback(t *testing.T) {
+	hardware := []string{"-c:v", "h264_vaapi", "out.mpd"}
+	software := []string{"-c:v", "libx264", "out.mpd"}
+
+	t.Run("retries in software", func(t *testing.T) {
+		log := stub_ffmpeg(t)
+		t.Setenv("STUB_FAIL", "h264_vaapi")
+
+		if err := with_fallback(run_ffmpeg, software)(context.Background(), hardware); err != nil {
+			t.Fatalf("fallback run = %v", err)
+		}
+		if calls := stub_calls(t, log); len(calls) != 2 || calls[0] != strings.Join(hardware, " ") || calls[1] != strings.Join(software, " ") {
+			t.Fatalf("ffmpeg calls = %q, want the hardware then the software encode", calls)
+		}
+	})
+
+	t.Run("no retry on success", func(t *testing.T) {
+		log := stub_ffmpeg(t)
+
+		if err := with_fallback(run_ffmpeg, software)(context.Background(), hardware); err != nil {
+			t.Fatal(err)
+		}
+		if calls := stub_calls(t, log); len(calls) != 1 {
+			t.Fatalf("ffmpeg calls = %q, want one", calls)
+		}
+	})
+
+	t.Run("software failure is returned", func(t *testing.T) {
+		log := stub_ffmpeg(t)
+		t.Setenv("STUB_FAIL", "out.mpd")
+
+		err := with_fallback(run_ffmpeg, software)(context.Background(), hardware)
+		var cmd_err *cmd.Error
+		if !errors.As(err, &cmd_err) || cmd_err.ExitCode != 187 || !strings.Contains(cmd_err.Stderr, "Failed to initialise") {
+			t.Fatalf("fallback run = %v, want the software encode's exit code and stderr", err)
+		}
+		if calls := stub_calls(t, log); len(calls) != 2 {
+			t.Fatalf("ffmpeg calls = %q, want two", calls)
+		}
+	})
+
+	t.Run("no fallback", func(t *testing.T) {
+		log := stub_ffmpeg(t)
+		t.Setenv("STUB_FAIL", "h264_vaapi")
+
+		if err := with_fallback(run_ffmpeg, nil)(context.Background(), hardware); err == nil {
+			t.Fatal("run without fallback succeeded")
+		}
+		if calls := stub_calls(t, log); len(calls) != 1 {
+			t.Fatalf("ffmpeg calls = %q, want one", calls)
+		}
+	})
+
+	t.Run("no retry once cancelled", func(t *testing.T) {
+		log := stub_ffmpeg(t)
+		t.Setenv("STUB_FAIL", "h264_vaapi")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		run := func(ctx context.Context, args []string) error {
+			err := run_ffmpeg(ctx, args)
+			cancel()
+			return err
+		}
+		if err := with_fallback(run, software)(ctx, hardware); err == nil {
+			t.Fatal("cancelled run succeeded")
+		}
+		if calls := stub_calls(t, log); len(calls) != 1 {
+			t.Fatalf("ffmpeg calls = %q, want one", calls)
+		}
+	})
+}
+
+func TestRunStreamsFallback(t *testing.T) {
+	log := stub_ffmpeg(t)
+	t.Setenv("STUB_FAIL", "h264_qsv")
+
+	dash := []string{"-c:v", "h264_qsv", "index.mpd"}
+	hls := []string{"-c:v", "h264_qsv", "index_%v.m3u8"}
+	fallback := map[int][]string{
+		DASH: {"-c:v", "libx264", "index.mpd"},
+		HLS:  {"-c:v", "libx264", "index_%v.m3u8"},
+	}
+
+	result := &Result{}
+	run_streams(context.Background(), 0, nil, dash, hls, fallback, result)
+	if err := result.Err(); err != nil {
+		t.Fatalf("run_streams = %v", err)
+	}
+	if calls := stub_calls(t, log); len(calls) != 4 {
+		t.Fatalf("ffmpeg calls = %q, want both streams run twice", calls)
+	}
+}
+
+func TestCleanUp(t *testing.T) {
+	t.Setenv("BSTORE_ENC_KEY", "0123456789abcdef0123456789abcdef")
+	dir := t.TempDir()
+	data := []byte("#EXTM3U\n")
+	if err := os.WriteFile(filepath.Join(dir, "index.m3u8"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CleanUp(false, true, 2, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "index.m3u8" {
+		t.Fatalf("files after sealing = %v, want index.m3u8 alone", entries)
+	}
+	r, err := fops.Open(filepath.Join(dir, "index.m3u8"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) || !r.Encrypted() {
+		t.Fatalf("sealed file reads %q, %v", got, err)
+	}
+}
+
+func TestCleanUpKeepsSourceOnError(t *testing.T) {
+	t.Setenv("BSTORE_ENC_KEY", "")
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "index.m3u8")
+	if err := os.WriteFile(fpath, []byte("#EXTM3U\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CleanUp(true, true, 2, dir); err == nil {
+		t.Fatal("sealing without a key succeeded")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "index.m3u8" {
+		t.Fatalf("files after a failed seal = %v, want the source alone", entries)
+	}
+}
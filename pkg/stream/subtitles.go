@@ -0,0 +1,242 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cartersusi/bstore/pkg/cmd"
+)
+
+// SubEXT are the sidecar subtitle files that attach to a video uploaded next to them,
+// `/dir/movie.en.srt` to `/dir/movie.mp4`.
+var SubEXT = []string{".srt", ".vtt"}
+
+// only these can become WebVTT, bitmap subtitles like PGS are skipped
+var textSubtitleCodecs = map[string]bool{
+	"subrip":   true,
+	"ass":      true,
+	"ssa":      true,
+	"mov_text": true,
+	"webvtt":   true,
+	"text":     true,
+}
+
+// Subtitle is a WebVTT track served next to the streams as `<ID>.vtt`, with the
+// `<ID>.m3u8` playlist HLS needs around it.
+type Subtitle struct {
+	ID       string
+	Language string
+	Name     string
+}
+
+func (sub Subtitle) label() string {
+	if sub.Name != "" {
+		return sub.Name
+	}
+	if sub.Language != "" {
+		return sub.Language
+	}
+	return sub.ID
+}
+
+func CheckSubEXT(fname string) bool {
+	ext := filepath.Ext(fname)
+	for _, e := range SubEXT {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// extract_subtitles converts the text subtitle streams of input to WebVTT and adds them
+// to the manifests already written to output_dir.
+func extract_subtitles(ctx context.Context, input, output_dir string, info *VideoInfo) error {
+	var subs []Subtitle
+	args := []string{"-i", input}
+	for _, track := range info.Subtitles {
+		if !textSubtitleCodecs[track.Codec] {
+			continue
+		}
+
+		sub := Subtitle{ID: fmt.Sprintf("sub_%d", len(subs)), Language: track.Language, Name: track.Title}
+		args = append(args, "-map", fmt.Sprintf("0:%d", track.Index), "-c:s", "webvtt", filepath.Join(output_dir, sub.ID+".vtt"))
+		subs = append(subs, sub)
+	}
+
+	if len(subs) == 0 {
+		return nil
+	}
+
+	err := cmd.RunCMD(ctx, "ffmpeg", args...)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range subs {
+		if err = add_subtitle(output_dir, sub, info.Duration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add_subtitle writes the HLS playlist of sub and references it in the local manifests.
+func add_subtitle(output_dir string, sub Subtitle, duration float64) error {
+	err := os.WriteFile(filepath.Join(output_dir, sub.ID+".m3u8"), SubtitlePlaylist(sub, duration), 0644)
+	if err != nil {
+		return err
+	}
+
+	return patch_manifests(output_dir, map[int]func([]byte) ([]byte, error){
+		DASH: func(mpd []byte) ([]byte, error) { return SubtitleMPD(mpd, sub), nil },
+		HLS:  func(master []byte) ([]byte, error) { return SubtitleMaster(master, sub), nil },
+	})
+}
+
+// patch_manifests rewrites the DASH and HLS manifests in output_dir, skipping the ones
+// that were not made. A patch that fails still has what it could change written.
+func patch_manifests(output_dir string, patches map[int]func([]byte) ([]byte, error)) error {
+	var errs []error
+	for method, patch := range patches {
+		fpath := filepath.Join(output_dir, MethodFMap[method])
+		manifest, err := os.ReadFile(fpath)
+		if os.IsNotExist(err) {
+			// that stream failed, there is nothing to add to
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		manifest, err = patch(manifest)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if err = os.WriteFile(fpath, manifest, 0644); err != nil {
+			return err
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SubtitlePlaylist is a single segment HLS playlist around the WebVTT file of sub.
+func SubtitlePlaylist(sub Subtitle, duration float64) []byte {
+	return []byte(fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:%.3f,\n%s.vtt\n#EXT-X-ENDLIST\n",
+		int(math.Ceil(duration)), duration, sub.ID))
+}
+
+// SubtitleMPD adds sub as a text adaptation set to a DASH manifest, once.
+func SubtitleMPD(mpd []byte, sub Subtitle) []byte {
+	if bytes.Contains(mpd, []byte("<BaseURL>"+sub.ID+".vtt</BaseURL>")) {
+		return mpd
+	}
+
+	i := bytes.LastIndex(mpd, []byte("</Period>"))
+	if i < 0 {
+		return mpd
+	}
+	// at the start of its line, to keep the indentation
+	i = bytes.LastIndexByte(mpd[:i], '\n') + 1
+
+	lang := ""
+	if sub.Language != "" {
+		lang = fmt.Sprintf(` lang="%s"`, xml_escape(sub.Language))
+	}
+	set := fmt.Sprintf("\t\t<AdaptationSet contentType=\"text\" mimeType=\"text/vtt\"%s>\n"+
+		"\t\t\t<Label>%s</Label>\n"+
+		"\t\t\t<Role schemeIdUri=\"urn:mpeg:dash:role:2011\" value=\"subtitle\"/>\n"+
+		"\t\t\t<Representation id=\"%s\" bandwidth=\"256\">\n"+
+		"\t\t\t\t<BaseURL>%s.vtt</BaseURL>\n"+
+		"\t\t\t</Representation>\n"+
+		"\t\t</AdaptationSet>\n",
+		lang, xml_escape(sub.label()), sub.ID, sub.ID)
+
+	return append(mpd[:i:i], append([]byte(set), mpd[i:]...)...)
+}
+
+// SubtitleMaster adds sub as an EXT-X-MEDIA rendition to an HLS master playlist, once,
+// and puts every variant stream in the subtitle group.
+func SubtitleMaster(master []byte, sub Subtitle) []byte {
+	uri := fmt.Sprintf(`URI="%s.m3u8"`, sub.ID)
+	if bytes.Contains(master, []byte(uri)) {
+		return master
+	}
+
+	media := fmt.Sprintf(`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="%s",`, hls_quote(sub.label()))
+	if sub.Language != "" {
+		media += fmt.Sprintf(`LANGUAGE="%s",`, hls_quote(sub.Language))
+	}
+	media += "DEFAULT=NO,AUTOSELECT=YES," + uri
+
+	var out []string
+	added := false
+	for _, line := range strings.Split(strings.TrimRight(string(master), "\n"), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			if !added {
+				out = append(out, media)
+				added = true
+			}
+			if !strings.Contains(line, `SUBTITLES="subs"`) {
+				line += `,SUBTITLES="subs"`
+			}
+		}
+		out = append(out, line)
+	}
+	return []byte(strings.Join(out, "\n") + "\n")
+}
+
+var srtTiming = regexp.MustCompile(`(\d{2}:\d{2}:\d{2}),(\d{3})`)
+
+// ToVTT converts an SRT file to WebVTT, WebVTT is returned as it is.
+func ToVTT(data []byte) []byte {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	if bytes.HasPrefix(data, []byte("WEBVTT")) {
+		return data
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		if strings.Contains(line, "-->") {
+			lines[i] = srtTiming.ReplaceAllString(line, "$1.$2")
+		}
+	}
+	return []byte("WEBVTT\n\n" + strings.Join(lines, "\n"))
+}
+
+func xml_escape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func hls_quote(s string) string {
+	return strings.NewReplacer(`"`, "'", "\n", " ", "\r", " ").Replace(s)
+}
+
+var vttEnd = regexp.MustCompile(`-->\s*((?:\d+:)?\d{2}:\d{2})\.(\d{3})`)
+
+// VTTDuration is where the last cue of a WebVTT file ends, in seconds.
+func VTTDuration(vtt []byte) float64 {
+	duration := 0.0
+	for _, m := range vttEnd.FindAllSubmatch(vtt, -1) {
+		seconds := 0.0
+		for _, part := range strings.Split(string(m[1]), ":") {
+			n, _ := strconv.Atoi(part)
+			seconds = seconds*60 + float64(n)
+		}
+		ms, _ := strconv.Atoi(string(m[2]))
+		duration = max(duration, seconds+float64(ms)/1000)
+	}
+	return duration
+}
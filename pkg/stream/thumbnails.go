@@ -0,0 +1,68 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cartersusi/bstore/pkg/cmd"
+)
+
+// Thumbnails configures the scrub previews: a frame every Interval seconds, Width pixels
+// wide, tiled Columns x Rows to a sprite sheet.
+type Thumbnails struct {
+	Enabled  bool `yaml:"enable"`
+	Interval int  `yaml:"interval"`
+	Width    int  `yaml:"width"`
+	Columns  int  `yaml:"columns"`
+	Rows     int  `yaml:"rows"`
+}
+
+var DefaultThumbnails = Thumbnails{Interval: 10, Width: 160, Columns: 10, Rows: 10}
+
+// make_thumbnails writes the sprite sheets `sprite_001.jpg`, ... and the WebVTT track
+// pointing every cue at its tile with a `#xywh=` fragment.
+func make_thumbnails(ctx context.Context, input, output_dir string, info *VideoInfo, t Thumbnails) error {
+	duration := info.Duration
+	if duration <= 0 {
+		return errors.New("Unknown video duration")
+	}
+
+	// the tile height has to be known for the cues, so it is fixed instead of left to scale
+	height := t.Width * 9 / 16
+	if info.Width > 0 && info.Height > 0 {
+		height = t.Width * info.Height / info.Width
+	}
+	height += height % 2
+
+	filter := fmt.Sprintf("fps=1/%d,scale=%d:%d,tile=%dx%d", t.Interval, t.Width, height, t.Columns, t.Rows)
+	err := cmd.RunCMD(ctx, "ffmpeg", "-i", input, "-vf", filter, "-an", "-sn", "-q:v", "5", filepath.Join(output_dir, "sprite_%03d.jpg"))
+	if err != nil {
+		return err
+	}
+
+	per_sheet := t.Columns * t.Rows
+	n := int(math.Ceil(duration / float64(t.Interval)))
+
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+	for i := 0; i < n; i++ {
+		start := float64(i * t.Interval)
+		end := min(start+float64(t.Interval), duration)
+		tile := i % per_sheet
+		fmt.Fprintf(&vtt, "\n%s --> %s\nsprite_%03d.jpg#xywh=%d,%d,%d,%d\n",
+			vtt_time(start), vtt_time(end), i/per_sheet+1, tile%t.Columns*t.Width, tile/t.Columns*height, t.Width, height)
+	}
+
+	return os.WriteFile(filepath.Join(output_dir, MethodFMap[THUMBNAILS]), []byte(vtt.String()), 0644)
+}
+
+// vtt_time formats seconds as `HH:MM:SS.mmm`.
+func vtt_time(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -4,10 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/cartersusi/bstore/pkg/cmd"
 	"github.com/cartersusi/bstore/pkg/fops"
@@ -20,22 +25,84 @@ const (
 	NoGPU GPUType = iota
 	NvidiaGPU
 	AppleGPU
+	VAAPIGPU
+	QSVGPU
+	V4L2GPU
+)
+
+// Hardware names the encoders the `hardware` setting can force, `auto` detects one.
+var Hardware = map[string]GPUType{
+	"software":     NoGPU,
+	"nvenc":        NvidiaGPU,
+	"videotoolbox": AppleGPU,
+	"vaapi":        VAAPIGPU,
+	"qsv":          QSVGPU,
+	"v4l2":         V4L2GPU,
+}
+
+func (g GPUType) String() string {
+	for name, gpu := range Hardware {
+		if gpu == g {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// the filters scaling frames the decoder left in GPU memory
+var hwScale = map[GPUType]string{
+	NvidiaGPU: "scale_cuda=-2:%d",
+	VAAPIGPU:  "scale_vaapi=w=-2:h=%d",
+	QSVGPU:    "scale_qsv=w=-2:h=%d",
+}
+
+// encoderPresets are the speed settings of the encoders that take one.
+var encoderPresets = map[string][]string{
+	"h264_nvenc": {"-preset", "p2"},
+	"av1_nvenc":  {"-preset", "p2"},
+	"h264_qsv":   {"-preset", "veryfast"},
+	"libx264":    {"-preset", "veryfast"},
+	"libx265":    {"-preset", "veryfast"},
+}
+
+const vaapiDevice = "/dev/dri/renderD128"
+
+// the device nodes hardware detection looks for
+var (
+	driDevices  = "/dev/dri/renderD*"
+	v4l2Devices = "/dev/video*"
 )
 
 const (
 	DASH = iota
 	HLS
 	POSTER
+	THUMBNAILS
 )
 
 const DEFAULT_BITRATE = 1000
 
+// Rung is one rendition of the bitrate ladder, Bitrate in kbps. Height 0 keeps the source size.
+type Rung struct {
+	Name    string `yaml:"name"`
+	Height  int    `yaml:"height"`
+	Bitrate int    `yaml:"bitrate"`
+}
+
+var DefaultLadder = []Rung{
+	{Name: "1080p", Height: 1080, Bitrate: 5000},
+	{Name: "720p", Height: 720, Bitrate: 2800},
+	{Name: "480p", Height: 480, Bitrate: 1400},
+	{Name: "360p", Height: 360, Bitrate: 800},
+}
+
 var MethodFMap = map[int]string{
-	DASH:   "index.mpd",
-	HLS:    "index.m3u8",
-	POSTER: "index.jpg",
+	DASH:       "index.mpd",
+	HLS:        "index.m3u8",
+	POSTER:     "index.jpg",
+	THUMBNAILS: "thumbnails.vtt",
 }
-var VidEXT = []string{".mp4", ".webm", ".ogg", ".wmv", ".mov", ".avchd", ".av1"}
+var VidEXT = []string{".mp4", ".mkv", ".webm", ".ogg", ".wmv", ".mov", ".avchd", ".av1"}
 
 type VideoEncoder struct {
 	InputFile  string
@@ -43,10 +110,16 @@ type VideoEncoder struct {
 	OutputFile string
 	StreamType int
 	Codec      string
-	Audio      bool
-	Command    string
+	Audio      []Track
+	Args       []string
 	GPUType    GPUType
-	Bitrate    string
+	// Hardware forces an encoder from Hardware, empty or `auto` detects one.
+	Hardware string
+	Bitrate  string
+	Progress bool
+	Ladder   []Rung
+	// Info is the probe of InputFile the audio tracks and ladder are picked from.
+	Info *VideoInfo
 }
 
 func detectGPU() GPUType {
@@ -62,36 +135,115 @@ func detectGPU() GPUType {
 		return NvidiaGPU
 	}
 
+	// ffmpeg lists what it was built with, the device nodes tell if the hardware is there
+	hwaccels, _ := cmd.GetCMD("ffmpeg", "-hide_banner", "-hwaccels")
+	encoders, _ := cmd.GetCMD("ffmpeg", "-hide_banner", "-encoders")
+	switch {
+	case has_field(hwaccels, "vaapi") && has_field(encoders, "h264_vaapi") && has_device(driDevices):
+		return VAAPIGPU
+	case has_field(hwaccels, "qsv") && has_field(encoders, "h264_qsv") && has_device(driDevices):
+		return QSVGPU
+	case has_field(encoders, "h264_v4l2m2m") && has_device(v4l2Devices):
+		return V4L2GPU
+	}
+
 	return NoGPU
 }
 
-func MakeUrl(c *gin.Context, fpath string, method int) string {
+var detected struct {
+	sync.Mutex
+	gpu  GPUType
+	done bool
+}
+
+// detectedGPU runs the detection once, it does not change while the server runs.
+func detectedGPU() GPUType {
+	detected.Lock()
+	defer detected.Unlock()
+
+	if !detected.done {
+		detected.gpu = detectGPU()
+		detected.done = true
+	}
+	return detected.gpu
+}
+
+// reset_detected_gpu makes the next detectedGPU detect again.
+func reset_detected_gpu() {
+	detected.Lock()
+	defer detected.Unlock()
+
+	detected.done = false
+}
+
+func has_field(output, field string) bool {
+	return slices.Contains(strings.Fields(output), field)
+}
+
+func has_device(glob string) bool {
+	matches, _ := filepath.Glob(glob)
+	return len(matches) > 0
+}
+
+// OutputKey is where the stream output of the video at fpath is stored, `/dir/movie.mp4`
+// streams from `/dir/movie/`.
+func OutputKey(fpath string) string {
+	return strings.TrimSuffix(fpath, path.Ext(fpath))
+}
+
+// MakeUrl is the URL of the stream output of fpath served below route.
+func MakeUrl(c *gin.Context, route, fpath string, method int) string {
+	return MakeFileUrl(c, route, OutputKey(fpath), MethodFMap[method])
+}
+
+// MakeFileUrl is the URL of fname in the stream directory dir served below route.
+func MakeFileUrl(c *gin.Context, route, dir, fname string) string {
 	tls := "https://"
 	is_https := c.Request.TLS
 	if is_https == nil {
 		tls = "http://"
 	}
 
-	_, fname := filepath.Split(fpath)
-	dir_name := strings.TrimSuffix(fname, filepath.Ext(fname))
-	stream_fname := MethodFMap[method]
-
-	return fmt.Sprintf("%s%s/bstore/%s/%s", tls, c.Request.Host, dir_name, stream_fname)
+	stream_path := (&url.URL{Path: route + dir + "/" + fname}).EscapedPath()
+	return fmt.Sprintf("%s%s%s", tls, c.Request.Host, stream_path)
 }
 
-func (v *VideoEncoder) getHWAccelFlags() (string, string) {
+func (v *VideoEncoder) getHWAccelFlags() ([]string, string) {
 	switch v.GPUType {
 	case NvidiaGPU:
 		gpuInfo, err := cmd.GetCMD("nvidia-smi", "--query-gpu=gpu_name", "--format=csv,noheader")
 		if err == nil && strings.Contains(strings.ToLower(gpuInfo), "40") && strings.Contains(v.Codec, "av1") {
-			return "-hwaccel cuda -hwaccel_output_format cuda", "av1_nvenc"
+			return []string{"-hwaccel", "cuda", "-hwaccel_output_format", "cuda"}, "av1_nvenc"
 		}
-		return "-hwaccel cuda -hwaccel_output_format cuda", "h264_nvenc"
+		return []string{"-hwaccel", "cuda", "-hwaccel_output_format", "cuda"}, "h264_nvenc"
 	case AppleGPU:
-		return "-hwaccel videotoolbox", "h264_videotoolbox"
+		return []string{"-hwaccel", "videotoolbox"}, "h264_videotoolbox"
+	case VAAPIGPU:
+		return []string{"-hwaccel", "vaapi", "-hwaccel_device", vaapiDevice, "-hwaccel_output_format", "vaapi"}, "h264_vaapi"
+	case QSVGPU:
+		return []string{"-hwaccel", "qsv", "-hwaccel_output_format", "qsv"}, "h264_qsv"
+	case V4L2GPU:
+		// the stateful V4L2 codecs only encode, decoding and scaling stay in software
+		return nil, "h264_v4l2m2m"
 	default:
-		return "", v.Codec
+		return nil, v.Codec
+	}
+}
+
+// progressFlags makes ffmpeg report machine readable progress on stdout instead of stats on stderr.
+func (v *VideoEncoder) progressFlags() []string {
+	if v.Progress {
+		return []string{"-progress", "pipe:1", "-nostats"}
 	}
+	return nil
+}
+
+func parseBitrate(bitrate string) int {
+	kbps, err := strconv.Atoi(strings.TrimSuffix(bitrate, "k"))
+	if err != nil || kbps < 1 {
+		return DEFAULT_BITRATE
+	}
+	return kbps
 }
 
 func formatBitrate(bitrate int) string {
@@ -105,10 +257,13 @@ func formatBitrate(bitrate int) string {
 func (v *VideoEncoder) VideoBuilder(method int) error {
 	log.Println("Building video for", method)
 	v.StreamType = method
-	v.GPUType = detectGPU()
+	if gpu, ok := Hardware[v.Hardware]; ok {
+		v.GPUType = gpu
+	} else {
+		v.GPUType = detectedGPU()
+	}
 
 	if v.Codec == "auto" {
-		fmt.Println("Auto codec")
 		if v.GPUType == NvidiaGPU {
 			v.Codec = "libaom-av1"
 		} else {
@@ -122,23 +277,12 @@ func (v *VideoEncoder) VideoBuilder(method int) error {
 	}
 
 	v.SetOutput()
+	v.SetLadder()
 	v.SetCommand()
-	v.Print()
 
 	return nil
 }
 
-func (v *VideoEncoder) Print() {
-	fmt.Println("InputFile:", v.InputFile)
-	fmt.Println("OutputDir:", v.OutputDir)
-	fmt.Println("OutputFile:", v.OutputFile)
-	fmt.Println("Codec:", v.Codec)
-	fmt.Println("Audio:", v.Audio)
-	fmt.Println("Command:", v.Command)
-	fmt.Println("GPUType:", v.GPUType)
-	fmt.Println("Bitrate:", v.Bitrate)
-}
-
 func (v *VideoEncoder) SetOutput() {
 	v.SetOutputDir()
 	v.SetOutputFile()
@@ -156,6 +300,18 @@ func (v *VideoEncoder) SetOutputFile() {
 	v.OutputFile = fmt.Sprintf("%s/%s", v.OutputDir, MethodFMap[v.StreamType])
 }
 
+// SoftwareArgs is the command without hardware acceleration, nil when it has none.
+func (v *VideoEncoder) SoftwareArgs() []string {
+	if v.GPUType == NoGPU {
+		return nil
+	}
+
+	software := *v
+	software.GPUType = NoGPU
+	software.SetCommand()
+	return software.Args
+}
+
 func (v *VideoEncoder) SetCommand() {
 	switch v.StreamType {
 	case DASH:
@@ -191,74 +347,163 @@ func (v *VideoEncoder) CheckCodec() bool {
 	return true
 }
 
+// CheckAudio lists the audio tracks of the input, each becomes its own rendition.
 func (v *VideoEncoder) CheckAudio() {
-	has_audio, err := cmd.GetCMD("ffprobe", "-i", v.InputFile, "-show_streams", "-select_streams", "a", "-loglevel", "error")
-	if err != nil || has_audio == "" {
-		v.Audio = false
+	v.Audio = nil
+	if v.Info != nil {
+		v.Audio = v.Info.Audio
+	}
+}
+
+// SetLadder drops rungs taller than the source so nothing is upscaled. With no ladder the
+// source is encoded once at Bitrate, and if every rung is too tall the smallest one is
+// kept at the source height. When the source height is unknown every rung is kept, each
+// scaled to its own height.
+func (v *VideoEncoder) SetLadder() {
+	if len(v.Ladder) == 0 {
+		v.Ladder = []Rung{{Name: "source", Bitrate: parseBitrate(v.Bitrate)}}
+		return
+	}
+
+	height := 0
+	if v.Info != nil {
+		height = v.Info.Height
+	}
+	if height == 0 {
 		return
 	}
 
-	v.Audio = true
+	var ladder []Rung
+	smallest := v.Ladder[0]
+	for _, rung := range v.Ladder {
+		if rung.Height <= height {
+			ladder = append(ladder, rung)
+		}
+		if rung.Height < smallest.Height {
+			smallest = rung
+		}
+	}
+
+	if len(ladder) == 0 {
+		smallest.Height = height
+		ladder = []Rung{smallest}
+	}
+	v.Ladder = ladder
 }
 
-func (v *VideoEncoder) DASHcmd() {
+// ladderFilter splits the video into one scaled output per rung, labelled [v0], [v1], ...
+func (v *VideoEncoder) ladderFilter() string {
+	scale := "scale=-2:%d"
+	if hw, ok := hwScale[v.GPUType]; ok {
+		scale = hw
+	}
+
+	filter := fmt.Sprintf("[0:v:0]split=%d", len(v.Ladder))
+	for i := range v.Ladder {
+		filter += fmt.Sprintf("[s%d]", i)
+	}
+	for i, rung := range v.Ladder {
+		if rung.Height == 0 {
+			filter += fmt.Sprintf(";[s%d]null[v%d]", i, i)
+		} else {
+			filter += fmt.Sprintf(";[s%d]"+scale+"[v%d]", i, rung.Height, i)
+		}
+	}
+	return filter
+}
+
+// ladderMaps maps every rung with its own bitrate, then every audio track once tagged
+// with its language, label and whether it is the default.
+func (v *VideoEncoder) ladderMaps() []string {
+	var maps []string
+	for i, rung := range v.Ladder {
+		maps = append(maps,
+			"-map", fmt.Sprintf("[v%d]", i),
+			fmt.Sprintf("-b:v:%d", i), fmt.Sprintf("%dk", rung.Bitrate),
+			fmt.Sprintf("-maxrate:v:%d", i), fmt.Sprintf("%dk", rung.Bitrate),
+			fmt.Sprintf("-bufsize:v:%d", i), fmt.Sprintf("%dk", rung.Bitrate*2))
+	}
+
+	default_audio := defaultAudio(v.Audio)
+	for i, track := range v.Audio {
+		role := "alternate"
+		if i == default_audio {
+			role = "main"
+		}
+
+		maps = append(maps, "-map", fmt.Sprintf("0:a:%d", i),
+			fmt.Sprintf("-metadata:s:a:%d", i), "title="+audio_label(i, track),
+			fmt.Sprintf("-metadata:s:a:%d", i), "role="+role)
+		if validLanguage.MatchString(track.Language) {
+			maps = append(maps, fmt.Sprintf("-metadata:s:a:%d", i), "language="+track.Language)
+		}
+	}
+	return maps
+}
+
+// encodeArgs is everything up to the muxer, shared by DASH and HLS.
+func (v *VideoEncoder) encodeArgs(audio_codec string) []string {
 	hwaccel, encoder := v.getHWAccelFlags()
-	audio_cmd := "-c:a libopus -b:a 128k"
-	segment_cmd := `-dash_segment_type mp4 -adaptation_sets "id=0,streams=v id=1,streams=a"`
 
-	if !v.Audio {
-		audio_cmd = ""
-		segment_cmd = `-dash_segment_type mp4 -adaptation_sets "id=0,streams=v"`
+	args := append(v.progressFlags(), hwaccel...)
+	args = append(args, "-i", v.InputFile, "-filter_complex", v.ladderFilter())
+	args = append(args, v.ladderMaps()...)
+	args = append(args, "-c:v", encoder)
+	args = append(args, encoderPresets[encoder]...)
+	args = append(args, "-keyint_min", "150", "-g", "150", "-sc_threshold", "0")
+	if len(v.Audio) > 0 {
+		args = append(args, "-c:a", audio_codec, "-b:a", "128k")
 	}
+	return args
+}
 
-	// Escape the file paths
-	inputFile := shellEscape(v.InputFile)
-	outputFile := shellEscape(v.OutputFile)
+// DASHcmd puts the rungs in one adaptation set and every audio track in its own, the
+// output streams are numbered rungs first.
+func (v *VideoEncoder) DASHcmd() {
+	adaptation_sets := []string{"id=0,streams=v"}
+	for i := range v.Audio {
+		adaptation_sets = append(adaptation_sets, fmt.Sprintf("id=%d,streams=%d", i+1, len(v.Ladder)+i))
+	}
 
-	v.Command = fmt.Sprintf(`ffmpeg %s -i %s \
-        -map 0 -c:v %s -preset p2 -b:v %s -maxrate %s -bufsize %s \
-        -keyint_min 150 -g 150 -sc_threshold 0 %s \
-        -f dash -seg_duration 4 -use_template 1 -use_timeline 1 \
-        -init_seg_name init-\$RepresentationID\$.m4s \
-        -media_seg_name chunk-\$RepresentationID\$-\$Number\$.m4s \
-        %s \
-        %s`,
-		hwaccel, inputFile, encoder, v.Bitrate, v.Bitrate, v.Bitrate,
-		audio_cmd, segment_cmd, outputFile)
+	v.Args = append(v.encodeArgs("libopus"),
+		"-f", "dash", "-seg_duration", "4", "-use_template", "1", "-use_timeline", "1",
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number$.m4s",
+		"-dash_segment_type", "mp4", "-adaptation_sets", strings.Join(adaptation_sets, " "),
+		v.OutputFile)
 }
 
+// HLScmd writes one playlist per rung, `index_<rung>.m3u8`, one per audio track,
+// `index_audio_<n>.m3u8`, and the master playlist at OutputFile listing the rungs as
+// variant streams sharing the audio tracks as renditions.
 func (v *VideoEncoder) HLScmd() {
-	hwaccel, encoder := v.getHWAccelFlags()
-	audio_cmd := "-c:a aac -b:a 128k"
-	segment_cmd := `-var_stream_map "v:0,a:0"`
-
-	if !v.Audio {
-		audio_cmd = ""
-		segment_cmd = `-var_stream_map "v:0"`
-	}
-
-	// Escape the file paths
-	inputFile := shellEscape(v.InputFile)
-	outputFile := shellEscape(v.OutputFile)
-	outputDir := shellEscape(v.OutputDir)
-
-	v.Command = fmt.Sprintf(`ffmpeg %s -i %s \
-        -map 0 -c:v %s -preset p2 -b:v %s -maxrate %s -bufsize %s \
-        -keyint_min 150 -g 150 -sc_threshold 0 %s \
-        -f hls \
-        -hls_time 4 \
-        -hls_playlist_type vod \
-        -hls_segment_filename %s/segment_%%03d.ts \
-        -master_pl_name /master.m3u8 \
-        %s \
-        %s`,
-		hwaccel, inputFile, encoder, v.Bitrate, v.Bitrate, v.Bitrate,
-		audio_cmd, outputDir, segment_cmd, outputFile)
-}
-
-func shellEscape(s string) string {
-	s = strings.Replace(s, "'", "'\\''", -1)
-	return "'" + s + "'"
+	// audio first, ffmpeg names the renditions after their position in the map
+	var variants []string
+	default_audio := defaultAudio(v.Audio)
+	for i, track := range v.Audio {
+		variant := fmt.Sprintf("a:%d,agroup:audio,name:audio_%d", i, i)
+		if validLanguage.MatchString(track.Language) {
+			variant += ",language:" + track.Language
+		}
+		if i == default_audio {
+			variant += ",default:yes"
+		}
+		variants = append(variants, variant)
+	}
+	for i, rung := range v.Ladder {
+		if len(v.Audio) > 0 {
+			variants = append(variants, fmt.Sprintf("v:%d,agroup:audio,name:%s", i, rung.Name))
+		} else {
+			variants = append(variants, fmt.Sprintf("v:%d,name:%s", i, rung.Name))
+		}
+	}
+
+	v.Args = append(v.encodeArgs("aac"),
+		"-f", "hls", "-hls_time", "4", "-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(v.OutputDir, "segment_%v_%03d.ts"),
+		"-master_pl_name", MethodFMap[HLS],
+		"-var_stream_map", strings.Join(variants, " "),
+		filepath.Join(v.OutputDir, "index_%v.m3u8"))
 }
 
 func CheckEXT(fname string) bool {
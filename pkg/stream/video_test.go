@@ -0,0 +1,288 @@
+package stream
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var testLadder = []Rung{
+	{Name: "720p", Height: 720, Bitrate: 2800},
+	{Name: "480p", Height: 480, Bitrate: 1400},
+}
+
+func test_encoder(method int, gpu GPUType, audio []Track, ladder []Rung) *VideoEncoder {
+	v := &VideoEncoder{
+		InputFile:  "/jobs/1/movie.mp4",
+		OutputDir:  "/jobs/1/movie",
+		StreamType: method,
+		Codec:      "libx264",
+		Audio:      audio,
+		GPUType:    gpu,
+		Ladder:     ladder,
+	}
+	v.SetOutputFile()
+	v.SetCommand()
+	return v
+}
+
+func TestVideoArgs(t *testing.T) {
+	// nvidia-smi must not be found, the NVENC encoder is picked from it
+	t.Setenv("PATH", t.TempDir())
+
+	gpus := []struct {
+		gpu     GPUType
+		hwaccel []string
+		encoder []string
+		scale   string
+	}{
+		{NoGPU, nil, []string{"libx264", "-preset", "veryfast"}, "scale=-2:%d"},
+		{NvidiaGPU, []string{"-hwaccel", "cuda", "-hwaccel_output_format", "cuda"}, []string{"h264_nvenc", "-preset", "p2"}, "scale_cuda=-2:%d"},
+		{AppleGPU, []string{"-hwaccel", "videotoolbox"}, []string{"h264_videotoolbox"}, "scale=-2:%d"},
+		{VAAPIGPU, []string{"-hwaccel", "vaapi", "-hwaccel_device", "/dev/dri/renderD128", "-hwaccel_output_format", "vaapi"}, []string{"h264_vaapi"}, "scale_vaapi=w=-2:h=%d"},
+		{QSVGPU, []string{"-hwaccel", "qsv", "-hwaccel_output_format", "qsv"}, []string{"h264_qsv", "-preset", "veryfast"}, "scale_qsv=w=-2:h=%d"},
+		{V4L2GPU, nil, []string{"h264_v4l2m2m"}, "scale=-2:%d"},
+	}
+
+	maps := []string{
+		"-map", "[v0]", "-b:v:0", "2800k", "-maxrate:v:0", "2800k", "-bufsize:v:0", "5600k",
+		"-map", "[v1]", "-b:v:1", "1400k", "-maxrate:v:1", "1400k", "-bufsize:v:1", "2800k",
+		"-map", "0:a:0", "-metadata:s:a:0", "title=eng (stereo)", "-metadata:s:a:0", "role=main", "-metadata:s:a:0", "language=eng",
+		"-map", "0:a:1", "-metadata:s:a:1", `title=Commentary "director"`, "-metadata:s:a:1", "role=alternate", "-metadata:s:a:1", "language=fra",
+	}
+	gop := []string{"-keyint_min", "150", "-g", "150", "-sc_threshold", "0"}
+
+	for _, g := range gpus {
+		filter := fmt.Sprintf("[0:v:0]split=2[s0][s1];[s0]"+g.scale+"[v0];[s1]"+g.scale+"[v1]", 720, 480)
+		encode := func(audio_codec string) []string {
+			args := slices.Concat(g.hwaccel, []string{"-i", "/jobs/1/movie.mp4", "-filter_complex", filter}, maps, []string{"-c:v"}, g.encoder, gop)
+			return append(args, "-c:a", audio_codec, "-b:a", "128k")
+		}
+
+		tests := []struct {
+			method int
+			want   []string
+		}{
+			{DASH, append(encode("libopus"),
+				"-f", "dash", "-seg_duration", "4", "-use_template", "1", "-use_timeline", "1",
+				"-init_seg_name", "init-$RepresentationID$.m4s",
+				"-media_seg_name", "chunk-$RepresentationID$-$Number$.m4s",
+				"-dash_segment_type", "mp4", "-adaptation_sets", "id=0,streams=v id=1,streams=2 id=2,streams=3",
+				"/jobs/1/movie/index.mpd")},
+			{HLS, append(encode("aac"),
+				"-f", "hls", "-hls_time", "4", "-hls_playlist_type", "vod",
+				"-hls_segment_filename", "/jobs/1/movie/segment_%v_%03d.ts",
+				"-master_pl_name", "index.m3u8",
+				"-var_stream_map", "a:0,agroup:audio,name:audio_0,language:eng,default:yes a:1,agroup:audio,name:audio_1,language:fra v:0,agroup:audio,name:720p v:1,agroup:audio,name:480p",
+				"/jobs/1/movie/index_%v.m3u8")},
+		}
+
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/%s", MethodFMap[tt.method], g.gpu), func(t *testing.T) {
+				got := test_encoder(tt.method, g.gpu, testTracks, testLadder).Args
+				if !slices.Equal(got, tt.want) {
+					t.Fatalf("argv =\n%q\nwant\n%q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestVideoArgsSourceWithoutAudio(t *testing.T) {
+	ladder := []Rung{{Name: "source", Bitrate: 1000}}
+	common := []string{
+		"-i", "/jobs/1/movie.mp4", "-filter_complex", "[0:v:0]split=1[s0];[s0]null[v0]",
+		"-map", "[v0]", "-b:v:0", "1000k", "-maxrate:v:0", "1000k", "-bufsize:v:0", "2000k",
+		"-c:v", "libx264", "-preset", "veryfast", "-keyint_min", "150", "-g", "150", "-sc_threshold", "0",
+	}
+
+	dash := test_encoder(DASH, NoGPU, nil, ladder).Args
+	if !slices.Equal(dash[:len(common)], common) || slices.Contains(dash, "-c:a") {
+		t.Fatalf("DASH argv = %q", dash)
+	}
+	if i := slices.Index(dash, "-adaptation_sets"); i < 0 || dash[i+1] != "id=0,streams=v" {
+		t.Fatalf("DASH adaptation sets = %q", dash)
+	}
+
+	hls := test_encoder(HLS, NoGPU, nil, ladder).Args
+	if !slices.Equal(hls[:len(common)], common) || slices.Contains(hls, "-c:a") {
+		t.Fatalf("HLS argv = %q", hls)
+	}
+	if i := slices.Index(hls, "-var_stream_map"); i < 0 || hls[i+1] != "v:0,name:source" {
+		t.Fatalf("HLS var_stream_map = %q", hls)
+	}
+}
+
+func TestSoftwareArgs(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	if args := test_encoder(DASH, NoGPU, testTracks, testLadder).SoftwareArgs(); args != nil {
+		t.Fatalf("software encoder has a fallback %q", args)
+	}
+
+	software := test_encoder(HLS, NoGPU, testTracks, testLadder).Args
+	for _, gpu := range []GPUType{NvidiaGPU, VAAPIGPU, QSVGPU, V4L2GPU} {
+		if args := test_encoder(HLS, gpu, testTracks, testLadder).SoftwareArgs(); !slices.Equal(args, software) {
+			t.Fatalf("%s fallback =\n%q\nwant\n%q", gpu, args, software)
+		}
+	}
+}
+
+func TestSetLadder(t *testing.T) {
+	tests := []struct {
+		name   string
+		height int
+		ladder []Rung
+		want   string
+	}{
+		{name: "no ladder", height: 1080, want: "source:0:1000"},
+		{name: "drops taller rungs", height: 720, ladder: DefaultLadder, want: "720p:720:2800 480p:480:1400 360p:360:800"},
+		{name: "all too tall", height: 240, ladder: DefaultLadder, want: "360p:240:800"},
+		{name: "unknown height", height: 0, ladder: DefaultLadder, want: "1080p:1080:5000 720p:720:2800 480p:480:1400 360p:360:800"},
+		{name: "not probed", height: -1, ladder: DefaultLadder, want: "1080p:1080:5000 720p:720:2800 480p:480:1400 360p:360:800"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &VideoEncoder{Ladder: slices.Clone(tt.ladder)}
+			if tt.height >= 0 {
+				v.Info = &VideoInfo{Height: tt.height}
+			}
+			v.SetLadder()
+
+			var got []string
+			for _, rung := range v.Ladder {
+				got = append(got, fmt.Sprintf("%s:%d:%d", rung.Name, rung.Height, rung.Bitrate))
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Fatalf("ladder = %s, want %s", strings.Join(got, " "), tt.want)
+			}
+		})
+	}
+}
+
+// fake_devices points hardware detection at device nodes made up for the test.
+func fake_devices(t *testing.T, dri, v4l2 bool) {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, ok := range map[string]bool{"renderD128": dri, "video0": v4l2} {
+		if !ok {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old_dri, old_v4l2 := driDevices, v4l2Devices
+	driDevices, v4l2Devices = filepath.Join(dir, "renderD*"), filepath.Join(dir, "video*")
+	t.Cleanup(func() {
+		driDevices, v4l2Devices = old_dri, old_v4l2
+		reset_detected_gpu()
+	})
+	reset_detected_gpu()
+}
+
+func TestDetectGPU(t *testing.T) {
+	tests := []struct {
+		name     string
+		hwaccels string
+		encoders string
+		dri      bool
+		v4l2     bool
+		want     GPUType
+	}{
+		{name: "vaapi", hwaccels: "vdpau vaapi", encoders: "libx264 h264_vaapi", dri: true, want: VAAPIGPU},
+		{name: "qsv", hwaccels: "qsv", encoders: "libx264 h264_qsv", dri: true, want: QSVGPU},
+		{name: "vaapi before qsv", hwaccels: "vaapi qsv", encoders: "h264_qsv h264_vaapi", dri: true, want: VAAPIGPU},
+		{name: "v4l2", encoders: "libx264 h264_v4l2m2m", v4l2: true, want: V4L2GPU},
+		{name: "vaapi without device", hwaccels: "vaapi", encoders: "h264_vaapi", want: NoGPU},
+		{name: "vaapi without encoder", hwaccels: "vaapi", encoders: "libx264 hevc_vaapi", dri: true, want: NoGPU},
+		{name: "v4l2 without device", encoders: "h264_v4l2m2m", dri: true, want: NoGPU},
+		{name: "software", encoders: "libx264", dri: true, v4l2: true, want: NoGPU},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub_ffmpeg(t)
+			t.Setenv("STUB_HWACCELS", tt.hwaccels)
+			t.Setenv("STUB_ENCODERS", tt.encoders)
+			fake_devices(t, tt.dri, tt.v4l2)
+
+			if got := detectGPU(); got != tt.want {
+				t.Fatalf("detectGPU() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectedGPUCached(t *testing.T) {
+	log := stub_ffmpeg(t)
+	t.Setenv("STUB_HWACCELS", "vaapi")
+	t.Setenv("STUB_ENCODERS", "h264_vaapi")
+	fake_devices(t, true, false)
+
+	if gpu := detectedGPU(); gpu != VAAPIGPU {
+		t.Fatalf("detectedGPU() = %s, want vaapi", gpu)
+	}
+	t.Setenv("STUB_ENCODERS", "")
+	if gpu := detectedGPU(); gpu != VAAPIGPU {
+		t.Fatalf("second detectedGPU() = %s, want the cached vaapi", gpu)
+	}
+	if calls := stub_calls(t, log); len(calls) != 2 {
+		t.Fatalf("ffmpeg calls = %q, want one detection", calls)
+	}
+
+	reset_detected_gpu()
+	if gpu := detectedGPU(); gpu != NoGPU {
+		t.Fatalf("detectedGPU() after reset = %s, want software", gpu)
+	}
+}
+
+func TestVideoBuilderHardware(t *testing.T) {
+	tests := []struct {
+		hardware string
+		want     GPUType
+		encoder  string
+	}{
+		{hardware: "", want: QSVGPU, encoder: "h264_qsv"},
+		{hardware: "auto", want: QSVGPU, encoder: "h264_qsv"},
+		{hardware: "software", want: NoGPU, encoder: "libx264"},
+		{hardware: "vaapi", want: VAAPIGPU, encoder: "h264_vaapi"},
+		{hardware: "v4l2", want: V4L2GPU, encoder: "h264_v4l2m2m"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hardware, func(t *testing.T) {
+			stub_ffmpeg(t)
+			t.Setenv("STUB_HWACCELS", "qsv")
+			t.Setenv("STUB_ENCODERS", "libx264 h264_qsv")
+			fake_devices(t, true, false)
+
+			v := &VideoEncoder{
+				InputFile: filepath.Join(t.TempDir(), "movie.mp4"),
+				Codec:     "auto",
+				Hardware:  tt.hardware,
+				Info:      &VideoInfo{Height: 720, Audio: testTracks},
+				Ladder:    testLadder,
+			}
+			if err := v.VideoBuilder(HLS); err != nil {
+				t.Fatal(err)
+			}
+
+			if v.GPUType != tt.want {
+				t.Fatalf("GPUType = %s, want %s", v.GPUType, tt.want)
+			}
+			if i := slices.Index(v.Args, "-c:v"); i < 0 || v.Args[i+1] != tt.encoder {
+				t.Fatalf("argv = %q, want encoder %s", v.Args, tt.encoder)
+			}
+			if (v.SoftwareArgs() == nil) != (tt.want == NoGPU) {
+				t.Fatalf("SoftwareArgs() = %q", v.SoftwareArgs())
+			}
+		})
+	}
+}